@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// authToken returns the source of the bearer token requests are authenticated with, or nil if
+// neither AuthToken nor AuthTokenProvider is set.
+func (m *manager) authToken() func(context.Context) (string, error) {
+	switch {
+	case m.AuthTokenProvider != nil:
+		return m.AuthTokenProvider
+	case m.AuthToken != "":
+		token := m.AuthToken
+		return func(context.Context) (string, error) { return token, nil }
+	default:
+		return nil
+	}
+}
+
+// authTransport sets the Authorization header of each request to a bearer token fetched for
+// that request, so that short-lived tokens are refreshed as needed.
+type authTransport struct {
+	base  http.RoundTripper
+	token func(context.Context) (string, error)
+}
+
+func newAuthTransport(base http.RoundTripper, token func(context.Context) (string, error)) *authTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &authTransport{
+		base:  base,
+		token: token,
+	}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		// the error is the provider's, the token itself is never part of it
+		return nil, fmt.Errorf("failed to get auth token: %w", err)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// withoutAuth returns the given client without the auth token of an authTransport, for requests
+// to third parties that must not see it.
+func withoutAuth(httpClient *http.Client) *http.Client {
+	if t, ok := httpClient.Transport.(*authTransport); ok {
+		unauthenticated := *httpClient
+		unauthenticated.Transport = t.base
+		return &unauthenticated
+	}
+	return httpClient
+}
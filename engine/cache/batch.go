@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"encoding/json"
+)
+
+// batchCacheRecords splits the given keys and links, and the removed ones of a delta export, into
+// UpdateCacheRecords requests whose estimated serialized size stays within maxBytes. Links are sent
+// in the same request as the key they're links of, and a key that exceeds the budget on its own is
+// sent in a request by itself. Links of keys that aren't given, and removed keys and links, follow
+// the keys, in as many further requests as they need. There's always at least one request.
+func batchCacheRecords(cacheKeys []CacheKey, links []Link, removedKeys []string, removedLinks []Link, maxBytes int) ([]UpdateCacheRecordsRequest, error) {
+	keyLinks := make(map[string][]Link, len(cacheKeys))
+	for _, link := range links {
+		keyLinks[link.ID] = append(keyLinks[link.ID], link)
+	}
+
+	// the size of a request without any keys or links, with each key and link adding its own size
+	// plus a separator; the removed fields are left out of it when empty, so are counted as set
+	emptyRequest, err := json.Marshal(UpdateCacheRecordsRequest{Incremental: true, Delta: true, MoreBatches: true})
+	if err != nil {
+		return nil, err
+	}
+	emptySize := len(emptyRequest) + len(`"RemovedCacheKeys":[],"RemovedLinks":[],`)
+	itemSize := func(item any) (int, error) {
+		b, err := json.Marshal(item)
+		return len(b) + 1, err
+	}
+
+	var batches []UpdateCacheRecordsRequest
+	var batch UpdateCacheRecordsRequest
+	batchSize := emptySize
+	// reserve starts a new batch if size doesn't fit in the current one, unless it's empty
+	reserve := func(size int) {
+		if batchSize > emptySize && batchSize+size > maxBytes {
+			batches = append(batches, batch)
+			batch = UpdateCacheRecordsRequest{}
+			batchSize = emptySize
+		}
+		batchSize += size
+	}
+
+	for _, cacheKey := range cacheKeys {
+		size, err := itemSize(cacheKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range keyLinks[cacheKey.ID] {
+			linkSize, err := itemSize(link)
+			if err != nil {
+				return nil, err
+			}
+			size += linkSize
+		}
+		reserve(size)
+		batch.CacheKeys = append(batch.CacheKeys, cacheKey)
+		batch.Links = append(batch.Links, keyLinks[cacheKey.ID]...)
+		delete(keyLinks, cacheKey.ID)
+	}
+
+	for _, link := range links {
+		if _, ok := keyLinks[link.ID]; !ok {
+			continue
+		}
+		size, err := itemSize(link)
+		if err != nil {
+			return nil, err
+		}
+		reserve(size)
+		batch.Links = append(batch.Links, link)
+	}
+	for _, id := range removedKeys {
+		size, err := itemSize(id)
+		if err != nil {
+			return nil, err
+		}
+		reserve(size)
+		batch.RemovedCacheKeys = append(batch.RemovedCacheKeys, id)
+	}
+	for _, link := range removedLinks {
+		size, err := itemSize(link)
+		if err != nil {
+			return nil, err
+		}
+		reserve(size)
+		batch.RemovedLinks = append(batch.RemovedLinks, link)
+	}
+	return append(batches, batch), nil
+}
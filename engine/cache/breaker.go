@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"cmp"
+	"context"
+	"hash/fnv"
+	"math/rand/v2"
+	"time"
+
+	"github.com/moby/buildkit/util/bklog"
+)
+
+// the longest the periodic imports and exports back off to if CircuitBreakerMaxPeriod isn't set
+const defaultCircuitBreakerMaxPeriod = time.Hour
+
+// loopBreaker tracks consecutive failures of the periodic imports or exports, backing off the
+// period between them once CircuitBreakerThreshold is reached so that an unavailable service
+// isn't called, and the failure logged, every period.
+type loopBreaker struct {
+	op        string        // what the loop does, e.g. "import"
+	period    time.Duration // updated when the config is reloaded
+	maxPeriod time.Duration // ignored if less than period
+	threshold int           // never backs off if zero
+	jitter    float64       // fraction of each wait that's randomized either way, from 0 to 1
+	rand      *rand.Rand    // seeded with the engine ID and op
+
+	failures int // consecutive failures so far
+}
+
+func (m *manager) newLoopBreaker(op string, period time.Duration) *loopBreaker {
+	seed := fnv.New64a()
+	seed.Write([]byte(m.EngineID))
+	seed.Write([]byte(op))
+	return &loopBreaker{
+		op:        op,
+		period:    period,
+		maxPeriod: cmp.Or(m.CircuitBreakerMaxPeriod, defaultCircuitBreakerMaxPeriod),
+		threshold: m.CircuitBreakerThreshold,
+		jitter:    min(max(m.LoopJitter, 0), 1),
+		rand:      rand.New(rand.NewPCG(seed.Sum64(), 0)),
+	}
+}
+
+// next records the outcome of the latest run of the loop, returning how long to wait before the
+// next one.
+func (b *loopBreaker) next(ctx context.Context, err error) time.Duration {
+	if err == nil {
+		if b.open() {
+			bklog.G(ctx).Infof("cache %s succeeded again after %d failures, resuming every %s", b.op, b.failures, b.period)
+		}
+		b.failures = 0
+		return b.wait()
+	}
+
+	b.failures++
+	if !b.open() {
+		bklog.G(ctx).WithError(err).Errorf("failed to %s cache", b.op)
+		return b.wait()
+	}
+	backoff := b.wait()
+	if b.failures == b.threshold {
+		bklog.G(ctx).WithError(err).Errorf("failed to %s cache %d times in a row, backing off until it succeeds again", b.op, b.failures)
+	} else {
+		bklog.G(ctx).WithError(err).Debugf("failed to %s cache, retrying in %s", b.op, backoff)
+	}
+	return backoff
+}
+
+// open returns whether the loop is backing off.
+func (b *loopBreaker) open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// wait returns how long to wait before the next run of the loop: the period, or while backing
+// off, the period doubled with each failure past the threshold, up to maxPeriod, randomized by
+// the jitter.
+func (b *loopBreaker) wait() time.Duration {
+	wait := b.backoff()
+	if b.jitter == 0 {
+		return wait
+	}
+	return wait + time.Duration(b.jitter*(2*b.rand.Float64()-1)*float64(wait))
+}
+
+// backoff returns the wait before the next run of the loop before jitter.
+func (b *loopBreaker) backoff() time.Duration {
+	if !b.open() {
+		return b.period
+	}
+	maxPeriod := max(b.maxPeriod, b.period)
+	backoff := b.period
+	for range b.failures - b.threshold + 1 {
+		backoff *= 2
+		if backoff >= maxPeriod {
+			return maxPeriod
+		}
+	}
+	return backoff
+}
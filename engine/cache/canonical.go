@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	createdAtAnnotation          = "buildkit/createdat"
+	distributionSourceAnnotation = "containerd.io/distribution.source."
+)
+
+// normalizeRecordLayers returns a canonical form of the given records, so that engines exporting
+// identical content send byte-identical UpdateCacheLayers requests.
+//
+// Records are sorted by digest and annotations that vary between engines or over time (creation
+// timestamps, distribution sources) are stripped from each layer. The order of layers within a
+// record is left untouched: it's the order in which the layers are applied on top of each other,
+// so sorting it would change the content the record describes.
+func normalizeRecordLayers(records []RecordLayers) []RecordLayers {
+	normalized := make([]RecordLayers, 0, len(records))
+	for _, record := range records {
+		normalizedRecord := RecordLayers{
+			RecordDigest: record.RecordDigest,
+			Layers:       normalizeDescriptors(record.Layers),
+		}
+		for _, variant := range record.Variants {
+			normalizedRecord.Variants = append(normalizedRecord.Variants, normalizeDescriptors(variant))
+		}
+		normalized = append(normalized, normalizedRecord)
+	}
+	slices.SortStableFunc(normalized, func(a, b RecordLayers) int {
+		return strings.Compare(a.RecordDigest.String(), b.RecordDigest.String())
+	})
+	return normalized
+}
+
+func normalizeDescriptors(descs []ocispecs.Descriptor) []ocispecs.Descriptor {
+	normalized := make([]ocispecs.Descriptor, 0, len(descs))
+	for _, desc := range descs {
+		normalized = append(normalized, normalizeDescriptor(desc))
+	}
+	return normalized
+}
+
+func normalizeDescriptor(desc ocispecs.Descriptor) ocispecs.Descriptor {
+	var annotations map[string]string
+	for k, v := range desc.Annotations {
+		if k == createdAtAnnotation || strings.HasPrefix(k, distributionSourceAnnotation) {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[k] = v
+	}
+	desc.Annotations = annotations
+	return desc
+}
+
+// normalizeCacheRecords returns a canonical form of the given keys and links, so that engines
+// exporting identical content send byte-identical UpdateCacheRecords requests.
+//
+// Keys are sorted by ID, the results of each key by ID and links by all their fields, with
+// duplicate links dropped. Timestamps are converted to UTC so they serialize the same regardless
+// of the engine's time zone.
+func normalizeCacheRecords(cacheKeys []CacheKey, links []Link) ([]CacheKey, []Link) {
+	normalizedKeys := make([]CacheKey, 0, len(cacheKeys))
+	for _, cacheKey := range cacheKeys {
+		results := make([]Result, 0, len(cacheKey.Results))
+		for _, result := range cacheKey.Results {
+			result.CreatedAt = result.CreatedAt.UTC()
+			if result.ExpiresAt != nil {
+				expiresAt := result.ExpiresAt.UTC()
+				result.ExpiresAt = &expiresAt
+			}
+			results = append(results, result)
+		}
+		slices.SortStableFunc(results, func(a, b Result) int {
+			return cmp.Or(strings.Compare(a.ID, b.ID), a.CreatedAt.Compare(b.CreatedAt))
+		})
+		normalizedKeys = append(normalizedKeys, CacheKey{
+			ID:      cacheKey.ID,
+			Results: results,
+		})
+	}
+	slices.SortStableFunc(normalizedKeys, func(a, b CacheKey) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	normalizedLinks := slices.Clone(links)
+	slices.SortFunc(normalizedLinks, compareLinks)
+	normalizedLinks = slices.Compact(normalizedLinks)
+	return normalizedKeys, normalizedLinks
+}
+
+func compareLinks(a, b Link) int {
+	return cmp.Or(
+		strings.Compare(a.ID, b.ID),
+		strings.Compare(a.LinkedID, b.LinkedID),
+		cmp.Compare(a.Input, b.Input),
+		strings.Compare(a.Digest.String(), b.Digest.String()),
+		strings.Compare(a.Selector.String(), b.Selector.String()),
+	)
+}
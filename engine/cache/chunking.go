@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/containerd/containerd/content"
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+/*
+Chunked layers are split into chunks using content-defined chunking, so that a small change to a
+layer only changes the chunks around it rather than shifting every chunk boundary after it. Each
+chunk is uploaded as a blob of its own under its digest, which lets the service skip chunks it
+already has, e.g. from a previous version of the layer.
+
+The blob uploaded for the layer itself then only holds a manifest of its chunks: the magic string
+chunkManifestMagic followed by the JSON encoded chunkManifest. The manifest is never encrypted, as
+it only holds chunk digests the service already knows; the chunks are encrypted like whole layers.
+*/
+
+const (
+	chunkManifestMagic = "DGRCDC01"
+	minChunkSize       = 256 * 1024
+	maxChunkSize       = 4 * 1024 * 1024
+
+	// boundaries are cut where the top 20 bits of the rolling hash are zero, for an average of
+	// ~1MiB on top of the minimum chunk size
+	chunkBoundaryMask = uint64(1<<20-1) << 44
+)
+
+// gearTable holds the random values of the gear rolling hash. It's derived deterministically so
+// that all engines cut chunks at the same boundaries.
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+type chunkManifest struct {
+	Chunks []chunkDescriptor
+}
+
+type chunkDescriptor struct {
+	Digest digest.Digest
+	Size   int64
+}
+
+// size returns the size of the layer, the total of its chunks.
+func (m *chunkManifest) size() int64 {
+	var size int64
+	for _, chunk := range m.Chunks {
+		size += chunk.Size
+	}
+	return size
+}
+
+// chunker splits the content read from r into content-defined chunks.
+type chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int // unchunked data in buf
+	err        error
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, 2*maxChunkSize),
+	}
+}
+
+// Next returns the next chunk, which is only valid until the following call, or io.EOF once all
+// content has been chunked.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < maxChunkSize && c.err == nil {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		var n int
+		n, c.err = io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch {
+		case errors.Is(c.err, io.EOF), errors.Is(c.err, io.ErrUnexpectedEOF):
+			c.err = io.EOF
+		case c.err != nil:
+			return nil, c.err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	cut := chunkBoundary(data)
+	c.start += cut
+	return data[:cut], nil
+}
+
+// chunkBoundary returns the length of the first chunk of data.
+func chunkBoundary(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	limit := min(len(data), maxChunkSize)
+	var hash uint64
+	for i := minChunkSize; i < limit; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&chunkBoundaryMask == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
+
+// pushLayerChunks uploads the chunks of the given layer the service doesn't have yet, followed by
+// the layer's chunk manifest.
+func (m *manager) pushLayerChunks(
+	ctx context.Context,
+	layerDesc ocispecs.Descriptor,
+	readerAt content.ReaderAt,
+	manifestUploadURL *GetLayerUploadURLResponse,
+) error {
+	var manifest chunkManifest
+	pushedChunks := map[digest.Digest]struct{}{}
+	chunker := newChunker(content.NewReader(readerAt))
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunkDesc := chunkDescriptor{
+			// chunks are addressed with the same algorithm as their layer
+			Digest: layerDesc.Digest.Algorithm().FromBytes(chunk),
+			Size:   int64(len(chunk)),
+		}
+		manifest.Chunks = append(manifest.Chunks, chunkDesc)
+		if _, ok := pushedChunks[chunkDesc.Digest]; ok {
+			continue
+		}
+
+		getURLResp, err := m.service().GetLayerUploadURL(ctx, GetLayerUploadURLRequest{Digest: chunkDesc.Digest})
+		if err != nil {
+			return err
+		}
+		if !getURLResp.Skip {
+			err := m.putBlob(ctx, getURLResp, func() (io.Reader, int64, error) {
+				return m.encryptBlob(ctx, bytes.NewReader(chunk), chunkDesc.Size)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to push chunk %s of layer %s: %w", chunkDesc.Digest, layerDesc.Digest, err)
+			}
+			pushedChunks[chunkDesc.Digest] = struct{}{}
+		}
+	}
+	bklog.G(ctx).Debugf("pushed %d of %d chunks of layer %s", len(pushedChunks), len(manifest.Chunks), layerDesc.Digest)
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestBlob := append([]byte(chunkManifestMagic), manifestJSON...)
+	return m.putBlob(ctx, manifestUploadURL, func() (io.Reader, int64, error) {
+		return bytes.NewReader(manifestBlob), int64(len(manifestBlob)), nil
+	})
+}
+
+// readChunkManifest returns the chunk manifest held by the given blob, or nil if the blob isn't
+// a chunk manifest.
+func readChunkManifest(ra content.ReaderAt) (*chunkManifest, error) {
+	r := io.NewSectionReader(ra, 0, 1<<62)
+	magic := make([]byte, len(chunkManifestMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// too short to be a manifest
+			return nil, nil
+		}
+		return nil, err
+	}
+	if string(magic) != chunkManifestMagic {
+		return nil, nil
+	}
+	var manifest chunkManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// chunkedReaderAt reads a layer by reassembling it from its chunks, which are opened as needed.
+type chunkedReaderAt struct {
+	ctx       context.Context
+	desc      ocispecs.Descriptor
+	chunks    []chunkDescriptor
+	offsets   []int64 // offset of each chunk within the layer
+	openChunk func(context.Context, ocispecs.Descriptor) (content.ReaderAt, error)
+
+	// the chunk currently open, which is kept around since reads are mostly sequential
+	current         int
+	currentReaderAt content.ReaderAt
+}
+
+func newChunkedReaderAt(
+	ctx context.Context,
+	desc ocispecs.Descriptor,
+	manifest *chunkManifest,
+	openChunk func(context.Context, ocispecs.Descriptor) (content.ReaderAt, error),
+) (*chunkedReaderAt, error) {
+	offsets := make([]int64, len(manifest.Chunks))
+	var size int64
+	for i, chunk := range manifest.Chunks {
+		offsets[i] = size
+		size += chunk.Size
+	}
+	if size != desc.Size {
+		return nil, fmt.Errorf("chunk manifest of layer %s covers %d bytes, expected %d", desc.Digest, size, desc.Size)
+	}
+	return &chunkedReaderAt{
+		ctx:       ctx,
+		desc:      desc,
+		chunks:    manifest.Chunks,
+		offsets:   offsets,
+		openChunk: openChunk,
+		current:   -1,
+	}, nil
+}
+
+func (r *chunkedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off < r.desc.Size {
+		index := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+		chunk := r.chunks[index]
+		if index != r.current {
+			if err := r.closeCurrent(); err != nil {
+				return n, err
+			}
+			readerAt, err := r.openChunk(r.ctx, ocispecs.Descriptor{
+				Digest: chunk.Digest,
+				Size:   chunk.Size,
+			})
+			if err != nil {
+				return n, fmt.Errorf("failed to open chunk %s of layer %s: %w", chunk.Digest, r.desc.Digest, err)
+			}
+			r.current = index
+			r.currentReaderAt = readerAt
+		}
+
+		chunkOff := off - r.offsets[index]
+		read, err := r.currentReaderAt.ReadAt(p[n:n+int(min(int64(len(p)-n), chunk.Size-chunkOff))], chunkOff)
+		n += read
+		off += int64(read)
+		if err != nil && !(errors.Is(err, io.EOF) && chunkOff+int64(read) == chunk.Size) {
+			return n, err
+		}
+		if read == 0 && err == nil {
+			return n, io.ErrNoProgress
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *chunkedReaderAt) Size() int64 {
+	return r.desc.Size
+}
+
+func (r *chunkedReaderAt) Close() error {
+	return r.closeCurrent()
+}
+
+func (r *chunkedReaderAt) closeCurrent() error {
+	if r.currentReaderAt == nil {
+		return nil
+	}
+	err := r.currentReaderAt.Close()
+	r.current = -1
+	r.currentReaderAt = nil
+	return err
+}
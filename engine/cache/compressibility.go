@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/containerd/containerd/content"
+	"github.com/moby/buildkit/cache"
+	cacheconfig "github.com/moby/buildkit/cache/config"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/contentutil"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// how much of an uncompressed layer is compressed to estimate whether it's worth compressing
+	compressibilitySampleSize = 1024 * 1024
+
+	// layers whose sample doesn't shrink below this fraction of its size are considered
+	// incompressible, e.g. because they mostly hold images or archives
+	maxCompressibleRatio = 0.9
+
+	// the range of zstd compression levels, mapped to the levels of buildkit's zstd encoder
+	minZstdLevel = 1
+	maxZstdLevel = 22
+)
+
+// exportRemote returns the remote whose layers should be pushed for the given ref, or nil if it
+// has none.
+func (m *manager) exportRemote(ctx context.Context, cacheRef cache.ImmutableRef) (*solver.Remote, error) {
+	if !m.ContentAwareCompression {
+		return firstRemote(ctx, cacheRef, m.exportCompression())
+	}
+
+	uncompressed, err := firstRemote(ctx, cacheRef, compression.New(compression.Uncompressed))
+	if err != nil || uncompressed == nil {
+		return uncompressed, err
+	}
+	incompressible := make([]bool, len(uncompressed.Descriptors))
+	allIncompressible := true
+	for i, desc := range uncompressed.Descriptors {
+		compressible, err := isCompressible(ctx, uncompressed.Provider, desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sample layer %s: %w", desc.Digest, err)
+		}
+		incompressible[i] = !compressible
+		allIncompressible = allIncompressible && !compressible
+	}
+	if allIncompressible {
+		return uncompressed, nil
+	}
+
+	compressed, err := firstRemote(ctx, cacheRef, m.exportCompression())
+	if err != nil || compressed == nil {
+		return compressed, err
+	}
+	if len(compressed.Descriptors) != len(uncompressed.Descriptors) {
+		bklog.G(ctx).Debugf("layer count of compressed and uncompressed remotes of cache ref %s differ, using compressed", cacheRef.ID())
+		return compressed, nil
+	}
+	return mixRemotes(compressed, uncompressed, incompressible), nil
+}
+
+// exportCompression returns the compression exported layers are compressed with.
+func (m *manager) exportCompression() compression.Config {
+	compressionConfig := m.Compression
+	if compressionConfig.Type == nil {
+		compressionConfig.Type = compression.Zstd
+	}
+	return compressionConfig
+}
+
+// validateCompression returns an error if the given compression isn't one this engine supports,
+// or its level is out of the range of its type.
+func validateCompression(compressionConfig compression.Config) error {
+	compressionType := compressionConfig.Type
+	if compressionType == nil {
+		compressionType = compression.Zstd
+	} else if _, err := compression.Parse(compressionType.String()); err != nil {
+		return fmt.Errorf("invalid cache export compression: %w", err)
+	}
+	if compressionConfig.Level == nil {
+		return nil
+	}
+
+	var minLevel, maxLevel int
+	switch compressionType {
+	case compression.Zstd:
+		minLevel, maxLevel = minZstdLevel, maxZstdLevel
+	case compression.Gzip, compression.EStargz:
+		minLevel, maxLevel = flate.HuffmanOnly, flate.BestCompression
+	default:
+		return fmt.Errorf("invalid cache export compression: %s has no compression levels", compressionType)
+	}
+	if level := *compressionConfig.Level; level < minLevel || level > maxLevel {
+		return fmt.Errorf("invalid cache export compression: %s level %d is out of range %d to %d", compressionType, level, minLevel, maxLevel)
+	}
+	return nil
+}
+
+// firstRemote returns the first remote of the given ref with the given compression, or nil if
+// it has none.
+func firstRemote(ctx context.Context, cacheRef cache.ImmutableRef, compressionConfig compression.Config) (*solver.Remote, error) {
+	remotes, err := cacheRef.GetRemotes(ctx, true, cacheconfig.RefConfig{
+		Compression: compressionConfig,
+	}, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(remotes) == 0 {
+		return nil, nil
+	}
+	if len(remotes) > 1 {
+		bklog.G(ctx).Debugf("multiple remotes for cache ref %s, using the first one", cacheRef.ID())
+	}
+	return remotes[0], nil
+}
+
+// mixRemotes returns a remote with the layers of compressed, except for those marked as
+// incompressible, which are taken from uncompressed instead.
+func mixRemotes(compressed, uncompressed *solver.Remote, incompressible []bool) *solver.Remote {
+	provider := contentutil.NewMultiProvider(compressed.Provider)
+	descs := slices.Clone(compressed.Descriptors)
+	for i, desc := range uncompressed.Descriptors {
+		if incompressible[i] {
+			descs[i] = desc
+			provider.Add(desc.Digest, uncompressed.Provider)
+		}
+	}
+	return &solver.Remote{
+		Descriptors: descs,
+		Provider:    provider,
+	}
+}
+
+// isCompressible estimates whether the given uncompressed layer is worth compressing by
+// compressing a sample from its start.
+func isCompressible(ctx context.Context, provider content.Provider, desc ocispecs.Descriptor) (bool, error) {
+	readerAt, err := provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return false, err
+	}
+	defer readerAt.Close()
+
+	sample := make([]byte, min(readerAt.Size(), compressibilitySampleSize))
+	n, err := readerAt.ReadAt(sample, 0)
+	if err != nil && !(errors.Is(err, io.EOF) && n == len(sample)) {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	var compressedSize countingWriter
+	w, err := flate.NewWriter(&compressedSize, flate.BestSpeed)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(sample); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	return float64(compressedSize) < maxCompressibleRatio*float64(n), nil
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
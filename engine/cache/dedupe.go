@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"fmt"
+	"slices"
+
+	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/solver"
+	"github.com/opencontainers/go-digest"
+)
+
+// localLink identifies a link in the local key store by its source key and the properties of the
+// target it links to, using the same record digest the remote cache config uses.
+type localLink struct {
+	sourceID     string
+	input        int
+	recordDigest digest.Digest
+	selector     string
+}
+
+// dropLocallyCachedResults removes the results of records in the imported cache config that
+// already have results in the local key store, so that the combined cache manager doesn't hold
+// (and query) a second copy of them. The records themselves are kept, as other records may link
+// through them. It returns the number of records whose results were dropped.
+//
+// Imported records are matched to local keys structurally: records without inputs share their ID
+// with the local key, and records with inputs match a local key linked to from the local keys
+// matching all of their inputs.
+func dropLocallyCachedResults(cacheConfig *remotecache.CacheConfig, keyStore solver.CacheKeyStorage) (int, error) {
+	links := map[localLink][]string{}
+	err := keyStore.Walk(func(id string) error {
+		return keyStore.WalkBacklinks(id, func(sourceID string, link solver.CacheInfoLink) error {
+			// the key store reports the digest links were added with, which is already the
+			// record digest
+			l := localLink{
+				sourceID:     sourceID,
+				input:        int(link.Input),
+				recordDigest: link.Digest,
+				selector:     link.Selector.String(),
+			}
+			links[l] = append(links[l], id)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to walk local cache links: %w", err)
+	}
+
+	localIDs := make([]string, len(cacheConfig.Records))
+	resolved := make([]bool, len(cacheConfig.Records))
+	var resolve func(int) string
+	resolve = func(index int) string {
+		if index < 0 || index >= len(cacheConfig.Records) {
+			return ""
+		}
+		if resolved[index] {
+			return localIDs[index]
+		}
+		// mark as resolved up front so that (invalid) loops terminate
+		resolved[index] = true
+
+		record := cacheConfig.Records[index]
+		if len(record.Inputs) == 0 {
+			if keyStore.Exists(record.Digest.String()) {
+				localIDs[index] = record.Digest.String()
+			}
+			return localIDs[index]
+		}
+
+		var candidates []string
+		for inputIndex, inputs := range record.Inputs {
+			var inputCandidates []string
+			for _, input := range inputs {
+				sourceID := resolve(input.LinkIndex)
+				if sourceID == "" {
+					continue
+				}
+				inputCandidates = append(inputCandidates, links[localLink{
+					sourceID:     sourceID,
+					input:        inputIndex,
+					recordDigest: record.Digest,
+					selector:     input.Selector,
+				}]...)
+			}
+			if inputIndex == 0 {
+				candidates = inputCandidates
+			} else {
+				candidates = slices.DeleteFunc(candidates, func(id string) bool {
+					return !slices.Contains(inputCandidates, id)
+				})
+			}
+			if len(candidates) == 0 {
+				return ""
+			}
+		}
+		slices.Sort(candidates)
+		localIDs[index] = candidates[0]
+		return localIDs[index]
+	}
+
+	var dropped int
+	for i := range cacheConfig.Records {
+		localID := resolve(i)
+		if localID == "" {
+			continue
+		}
+		record := &cacheConfig.Records[i]
+		if len(record.Results) == 0 && len(record.ChainedResults) == 0 {
+			continue
+		}
+		var hasLocalResults bool
+		err := keyStore.WalkResults(localID, func(solver.CacheResult) error {
+			hasLocalResults = true
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to walk local cache results: %w", err)
+		}
+		if !hasLocalResults {
+			continue
+		}
+		record.Results = nil
+		record.ChainedResults = nil
+		dropped++
+	}
+	return dropped, nil
+}
+
+// recordDigest returns the digest buildkit uses for the cache record of the given vertex output.
+func recordDigest(dgst digest.Digest, output solver.Index) digest.Digest {
+	return digest.FromBytes([]byte(fmt.Sprintf("%s@%d", dgst, output)))
+}
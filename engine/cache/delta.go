@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// exportedRecords is the full set of keys and links sent in an export, which the next export's
+// delta is computed against.
+type exportedRecords struct {
+	keys  map[string]CacheKey // as compared, see comparableKey
+	links map[Link]struct{}
+}
+
+func newExportedRecords(cacheKeys []CacheKey, links []Link) *exportedRecords {
+	records := &exportedRecords{
+		keys:  make(map[string]CacheKey, len(cacheKeys)),
+		links: make(map[Link]struct{}, len(links)),
+	}
+	for _, cacheKey := range cacheKeys {
+		records.keys[cacheKey.ID] = comparableKey(cacheKey)
+	}
+	for _, link := range links {
+		records.links[link] = struct{}{}
+	}
+	return records
+}
+
+// delta returns the given keys and links that were added or changed since r, in their given
+// order, along with the IDs of the keys and the links removed since r, sorted.
+func (r *exportedRecords) delta(cacheKeys []CacheKey, links []Link) (
+	changedKeys []CacheKey,
+	addedLinks []Link,
+	removedKeys []string,
+	removedLinks []Link,
+) {
+	current := newExportedRecords(cacheKeys, links)
+	for _, cacheKey := range cacheKeys {
+		if prev, ok := r.keys[cacheKey.ID]; !ok || !reflect.DeepEqual(prev, comparableKey(cacheKey)) {
+			changedKeys = append(changedKeys, cacheKey)
+		}
+	}
+	for _, link := range links {
+		if _, ok := r.links[link]; !ok {
+			addedLinks = append(addedLinks, link)
+		}
+	}
+	for id := range r.keys {
+		if _, ok := current.keys[id]; !ok {
+			removedKeys = append(removedKeys, id)
+		}
+	}
+	for link := range r.links {
+		if _, ok := current.links[link]; !ok {
+			removedLinks = append(removedLinks, link)
+		}
+	}
+	slices.Sort(removedKeys)
+	slices.SortFunc(removedLinks, compareLinks)
+	return changedKeys, addedLinks, removedKeys, removedLinks
+}
+
+// comparableKey returns the cache key as it's compared between exports: with its results sorted by
+// ID, as the key store walks them in no particular order, and without their ExpiresAt, which
+// ExportTTL moves forward with every export. A delta export therefore doesn't extend the expiry of
+// unchanged results, which is left to the periodic full export.
+func comparableKey(cacheKey CacheKey) CacheKey {
+	cacheKey.Results = slices.Clone(cacheKey.Results)
+	for i := range cacheKey.Results {
+		cacheKey.Results[i].ExpiresAt = nil
+	}
+	slices.SortFunc(cacheKey.Results, func(a, b Result) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return cacheKey
+}
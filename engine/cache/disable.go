@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/moby/buildkit/util/bklog"
+)
+
+var errRemoteDisabled = errors.New("cache service disabled")
+
+// DisableRemote stops using the cache service, e.g. when it misbehaves, without restarting the
+// engine: imports and exports in progress are canceled, the periodic ones are stopped, the
+// service client is closed, and only the local cache is queried until EnableRemote is called.
+// Results saved in the meantime are exported once it is.
+func (m *manager) DisableRemote() {
+	m.remoteMu.Lock()
+	defer m.remoteMu.Unlock()
+	if !m.disableRemote() {
+		return
+	}
+	if err := m.disconnect(); err != nil {
+		bklog.G(context.TODO()).WithError(err).Warn("failed to close cache service client")
+	}
+}
+
+// disableRemote drops the imported cache and stops the periodic loops, returning whether the
+// service wasn't already disabled.
+func (m *manager) disableRemote() bool {
+	// scoped imports are dropped along with the imported cache
+	m.scopedImportMu.Lock()
+	defer m.scopedImportMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.remoteDisabled {
+		return false
+	}
+	m.remoteDisabled = true
+	if m.remoteDisabledCh != nil {
+		close(m.remoteDisabledCh)
+		m.remoteDisabledCh = nil
+	}
+	if m.stopLoopsCh != nil {
+		close(m.stopLoopsCh)
+		m.stopLoopsCh = nil
+	}
+	m.scopedFetched = nil
+	m.scopedImports = nil
+	m.scopedImportGen++
+	m.inner = m.combine()
+	m.attestations = nil
+	return true
+}
+
+// EnableRemote uses the cache service again after DisableRemote. The service client is created
+// again and the service's config fetched, failing if the service is still unavailable, then the
+// periodic loops are restarted and the service's cache is imported.
+func (m *manager) EnableRemote(ctx context.Context) error {
+	m.remoteMu.Lock()
+	defer m.remoteMu.Unlock()
+	if !m.isRemoteDisabled() {
+		return nil
+	}
+	if m.serviceURL != nil {
+		if err := m.connect(); err != nil {
+			return fmt.Errorf("failed to connect to cache service: %w", err)
+		}
+	}
+	if err := m.ReloadConfig(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.remoteDisabled = false
+	m.startLoops(ctx)
+	m.mu.Unlock()
+	bklog.G(ctx).Debug("cache service enabled again")
+	if err := m.Import(ctx); err != nil {
+		// the periodic imports keep trying
+		return fmt.Errorf("failed to import cache: %w", err)
+	}
+	return nil
+}
+
+// remoteContext returns a context for calls to the cache service that's canceled if the service
+// is disabled, or errRemoteDisabled if it already is.
+func (m *manager) remoteContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	m.mu.Lock()
+	if m.remoteDisabled {
+		m.mu.Unlock()
+		return nil, nil, errRemoteDisabled
+	}
+	if m.remoteDisabledCh == nil {
+		m.remoteDisabledCh = make(chan struct{})
+	}
+	disabledCh := m.remoteDisabledCh
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-disabledCh:
+			cancel(errRemoteDisabled)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(nil) }, nil
+}
+
+// isRemoteDisabled returns whether DisableRemote has been called since the service was last
+// enabled.
+func (m *manager) isRemoteDisabled() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.remoteDisabled
+}
+
+func (defaultCacheManager) DisableRemote() {}
+
+func (defaultCacheManager) EnableRemote(context.Context) error {
+	return nil
+}
+
+func (mm *multiManager) DisableRemote() {
+	for _, m := range mm.managers {
+		m.DisableRemote()
+	}
+}
+
+func (mm *multiManager) EnableRemote(ctx context.Context) error {
+	return mm.each(func(m *manager) error {
+		return m.EnableRemote(ctx)
+	})
+}
@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+/*
+Encrypted layers use envelope encryption: each blob is encrypted with a random data key, and the
+data key is encrypted ("wrapped") with a key from the configured LayerKeySource. The store only ever
+sees the wrapped data key.
+
+An encrypted blob consists of a header followed by the encrypted content:
+  - the magic string encryptedLayerMagic
+  - the ID of the key used to wrap the data key (uint16 big endian length + bytes)
+  - the wrapped data key (uint16 big endian length + bytes)
+  - the content split into encryptedLayerChunkSize chunks, each sealed with AES-GCM using the chunk
+    index as nonce
+
+Chunking allows random access when reading the blob back, which buildkit relies on. The header makes
+blobs self-describing, so layers exported before encryption was enabled can still be imported.
+*/
+
+const (
+	encryptedLayerMagic      = "DGRENC01"
+	encryptedLayerChunkSize  = 64 * 1024
+	encryptedLayerAnnotation = "dagger.io/magicache.encryption.keyid"
+)
+
+// LayerKeySource provides the keys used to encrypt layer blobs before they're uploaded and to
+// decrypt them when they're downloaded again. Keys must be 16, 24 or 32 bytes (AES-128, AES-192
+// or AES-256).
+type LayerKeySource interface {
+	// CurrentKey returns the key newly exported layers should be encrypted with, along with an ID
+	// that can later be passed to Key to retrieve it again.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+
+	// Key returns the key with the given ID. Layers may have been encrypted with a key other than
+	// the current one, e.g. before a key rotation.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticLayerKey is a LayerKeySource that always uses a single key.
+type StaticLayerKey struct {
+	ID     string
+	Secret []byte
+}
+
+func (k StaticLayerKey) CurrentKey(context.Context) (string, []byte, error) {
+	return k.ID, k.Secret, nil
+}
+
+func (k StaticLayerKey) Key(_ context.Context, id string) ([]byte, error) {
+	if id != k.ID {
+		return nil, fmt.Errorf("unknown layer encryption key %q", id)
+	}
+	return k.Secret, nil
+}
+
+type layerEncryptor struct {
+	keyID  string
+	header []byte
+	aead   cipher.AEAD
+}
+
+func newLayerEncryptor(ctx context.Context, keys LayerKeySource) (*layerEncryptor, error) {
+	keyID, key, err := keys.CurrentKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layer encryption key: %w", err)
+	}
+	keyAEAD, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layer encryption key %q: %w", keyID, err)
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapNonce := make([]byte, keyAEAD.NonceSize())
+	if _, err := rand.Read(wrapNonce); err != nil {
+		return nil, err
+	}
+	wrappedKey := keyAEAD.Seal(wrapNonce, wrapNonce, dataKey, []byte(keyID))
+
+	var header bytes.Buffer
+	header.WriteString(encryptedLayerMagic)
+	binary.Write(&header, binary.BigEndian, uint16(len(keyID)))
+	header.WriteString(keyID)
+	binary.Write(&header, binary.BigEndian, uint16(len(wrappedKey)))
+	header.Write(wrappedKey)
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &layerEncryptor{
+		keyID:  keyID,
+		header: header.Bytes(),
+		aead:   aead,
+	}, nil
+}
+
+// Size returns the size of the encrypted blob for content of the given size.
+func (e *layerEncryptor) Size(size int64) int64 {
+	chunks := (size + encryptedLayerChunkSize - 1) / encryptedLayerChunkSize
+	return int64(len(e.header)) + size + chunks*int64(e.aead.Overhead())
+}
+
+// Reader returns a reader of the encrypted blob for the content read from r.
+func (e *layerEncryptor) Reader(r io.Reader) io.Reader {
+	return &encryptingReader{
+		aead:  e.aead,
+		src:   r,
+		buf:   e.header,
+		plain: make([]byte, encryptedLayerChunkSize),
+	}
+}
+
+type encryptingReader struct {
+	aead  cipher.AEAD
+	src   io.Reader
+	buf   []byte // encrypted data not yet returned
+	plain []byte
+	out   []byte
+	chunk int64
+	err   error
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		if n > 0 {
+			r.out = r.aead.Seal(r.out[:0], chunkNonce(r.chunk), r.plain[:n], nil)
+			r.buf = r.out
+			r.chunk++
+		}
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			r.err = io.EOF
+		case err != nil:
+			r.err = err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// newDecryptingReaderAt returns a ReaderAt of the decrypted content of the given blob. If the blob
+// isn't encrypted it's returned as is.
+func newDecryptingReaderAt(ctx context.Context, ra content.ReaderAt, desc ocispecs.Descriptor, keys LayerKeySource) (content.ReaderAt, error) {
+	header := io.NewSectionReader(ra, 0, 1<<62)
+	magic := make([]byte, len(encryptedLayerMagic))
+	if _, err := io.ReadFull(header, magic); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// too short to be encrypted
+			return ra, nil
+		}
+		return nil, err
+	}
+	if string(magic) != encryptedLayerMagic {
+		return ra, nil
+	}
+
+	keyID, err := readHeaderField(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted layer %s: %w", desc.Digest, err)
+	}
+	wrappedKey, err := readHeaderField(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted layer %s: %w", desc.Digest, err)
+	}
+	headerLen, _ := header.Seek(0, io.SeekCurrent)
+
+	key, err := keys.Key(ctx, string(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key to decrypt layer %s: %w", desc.Digest, err)
+	}
+	keyAEAD, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layer encryption key %q: %w", keyID, err)
+	}
+	if len(wrappedKey) < keyAEAD.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted layer %s: wrapped key too short", desc.Digest)
+	}
+	dataKey, err := keyAEAD.Open(nil, wrappedKey[:keyAEAD.NonceSize()], wrappedKey[keyAEAD.NonceSize():], keyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key for layer %s: %w", desc.Digest, err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReaderAt{
+		ReaderAt:   ra,
+		aead:       aead,
+		desc:       desc,
+		headerLen:  headerLen,
+		chunkIndex: -1,
+	}, nil
+}
+
+type decryptingReaderAt struct {
+	content.ReaderAt
+	aead      cipher.AEAD
+	desc      ocispecs.Descriptor
+	headerLen int64
+
+	// the most recently decrypted chunk, which is kept around since reads are mostly sequential
+	chunkIndex int64
+	chunk      []byte
+	sealed     []byte
+}
+
+func (r *decryptingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off < r.desc.Size {
+		index := off / encryptedLayerChunkSize
+		if index != r.chunkIndex {
+			if err := r.loadChunk(index); err != nil {
+				return n, err
+			}
+		}
+		copied := copy(p[n:], r.chunk[off-index*encryptedLayerChunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *decryptingReaderAt) loadChunk(index int64) error {
+	plainLen := min(encryptedLayerChunkSize, r.desc.Size-index*encryptedLayerChunkSize)
+	sealedLen := plainLen + int64(r.aead.Overhead())
+	sealedOffset := r.headerLen + index*int64(encryptedLayerChunkSize+r.aead.Overhead())
+	if int64(cap(r.sealed)) < sealedLen {
+		r.sealed = make([]byte, sealedLen)
+	}
+	r.sealed = r.sealed[:sealedLen]
+	if _, err := io.ReadFull(io.NewSectionReader(r.ReaderAt, sealedOffset, sealedLen), r.sealed); err != nil {
+		return fmt.Errorf("failed to read encrypted layer %s: %w", r.desc.Digest, err)
+	}
+
+	chunk, err := r.aead.Open(r.chunk[:0], chunkNonce(index), r.sealed, nil)
+	if err != nil {
+		r.chunkIndex = -1
+		return fmt.Errorf("failed to decrypt layer %s: %w", r.desc.Digest, err)
+	}
+	r.chunk = chunk
+	r.chunkIndex = index
+	return nil
+}
+
+func (r *decryptingReaderAt) Size() int64 {
+	return r.desc.Size
+}
+
+func readHeaderField(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(index int64) []byte {
+	// the data key is unique to each blob, so the chunk index alone is a unique nonce
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// withEncryptionAnnotation returns copies of the given layer descriptors annotated with the ID of
+// the key they were encrypted with, leaving the originals (which buildkit owns) untouched.
+func withEncryptionAnnotation(layers []ocispecs.Descriptor, keyID string) []ocispecs.Descriptor {
+	annotated := make([]ocispecs.Descriptor, 0, len(layers))
+	for _, layer := range layers {
+		annotations := make(map[string]string, len(layer.Annotations)+1)
+		for k, v := range layer.Annotations {
+			annotations[k] = v
+		}
+		annotations[encryptedLayerAnnotation] = keyID
+		layer.Annotations = annotations
+		annotated = append(annotated, layer)
+	}
+	return annotated
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// exportedLayer is a layer pushed during an export, along with the cache refs it's a layer of.
+type exportedLayer struct {
+	desc   ocispecs.Descriptor
+	refIDs []string
+}
+
+// gcExportedLayers passes the layers the service has confirmed storing to LayerGC, leaving out
+// any that are still used by active refs.
+func (m *manager) gcExportedLayers(ctx context.Context, exported map[digest.Digest]*exportedLayer) error {
+	usage, err := m.Worker.CacheManager().DiskUsage(ctx, bkclient.DiskUsageInfo{})
+	if err != nil {
+		return err
+	}
+	inUse := make(map[string]struct{})
+	for _, record := range usage {
+		if record.InUse {
+			inUse[record.ID] = struct{}{}
+		}
+	}
+	eligible := gcEligibleLayers(exported, inUse)
+	if len(eligible) == 0 {
+		return nil
+	}
+	return m.LayerGC(ctx, eligible)
+}
+
+// gcEligibleLayers returns the exported layers none of whose refs are in use, in digest order.
+func gcEligibleLayers(exported map[digest.Digest]*exportedLayer, inUse map[string]struct{}) []ocispecs.Descriptor {
+	var eligible []ocispecs.Descriptor
+	for _, layer := range exported {
+		if slices.ContainsFunc(layer.refIDs, func(refID string) bool {
+			_, ok := inUse[refID]
+			return ok
+		}) {
+			continue
+		}
+		eligible = append(eligible, layer.desc)
+	}
+	slices.SortFunc(eligible, func(a, b ocispecs.Descriptor) int {
+		return strings.Compare(a.Digest.String(), b.Digest.String())
+	})
+	return eligible
+}
@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+/*
+The gRPC transport, selected with a grpc:// service URL, or grpcs:// to connect over TLS, carries
+the same calls and messages as the HTTP one, JSON encoded, but multiplexes all of them over a
+single connection. Layer blobs are streamed over that connection too, in chunks of a PutBlob
+call, rather than being PUT to the upload URL; the URL then only identifies the upload to the
+service.
+*/
+
+const (
+	grpcServiceName   = "dagger.cache.v1.CacheService"
+	grpcBlobChunkSize = 1024 * 1024
+
+	// grpcMaxMessageSize lifts gRPC's default 4MB bound on the messages of a call, as cache configs
+	// are commonly larger and the HTTP transport doesn't bound the bodies carrying them either.
+	grpcMaxMessageSize = math.MaxInt32
+)
+
+// jsonCodec encodes gRPC messages as JSON, so that the gRPC transport can use the same message
+// types as the HTTP one.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+// PutBlobChunk is a message of a PutBlob stream. The first message of the stream sets UploadURL
+// and Size, all of them carry the next chunk of the blob's data.
+type PutBlobChunk struct {
+	UploadURL string `json:",omitempty"`
+	Size      int64  `json:",omitempty"`
+	Data      []byte
+}
+
+// blobUploader is implemented by Service transports that upload blobs themselves rather than
+// having them PUT to the upload URL.
+type blobUploader interface {
+	PutBlob(ctx context.Context, uploadURL *GetLayerUploadURLResponse, body io.Reader, size int64) error
+}
+
+var putBlobStreamDesc = &grpc.StreamDesc{
+	StreamName:    "PutBlob",
+	ClientStreams: true,
+}
+
+type grpcClient struct {
+	conn *grpc.ClientConn
+}
+
+var _ Service = &grpcClient{}
+var _ blobUploader = &grpcClient{}
+
+// newGRPCClient connects to the service at target, with extraOpts applied after the options for
+// its credentials and codec.
+func newGRPCClient(target, token string, tlsConfig *tls.Config, authToken func(context.Context) (string, error), extraOpts ...grpc.DialOption) (*grpcClient, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(
+			grpc.ForceCodec(jsonCodec{}),
+			grpc.MaxCallRecvMsgSize(grpcMaxMessageSize),
+			grpc.MaxCallSendMsgSize(grpcMaxMessageSize),
+		),
+	}
+	switch {
+	case authToken != nil:
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerCredentials(authToken)))
+	case token != "":
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(token)))
+	}
+	opts = append(opts, extraOpts...)
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{conn: conn}, nil
+}
+
+// grpcDialOptions returns the options of ManagerConfig to dial the service with, the keepalive
+// ones first so that GRPCDialOptions can override them.
+func (m *manager) grpcDialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	if m.ServiceKeepalive > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    m.ServiceKeepalive,
+			Timeout: m.ServiceKeepaliveTimeout,
+			// idle connections have no streams, and are the ones to keep alive
+			PermitWithoutStream: true,
+		}))
+	}
+	return append(opts, m.GRPCDialOptions...)
+}
+
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+func grpcInvoke[T any](ctx context.Context, c *grpcClient, method string, req any) (*T, error) {
+	var resp T
+	if err := c.conn.Invoke(ctx, "/"+grpcServiceName+"/"+method, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *grpcClient) GetConfig(ctx context.Context, req GetConfigRequest) (*Config, error) {
+	return grpcInvoke[Config](ctx, c, "GetConfig", &req)
+}
+
+func (c *grpcClient) UpdateCacheRecords(ctx context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+	return grpcInvoke[UpdateCacheRecordsResponse](ctx, c, "UpdateCacheRecords", &req)
+}
+
+func (c *grpcClient) UpdateCacheLayers(ctx context.Context, req UpdateCacheLayersRequest) error {
+	_, err := grpcInvoke[struct{}](ctx, c, "UpdateCacheLayers", &req)
+	return err
+}
+
+func (c *grpcClient) ImportCache(ctx context.Context, req ImportCacheRequest) (*ImportCacheResponse, error) {
+	return grpcInvoke[ImportCacheResponse](ctx, c, "ImportCache", &req)
+}
+
+func (c *grpcClient) GetLayerDownloadURL(ctx context.Context, req GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error) {
+	return grpcInvoke[GetLayerDownloadURLResponse](ctx, c, "GetLayerDownloadURL", &req)
+}
+
+func (c *grpcClient) GetLayerUploadURL(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+	return grpcInvoke[GetLayerUploadURLResponse](ctx, c, "GetLayerUploadURL", &req)
+}
+
+func (c *grpcClient) GetAttestations(ctx context.Context, req GetAttestationsRequest) (*GetAttestationsResponse, error) {
+	return grpcInvoke[GetAttestationsResponse](ctx, c, "GetAttestations", &req)
+}
+
+func (c *grpcClient) GetCacheMountConfig(ctx context.Context, req GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error) {
+	return grpcInvoke[GetCacheMountConfigResponse](ctx, c, "GetCacheMountConfig", &req)
+}
+
+func (c *grpcClient) GetCacheMountUploadURL(ctx context.Context, req GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error) {
+	return grpcInvoke[GetCacheMountUploadURLResponse](ctx, c, "GetCacheMountUploadURL", &req)
+}
+
+func (c *grpcClient) PruneCacheRecords(ctx context.Context, req PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error) {
+	return grpcInvoke[PruneCacheRecordsResponse](ctx, c, "PruneCacheRecords", &req)
+}
+
+func (c *grpcClient) LayersExist(ctx context.Context, req LayersExistRequest) (*LayersExistResponse, error) {
+	return grpcInvoke[LayersExistResponse](ctx, c, "LayersExist", &req)
+}
+
+func (c *grpcClient) Ping(ctx context.Context) error {
+	_, err := grpcInvoke[struct{}](ctx, c, "Ping", &struct{}{})
+	return err
+}
+
+func (c *grpcClient) GetLayerUploadURLs(ctx context.Context, req GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+	return grpcInvoke[GetLayerUploadURLsResponse](ctx, c, "GetLayerUploadURLs", &req)
+}
+
+func (c *grpcClient) PutBlob(ctx context.Context, uploadURL *GetLayerUploadURLResponse, body io.Reader, size int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // aborts the stream if it isn't completed
+	stream, err := c.conn.NewStream(ctx, putBlobStreamDesc, "/"+grpcServiceName+"/PutBlob")
+	if err != nil {
+		return err
+	}
+
+	chunk := PutBlobChunk{
+		UploadURL: uploadURL.URL,
+		Size:      size,
+	}
+	buf := make([]byte, grpcBlobChunkSize)
+	var sent int64
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 || sent == 0 {
+			chunk.Data = buf[:n]
+			if err := stream.SendMsg(&chunk); err != nil {
+				return fmt.Errorf("failed to send blob chunk: %w", err)
+			}
+			chunk = PutBlobChunk{}
+			sent += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if sent != size {
+		return fmt.Errorf("blob has %d bytes, expected %d", sent, size)
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return stream.RecvMsg(&struct{}{})
+}
+
+// tokenCredentials authenticates gRPC calls with the service token, the same way the HTTP
+// transport does.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(string(t)+":")),
+	}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// bearerCredentials authenticates gRPC calls with a bearer token fetched for each call, the same
+// way the HTTP transport does with an authTransport.
+type bearerCredentials func(context.Context) (string, error)
+
+func (c bearerCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	token, err := c(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get auth token: %w", err)
+	}
+	return map[string]string{
+		"authorization": "Bearer " + token,
+	}, nil
+}
+
+func (c bearerCredentials) RequireTransportSecurity() bool {
+	return false
+}
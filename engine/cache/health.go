@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// CacheHealth describes whether the cache service is available, e.g. for the engine's own health
+// checks.
+type CacheHealth struct {
+	// Reachable is whether the service responded to a ping.
+	Reachable bool
+
+	// LastError is the error of the ping if it failed, or else of the last import if it failed.
+	LastError error
+
+	// LastImport is when the service's cache was last imported successfully, zero if never.
+	LastImport time.Time
+}
+
+// CacheHealth pings the cache service to check that it's reachable.
+func (m *manager) CacheHealth(ctx context.Context) CacheHealth {
+	m.mu.RLock()
+	health := CacheHealth{
+		LastError:  m.importErr,
+		LastImport: m.importedAt,
+	}
+	m.mu.RUnlock()
+
+	if err := m.service().Ping(ctx); err != nil {
+		health.LastError = err
+	} else {
+		health.Reachable = true
+	}
+	return health
+}
+
+// LastImport returns when the service's cache was last imported successfully, zero if never.
+func (m *manager) LastImport() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.importedAt
+}
+
+// LastExport returns when the last successful export finished, zero if none has.
+func (m *manager) LastExport() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.exportedAt
+}
+
+// LastError returns when the last failed import or export happened, along with its error, even
+// if imports and exports have succeeded since.
+func (m *manager) LastError() (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastErrAt, m.lastErr
+}
+
+// CacheHealth always reports the local cache as healthy.
+func (defaultCacheManager) CacheHealth(context.Context) CacheHealth {
+	return CacheHealth{Reachable: true}
+}
+
+// CacheHealth reports the services as reachable if any of them is, since each is used
+// independently of the others.
+func (mm *multiManager) CacheHealth(ctx context.Context) CacheHealth {
+	var health CacheHealth
+	var errs []error
+	for _, m := range mm.managers {
+		serviceHealth := m.CacheHealth(ctx)
+		health.Reachable = health.Reachable || serviceHealth.Reachable
+		errs = append(errs, serviceHealth.LastError)
+		if serviceHealth.LastImport.After(health.LastImport) {
+			health.LastImport = serviceHealth.LastImport
+		}
+	}
+	health.LastError = errors.Join(errs...)
+	return health
+}
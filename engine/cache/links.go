@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"fmt"
+
+	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
+)
+
+// repairCacheConfigLinks checks that every record input in the cache config links to a record
+// that actually exists. A partially corrupt config would otherwise result in a key storage
+// whose link graph references missing keys, which only shows up later as obscure query failures.
+//
+// If strict is set, the first dangling link results in an error. Otherwise dangling links are
+// dropped from the config in place, along with records left with an input that has no links, as
+// they could never be matched, and in turn the links to those. The number of dropped links and
+// records is returned.
+func repairCacheConfigLinks(cacheConfig *remotecache.CacheConfig, strict bool) (droppedLinks, droppedRecords int, _ error) {
+	dropped := make([]bool, len(cacheConfig.Records))
+	for changed := true; changed; {
+		changed = false
+		for recordIndex, record := range cacheConfig.Records {
+			if dropped[recordIndex] {
+				continue
+			}
+			for inputIndex, inputs := range record.Inputs {
+				var validInputs []remotecache.CacheInput
+				for _, input := range inputs {
+					if input.LinkIndex >= 0 && input.LinkIndex < len(cacheConfig.Records) && !dropped[input.LinkIndex] {
+						validInputs = append(validInputs, input)
+						continue
+					}
+					if strict {
+						return 0, 0, fmt.Errorf("record %d (%s) input %d links to missing record %d",
+							recordIndex, record.Digest, inputIndex, input.LinkIndex)
+					}
+					droppedLinks++
+				}
+				if len(validInputs) != len(inputs) {
+					record.Inputs[inputIndex] = validInputs
+				}
+				if len(validInputs) == 0 && len(inputs) > 0 {
+					// records linking to this one lose that link on the next pass
+					dropped[recordIndex] = true
+					droppedRecords++
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	if droppedRecords == 0 {
+		return droppedLinks, 0, nil
+	}
+
+	// the remaining records move up, so the links to them are renumbered
+	newIndexes := make([]int, len(cacheConfig.Records))
+	var records []remotecache.CacheRecord
+	for recordIndex, record := range cacheConfig.Records {
+		if dropped[recordIndex] {
+			continue
+		}
+		newIndexes[recordIndex] = len(records)
+		records = append(records, record)
+	}
+	for _, record := range records {
+		for _, inputs := range record.Inputs {
+			for i := range inputs {
+				inputs[i].LinkIndex = newIndexes[inputs[i].LinkIndex]
+			}
+		}
+	}
+	cacheConfig.Records = records
+	return droppedLinks, droppedRecords, nil
+}
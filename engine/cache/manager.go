@@ -2,39 +2,105 @@ package cache
 
 import (
 	"context"
+	_ "crypto/sha512" // registers sha512 for layers addressed with it
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/moby/buildkit/cache"
-	cacheconfig "github.com/moby/buildkit/cache/config"
 	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
 	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/solver/llbsolver/mounts"
 	"github.com/moby/buildkit/util/bklog"
 	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/worker"
 	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
 )
 
 type manager struct {
 	ManagerConfig
-	cacheClient   Service
 	httpClient    *http.Client
-	layerProvider content.Provider
-	runtimeConfig Config
+	layerProvider *layerProvider
 	localCache    solver.CacheManager
+	multi         *multiMember // set if the manager is one of a multiManager
+
+	configMu       sync.RWMutex
+	runtimeConfig  Config        // guarded by configMu, replaced by ReloadConfig
+	configReloaded chan struct{} // guarded by configMu, closed and replaced by ReloadConfig
 
 	mu                 sync.RWMutex
 	inner              solver.CacheManager
-	startCloseCh       chan struct{} // closed when shutdown should start
-	doneCh             chan struct{} // closed when shutdown is complete
-	stopCacheMountSync func(context.Context) error
+	importedAt         time.Time     // when inner was last updated by a successful import
+	importErr          error         // of the last import, guarded by mu
+	exportedAt         time.Time     // when the last successful export finished, guarded by mu
+	lastErr            error         // of the last failed import or export, guarded by mu
+	lastErrAt          time.Time     // when lastErr happened, guarded by mu
+	remoteMu           sync.Mutex    // serializes DisableRemote and EnableRemote
+	remoteDisabled     bool          // set by DisableRemote, guarded by mu
+	remoteDisabledCh   chan struct{} // closed by DisableRemote to cancel service calls, guarded by mu
+	now                func() time.Time
+	startCloseCh       chan struct{}               // closed when shutdown should start
+	stopLoopsCh        chan struct{}               // closed to stop the periodic loops, guarded by mu
+	doneCh             chan struct{}               // closed when the periodic loops stop, guarded by mu
+	mountSyncMu        sync.Mutex                  // serializes starting cache mount syncs
+	stopCacheMountSync func(context.Context) error // guarded by mountSyncMu
+	mountSyncStatus    CacheMountSyncStatus        // guarded by mu
+
+	// the client of the cache service and what it holds, replaced by connect
+	serviceURL       *url.URL
+	tlsConfig        *tls.Config
+	serviceMu        sync.RWMutex
+	cacheClient      Service      // guarded by serviceMu
+	serviceRecording io.Closer    // set if calls to the cache service are being recorded, guarded by serviceMu
+	serviceConn      io.Closer    // set if the service transport holds a connection open, guarded by serviceMu
+	blobUploader     blobUploader // set if the service transport uploads blobs itself, guarded by serviceMu
+
+	// attestations of the imported records by record digest, guarded by mu
+	attestations map[digest.Digest][]Attestation
+
+	localRecordIDs sync.Map // IDs of records Records found in the local cache, for RecordSource
+
+	importGroup singleflight.Group // dedupes concurrent imports
+	exportGroup singleflight.Group // dedupes periodic exports and flushes
+
+	scopedImportGroup singleflight.Group // dedupes concurrent scoped imports of a record
+	scopedImportMu    sync.Mutex
+	scopedImports     []solver.CacheManager      // written with both scopedImportMu and mu held
+	scopedFetched     map[digest.Digest]struct{} // record digests already fetched for scoped imports
+	scopedImportSeq   int                        // number of scoped imports started, for their IDs
+	scopedImportGen   int                        // incremented as scoped imports are dropped
+
+	exportMu           sync.Mutex       // serializes exports
+	exportWatermark    time.Time        // start time of the last successful export
+	incrementalExports int              // incremental exports since the last full one
+	lastExported       *exportedRecords // records of the last successful full or delta export
+	deltaExports       int              // delta exports since the last full one
+
+	inFlightExportMu     sync.Mutex
+	inFlightExportGen    uint64
+	cancelInFlightExport context.CancelCauseFunc
+
+	replications sync.WaitGroup // uploads of layers written to LayerMirror in progress
+
+	uploadedBytes atomic.Int64 // bytes of blobs uploaded so far, for ExportStats
+
+	saveExportMu    sync.Mutex
+	saveExportTimer *time.Timer // set while an export after save is pending
 }
 
 type ManagerConfig struct {
@@ -45,50 +111,425 @@ type ManagerConfig struct {
 	ServiceURL   string
 	Token        string
 	EngineID     string
+
+	// ServiceURLs, if set, are multiple cache services to use in place of ServiceURL, in
+	// priority order, e.g. a fast regional cache followed by a slower global one. The cache of
+	// each is imported and queried, with results of the first taking precedence, and exports go
+	// to all of them. Each is imported from and exported to independently, so a failing service
+	// doesn't hold up the others, and one that fails to start is skipped. Cache mounts are only
+	// synced with the first.
+	ServiceURLs []string
+
+	// RequireTLS, if set, rejects service URLs that don't connect over TLS, i.e. any but https
+	// and grpcs ones, so that cache metadata is never sent in cleartext.
+	RequireTLS bool
+
+	// AuthToken, if set, is a bearer token sent in the Authorization header of requests to the
+	// cache service, in place of Token, and of layer uploads and downloads. AuthTokenProvider
+	// takes precedence over it, returning the token to send for each request so that
+	// short-lived tokens can be refreshed.
+	AuthToken         string
+	AuthTokenProvider func(context.Context) (string, error)
+
+	// TLSCertPath and TLSKeyPath, if set, are a client certificate and key presented to the
+	// cache service and layer stores that require mutual TLS. TLSCAPath optionally points to a
+	// CA bundle used to verify them instead of the system roots.
+	TLSCertPath string
+	TLSKeyPath  string
+	TLSCAPath   string
+
+	// TLSConfig, if set, is used in place of the config loaded from the paths above, for
+	// settings they don't cover, e.g. custom verification. Like that one, it applies to the
+	// cache service and layer stores.
+	TLSConfig *tls.Config
+
+	// ServiceKeepalive, if set, is how long a gRPC connection to the cache service may be idle
+	// before it's pinged, so that e.g. a load balancer doesn't silently drop it and fail the
+	// next call. ServiceKeepaliveTimeout is how long to wait for the ping to be answered before
+	// closing the connection, 20s if unset. The service must permit pings this frequent, and
+	// gRPC pings no more often than every 10s.
+	ServiceKeepalive        time.Duration
+	ServiceKeepaliveTimeout time.Duration
+
+	// GRPCDialOptions are further options the gRPC connection to the cache service is dialed
+	// with, for grpc and grpcs service URLs. They take precedence over the ones set by other
+	// settings.
+	GRPCDialOptions []grpc.DialOption
+
+	// HTTPClient, if set, is used for layer uploads and downloads in place of the default
+	// client, whose transport bounds the time to connect and to wait for a response, but not
+	// how long a large layer takes to transfer. The TLS settings above then aren't applied to
+	// it. HTTPTimeout, if set, bounds each request made with the default client as a whole,
+	// including transferring its body. Deadlines of the context requests are made with always
+	// apply too.
+	HTTPClient  *http.Client
+	HTTPTimeout time.Duration
+
+	// MaxConcurrentDownloads, if set, caps the number of layers downloaded from the service at
+	// once, e.g. while buildkit pulls many layers of imported results, so that the service
+	// isn't overwhelmed. A download holds its slot until its reader is closed.
+	MaxConcurrentDownloads int
+
+	// ServiceRateLimit, if non-zero, caps the rate of calls made to the cache service in
+	// requests per second, allowing bursts of up to ServiceRateBurst calls.
+	ServiceRateLimit float64
+	ServiceRateBurst int
+
+	// RetryMaxDuration, if set, enables retrying cache service calls and uploads that fail with
+	// transient errors, with exponential backoff, for at most this long per call. RetryJitter is
+	// the fraction (from 0 to 1) of each backoff that is randomized, so that engines failing at
+	// the same time spread out their retries.
+	RetryMaxDuration time.Duration
+	RetryJitter      float64
+
+	// UploadMaxAttempts, if set, enables retrying layer uploads that fail with transient errors,
+	// i.e. 429 and 5xx responses and network errors, for up to this many attempts in total, whether
+	// or not RetryMaxDuration is set. UploadRetryDelay, if set, is the backoff before the first retry,
+	// which doubles with each one after.
+	UploadMaxAttempts int
+	UploadRetryDelay  time.Duration
+
+	// ResumableUploadThreshold, if set, is the size past which layers are uploaded resumably, in
+	// parts of ResumableUploadPartSize (64MiB if unset), if the service supports it. A failed part
+	// is retried on its own, so a failure near the end of a large layer doesn't mean uploading all
+	// of it again.
+	ResumableUploadThreshold int64
+	ResumableUploadPartSize  int64
+
+	// CircuitBreakerThreshold, if set, is the number of consecutive failures of the periodic
+	// imports or exports after which they back off, with the period between them doubling with
+	// each further failure up to CircuitBreakerMaxPeriod (an hour if unset), until one succeeds
+	// again. Only backing off and recovering are logged then, rather than every failure.
+	CircuitBreakerThreshold int
+	CircuitBreakerMaxPeriod time.Duration
+
+	// LoopJitter is the fraction (from 0 to 1) by which each wait between periodic imports or
+	// exports is randomized either way, e.g. 0.1 for ±10% of the period, so that engines started
+	// together don't all call the service at once every period. The randomness is seeded with
+	// the EngineID, so that it's distributed across engines but reproducible for each one.
+	LoopJitter float64
+
+	// NormalizeExportedLayers canonicalizes the records sent in UpdateCacheLayers so that
+	// identical content results in identical requests across engines.
+	NormalizeExportedLayers bool
+
+	// NormalizeExportedRecords does the same for the keys and links sent in UpdateCacheRecords,
+	// allowing the service to dedupe identical exports. Note that expiry hints based on
+	// ExportTTL still vary with the time of each export.
+	NormalizeExportedRecords bool
+
+	// ExportIncremental limits each export to keys with results created since the previous
+	// successful export, with a periodic full export to reconcile.
+	ExportIncremental bool
+
+	// ExportDelta makes each export send only the keys and links that were added, changed or
+	// removed since the previous successful export, with a periodic full export to reconcile.
+	// It has no effect on exports that are incremental.
+	ExportDelta bool
+
+	// LayerKeys, if set, enables client-side encryption of layer blobs: they are encrypted
+	// with keys from this source before being uploaded and decrypted when imported.
+	LayerKeys LayerKeySource
+
+	// ChunkedLayers splits exported layers into content-defined chunks, each uploaded only if
+	// the service doesn't have it yet, so that layers that change a little between exports
+	// don't have to be uploaded in full again. Engines importing chunked layers need it set too.
+	ChunkedLayers bool
+
+	// Compression is the compression exported layers are compressed with, zstd if its Type isn't
+	// set. With ContentAwareCompression, it's the compression of the layers worth compressing.
+	// Its Level, if set, trades CPU for smaller uploads or the other way around: from 1 to 22 for
+	// zstd, whose default is 3, and from -2 to 9 for gzip and estargz. It applies to layers
+	// compressed for the export; those already available in its compression are exported as is.
+	Compression compression.Config
+
+	// ContentAwareCompression, if set, samples each exported layer and only compresses the ones
+	// that compress well, leaving e.g. layers of images or archives uncompressed rather than
+	// spending CPU on compressing them for no gain.
+	ContentAwareCompression bool
+
+	// ExportProvider, if set, wraps the content provider of each exported ref's remote, which the
+	// layers pushed are read from, e.g. to read them through a local mirror or instrument the
+	// reads. The layers are then read from the wrapped provider rather than streamed as they're
+	// computed, unless it streams them itself.
+	ExportProvider func(content.Provider) content.Provider
+
+	// RemoteSelection selects which variants of the layers of exported cache refs to export.
+	// The default is just those in the export compression.
+	RemoteSelection RemoteSelection
+
+	// ExportAfterSave, if set, triggers an export this long after results are saved to the
+	// cache, with any results saved in the meantime included in the same export. This gets new
+	// results to the service promptly, e.g. from short-lived engines that may exit before the
+	// next periodic export.
+	ExportAfterSave time.Duration
+
+	// LayerMirror, if set, is a local store exported layers are written to before the export
+	// continues, with their upload to the service happening in the background. Exports then
+	// aren't held up by slow uploads, as long as the mirror serves the layers in the meantime.
+	// Failed uploads are retried, and logged if they still fail.
+	LayerMirror LayerStore
+
+	// MetricsRecorder, if set, is notified of the outcome of each import and export.
+	MetricsRecorder MetricsRecorder
+
+	// SlowUploadThroughput, if set, is the throughput in bytes per second below which the upload
+	// of a layer is logged as slow, along with its digest. Layers under a MiB aren't, as the time
+	// to upload them is mostly latency. ExportStats has percentiles of the upload times either way.
+	SlowUploadThroughput int64
+
+	// ProgressWriter, if set, is sent the progress of each layer uploaded while exporting, as a
+	// vertex keyed by the layer's digest with the bytes uploaded so far. It isn't closed by the
+	// manager.
+	ProgressWriter progress.Writer
+
+	// LayerGC, if set, is called after each successful export with the exported layers that
+	// aren't used by any active ref. Since the service now stores them, local copies can be
+	// garbage collected, e.g. by releasing leases on them, to keep disk usage in check.
+	LayerGC func(context.Context, []ocispecs.Descriptor) error
+
+	// ExportConcurrency determines what happens when an export is started while another one
+	// is still in progress. The default is to wait for the in-progress export to finish.
+	ExportConcurrency ExportConcurrency
+
+	// ExportTimeoutMode determines what the ExportTimeout of the service's config applies to. The
+	// default is to apply it to each export as a whole.
+	ExportTimeoutMode ExportTimeoutMode
+
+	// ContinueOnRecordError, if set, skips records whose ref fails to export, e.g. because its
+	// remotes can't be got or a layer fails to push, rather than failing the export as a whole.
+	// The rest of the records are still exported, with the export then failing with the errors
+	// of those skipped, so that the failures are still visible.
+	ContinueOnRecordError bool
+
+	// ExportTTL, if set, is sent along with each exported result as a hint of how long after
+	// the export the service should retain it. ExportExpiry, if set, instead computes the
+	// expiry hint for each result; returning the zero time leaves it up to the service.
+	ExportTTL    time.Duration
+	ExportExpiry func(Result) time.Time
+
+	// ExportRetention, if set, returns the retention policy sent to the service with each
+	// exported result, e.g. to keep results of release builds longer than those of PR builds.
+	// Otherwise ExportRetentionPolicy, if non-zero, is sent with every result.
+	ExportRetention       func(Result) RetentionPolicy
+	ExportRetentionPolicy RetentionPolicy
+
+	// ExportBatchMaxBytes, if set, splits the cache records sent on export into multiple
+	// UpdateCacheRecords requests, each of an estimated serialized size of at most this many
+	// bytes.
+	ExportBatchMaxBytes int
+
+	// ExportFilter, if set, is called with each cache key walked on export, along with its
+	// results, and returns whether to export it. Keys it rejects are left out of the records sent
+	// to the service, as are links to them, so their layers aren't pushed either. The key's ID
+	// includes KeyPrefix.
+	ExportFilter func(CacheKey) bool
+
+	// DedupeImportedResults drops imported results for records the local cache already has
+	// results for, so only the local copy is kept and queried.
+	DedupeImportedResults bool
+
+	// Namespace, if set, partitions the service's cache, e.g. between tenants sharing the
+	// service: it's sent with each call touching records, for the service to only import and
+	// export records of the namespace. A service that doesn't advertise supporting namespaces
+	// isn't used then, leaving just the local cache, so that records of other namespaces are
+	// never imported.
+	Namespace string
+
+	// KeyPrefix, if set, is prepended to the IDs of exported cache keys, giving the engines
+	// that use it their own logical space within a shared cache service. Imports are limited to
+	// keys exported with the same prefix.
+	KeyPrefix string
+
+	// ServiceRecordingPath, if set, is a file that every call made to the cache service is
+	// recorded to (with sensitive headers redacted), so that issues can be reproduced offline.
+	ServiceRecordingPath string
+
+	// MaxSnapshotAge, if set, is how long after the last successful import the imported cache
+	// is still queried. Once exceeded only the local cache is queried until an import succeeds
+	// again, rather than serving hits from an increasingly stale snapshot.
+	MaxSnapshotAge time.Duration
+
+	// AttestationSource, if set, is called for each exported result to get attestations (e.g.
+	// provenance) to export along with it. ImportAttestations makes imports fetch the
+	// attestations of imported records, which can then be retrieved with Attestations.
+	AttestationSource  func(context.Context, cache.ImmutableRef) ([]Attestation, error)
+	ImportAttestations bool
+
+	// ReferrersSubject, if set, is a reference by digest to an image whose cache referrers, i.e.
+	// manifests referring to it with a cache config, are imported from its registry along with
+	// the service's cache. This picks up cache published with the OCI referrers API without
+	// needing to know its tag. Only registries allowing anonymous pulls are supported.
+	ReferrersSubject string
+
+	// ReferrersPlainHTTP makes requests to the registry of ReferrersSubject over plain HTTP.
+	ReferrersPlainHTTP bool
+
+	// ScopedImport makes imports fetch only the records builds actually query (along with the
+	// records they link to) as they're queried, instead of the whole cache config. Periodic imports
+	// then just drop the records fetched so far, so they're fetched again when next queried.
+	ScopedImport bool
+
+	// WarmKeys, if set, are digests of cache records whose layers are copied to the worker's
+	// content store, and whose results are loaded from them, in the background once the import
+	// done at startup has finished, so that builds using e.g. a known set of base image layers
+	// don't have to pull them first. It doesn't hold up NewManager, and failing to warm them is
+	// only logged.
+	WarmKeys []digest.Digest
+
+	// ChainCacheDir, if set, is a directory the cache config of each successful import is saved
+	// to. At startup, the saved one is used until the first import finishes, or in place of it if
+	// the import fails. It's only used while the service reports the same CacheGeneration as it
+	// returned with the import, so it isn't loaded if the service can't be reached to report one,
+	// as the layers of its results couldn't be downloaded either.
+	ChainCacheDir string
+
+	// FailOnInitialImportError makes NewManager fail if the import done at startup fails,
+	// rather than starting out with just the local cache and retrying in the background.
+	FailOnInitialImportError bool
+
+	// StrictImport causes imports of cache configs containing links to records that don't
+	// exist to fail, rather than dropping those links and importing the rest.
+	StrictImport bool
 }
 
+type ExportConcurrency int
+
+const (
+	// ExportQueue makes an export wait for the in-progress export to finish first.
+	ExportQueue ExportConcurrency = iota
+
+	// ExportCancelInFlight makes an export cancel the in-progress export, whose view of the cache
+	// is superseded by the newer one, rather than waiting for it to finish.
+	ExportCancelInFlight
+)
+
+var errExportSuperseded = errors.New("cache export superseded by a newer export")
+
+type ExportTimeoutMode int
+
+const (
+	// ExportTimeoutOverall fails an export that takes longer than the timeout.
+	ExportTimeoutOverall ExportTimeoutMode = iota
+
+	// ExportTimeoutPerLayer instead applies the timeout to the push of each layer, with exports
+	// as a whole allowed to take however long they need. A layer that still fails to push once
+	// its timeout is up, including retries, doesn't fail the export: the records with that layer
+	// are left without layers, i.e. partially exported, with their cache keys and links sent to
+	// the service but their layers not. The service then asks for them again on the next export.
+	ExportTimeoutPerLayer
+)
+
 const (
 	LocalCacheID            = "local"
 	startupImportTimeout    = 1 * time.Minute
+	defaultExportTimeout    = 10 * time.Minute
 	backgroundImportTimeout = 10 * time.Minute
+	scopedImportTimeout     = 30 * time.Second
+
+	// number of incremental or delta exports after which a full export is done again
+	maxIncrementalExports = 10
+
+	// size under which layers aren't checked against SlowUploadThroughput
+	minSlowUploadSize = 1 << 20
 )
 
 func NewManager(ctx context.Context, managerConfig ManagerConfig) (Manager, error) {
-	localCache := solver.NewCacheManager(ctx, LocalCacheID, managerConfig.KeyStore, managerConfig.ResultStore)
+	return newManager(ctx, managerConfig, nil)
+}
+
+// newManager is NewManager, creating a manager of a multiManager if multi is set.
+func newManager(ctx context.Context, managerConfig ManagerConfig, multi *multiMember) (Manager, error) {
+	var localCache solver.CacheManager
+	if multi != nil {
+		localCache = multi.localCache
+	} else {
+		localCache = solver.NewCacheManager(ctx, LocalCacheID, managerConfig.KeyStore, managerConfig.ResultStore)
+	}
 	m := &manager{
 		ManagerConfig: managerConfig,
 		localCache:    localCache,
+		multi:         multi,
 		startCloseCh:  make(chan struct{}),
-		doneCh:        make(chan struct{}),
 		httpClient:    &http.Client{},
+		now:           time.Now,
+	}
+
+	if err := validateCompression(managerConfig.Compression); err != nil {
+		return nil, err
+	}
+	for _, dgst := range managerConfig.WarmKeys {
+		if err := dgst.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid warm key %q: %w", dgst, err)
+		}
 	}
 
 	if managerConfig.Token == "" {
-		return defaultCacheManager{m.localCache}, nil
+		return defaultCacheManager{CacheManager: m.localCache, keyStore: m.KeyStore}, nil
+	}
+	if len(managerConfig.ServiceURLs) > 0 {
+		// all of them are validated upfront, rather than misconfigured ones skipped like
+		// unavailable ones
+		for _, serviceURL := range managerConfig.ServiceURLs {
+			if _, err := validateServiceURL(serviceURL, managerConfig.RequireTLS); err != nil {
+				return nil, err
+			}
+		}
+		return newMultiManager(ctx, managerConfig)
+	}
+	serviceURL, err := validateServiceURL(managerConfig.ServiceURL, managerConfig.RequireTLS)
+	if err != nil {
+		return nil, err
 	}
 	bklog.G(ctx).Debugf("using cache service at %s", managerConfig.ServiceURL)
 
-	serviceClient, err := newClient(managerConfig.ServiceURL, managerConfig.Token)
-	if err != nil {
+	tlsConfig := managerConfig.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig, err = loadTLSConfig(managerConfig.TLSCertPath, managerConfig.TLSKeyPath, managerConfig.TLSCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cache service TLS config: %w", err)
+		}
+	}
+	m.httpClient = m.layerHTTPClient(tlsConfig)
+	authToken := m.authToken()
+	if authToken != nil {
+		// only the transport is swapped, keeping e.g. the client's timeout
+		httpClient := *m.httpClient
+		httpClient.Transport = newAuthTransport(httpClient.Transport, authToken)
+		m.httpClient = &httpClient
+	}
+
+	m.serviceURL = serviceURL
+	m.tlsConfig = tlsConfig
+	if err := m.connect(); err != nil {
 		return nil, err
 	}
-	m.cacheClient = serviceClient
 	m.layerProvider = &layerProvider{
-		httpClient:  m.httpClient,
-		cacheClient: m.cacheClient,
+		httpClient: m.httpClient,
+		service:    m.service,
+		keys:       managerConfig.LayerKeys,
+		chunked:    managerConfig.ChunkedLayers,
+		downloads:  newDownloadLimit(managerConfig.MaxConcurrentDownloads),
 	}
 
-	config, err := m.cacheClient.GetConfig(ctx, GetConfigRequest{
-		EngineID: m.EngineID,
+	config, err := m.service().GetConfig(ctx, GetConfigRequest{
+		EngineID:  m.EngineID,
+		Namespace: m.Namespace,
 	})
+	if err == nil {
+		err = m.checkNamespaces(config)
+	}
 	if err != nil {
 		bklog.G(ctx).WithError(err).Warnf("cache init failed, falling back to local cache")
-		return defaultCacheManager{m.localCache}, nil
+		m.disconnect()
+		return defaultCacheManager{CacheManager: m.localCache, keyStore: m.KeyStore}, nil
 	}
-	if config.ImportPeriod == 0 || config.ExportPeriod == 0 || config.ExportTimeout == 0 {
-		return nil, fmt.Errorf("invalid cache config: import/export periods must be non-zero")
+	if err := config.validate(); err != nil {
+		m.disconnect()
+		return nil, fmt.Errorf("invalid cache config: %w", err)
 	}
 	m.runtimeConfig = *config
+	m.configReloaded = make(chan struct{})
 
 	importParentCtx, cancelImport := context.WithCancelCause(context.Background())
 	go func() {
@@ -97,84 +538,365 @@ func NewManager(ctx context.Context, managerConfig ManagerConfig) (Manager, erro
 	}()
 
 	// do an initial synchronous import at start
-	m.inner = m.localCache // start out with just the local cache, will be updated if Import succeeds
+	m.inner = m.combine() // start out with just the local cache, will be updated if Import succeeds
+	if m.ChainCacheDir != "" && !m.ScopedImport {
+		loaded, err := m.loadChainSnapshot(ctx, config.CacheGeneration)
+		if err != nil {
+			bklog.G(ctx).WithError(err).Warn("failed to load cache snapshot")
+		} else if loaded {
+			bklog.G(ctx).Debugf("loaded cache snapshot of generation %s", config.CacheGeneration)
+		}
+	}
 	startupImportCtx, startupImportCancel := context.WithTimeout(importParentCtx, startupImportTimeout)
 	defer startupImportCancel()
 	if err := m.Import(startupImportCtx); err != nil {
+		if m.FailOnInitialImportError {
+			close(m.startCloseCh) // stops the goroutine above, m is never returned to be closed
+			m.disconnect()
+			return nil, fmt.Errorf("failed to import cache at startup: %w", err)
+		}
 		// the first import failed, but we can continue with just the local cache to start and retry
 		// importing in the background in the loop below
 		bklog.G(ctx).WithError(err).Error("failed to import cache at startup")
 	}
 
+	if len(m.WarmKeys) > 0 && m.Worker != nil {
+		go func() {
+			warmCtx, cancel := context.WithTimeout(importParentCtx, backgroundImportTimeout)
+			defer cancel()
+			if err := m.warmKeys(warmCtx, m.Worker.ContentStore(), m.Worker.LeaseManager(), m.Worker.FromRemote); err != nil {
+				bklog.G(ctx).WithError(err).Warn("failed to warm cache records")
+			}
+		}()
+	}
+
+	m.mu.Lock()
+	m.startLoops(ctx)
+	m.mu.Unlock()
+
+	return m, nil
+}
+
+// connect creates the client of the cache service, replacing the previous one, if any.
+func (m *manager) connect() error {
+	if err := m.disconnect(); err != nil {
+		bklog.G(context.TODO()).WithError(err).Warn("failed to close cache service client")
+	}
+	authToken := m.authToken()
+
+	var serviceClient Service
+	var serviceConn io.Closer
+	var uploader blobUploader
+	if m.serviceURL.Scheme == "grpc" || m.serviceURL.Scheme == "grpcs" {
+		grpcTLSConfig := m.tlsConfig
+		if m.serviceURL.Scheme == "grpcs" && grpcTLSConfig == nil {
+			// verified against the system roots
+			grpcTLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		grpcClient, err := newGRPCClient(m.serviceURL.Host, m.Token, grpcTLSConfig, authToken, m.grpcDialOptions()...)
+		if err != nil {
+			return err
+		}
+		serviceClient = grpcClient
+		serviceConn = grpcClient
+		uploader = grpcClient
+	} else {
+		var err error
+		serviceClient, err = newClient(m.ServiceURL, m.Token, m.tlsConfig)
+		if err != nil {
+			return err
+		}
+		if authToken != nil {
+			httpClient := serviceClient.(*client).httpClient
+			httpClient.Transport = newAuthTransport(httpClient.Transport, authToken)
+		}
+	}
+	var serviceRecording io.Closer
+	if m.ServiceRecordingPath != "" {
+		recordingFile, err := os.OpenFile(m.ServiceRecordingPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			if serviceConn != nil {
+				serviceConn.Close()
+			}
+			return fmt.Errorf("failed to open cache service recording: %w", err)
+		}
+		serviceRecording = recordingFile
+		serviceClient = newRecordingService(serviceClient, recordingFile)
+	}
+	if m.ServiceRateLimit > 0 {
+		serviceClient = newRateLimitedService(serviceClient, m.ServiceRateLimit, m.ServiceRateBurst)
+	}
+	if m.RetryMaxDuration > 0 {
+		serviceClient = newRetryingService(serviceClient, m.retryPolicy())
+	}
+
+	m.serviceMu.Lock()
+	defer m.serviceMu.Unlock()
+	m.cacheClient = serviceClient
+	m.serviceRecording = serviceRecording
+	m.serviceConn = serviceConn
+	m.blobUploader = uploader
+	return nil
+}
+
+// disconnect closes what the client of the cache service holds open. The client itself is kept,
+// so calls made with it afterwards fail rather than panic.
+func (m *manager) disconnect() (rerr error) {
+	m.serviceMu.Lock()
+	defer m.serviceMu.Unlock()
+	if m.serviceRecording != nil {
+		rerr = m.serviceRecording.Close()
+		m.serviceRecording = nil
+	}
+	if m.serviceConn != nil {
+		if err := m.serviceConn.Close(); err != nil && rerr == nil {
+			rerr = err
+		}
+		m.serviceConn = nil
+	}
+	return rerr
+}
+
+// service returns the client of the cache service.
+func (m *manager) service() Service {
+	m.serviceMu.RLock()
+	defer m.serviceMu.RUnlock()
+	return m.cacheClient
+}
+
+// uploader returns the client of the cache service if it uploads blobs itself, or nil.
+func (m *manager) uploader() blobUploader {
+	m.serviceMu.RLock()
+	defer m.serviceMu.RUnlock()
+	return m.blobUploader
+}
+
+// startLoops starts the loops of periodic imports and exports, which run until the manager is
+// closed or stopLoopsCh is closed. Must be called with mu held.
+func (m *manager) startLoops(ctx context.Context) {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	m.stopLoopsCh = stopCh
+	m.doneCh = doneCh
+
+	importParentCtx, cancelImport := context.WithCancelCause(context.Background())
+	go func() {
+		select {
+		case <-m.startCloseCh:
+			cancelImport(errors.New("cache manager closing"))
+		case <-stopCh:
+			cancelImport(errRemoteDisabled)
+		}
+	}()
+
 	// loop for periodic async imports
 	go func() {
-		importTicker := time.NewTicker(config.ImportPeriod)
-		defer importTicker.Stop()
+		breaker := m.newLoopBreaker("import", m.config().ImportPeriod)
+		importTimer := time.NewTimer(breaker.wait())
+		defer importTimer.Stop()
 		for {
 			select {
-			case <-importTicker.C:
+			case <-importTimer.C:
+			case <-m.configReloadedCh():
+				breaker.period = m.config().ImportPeriod
+				importTimer.Reset(breaker.wait())
+				continue
 			case <-m.startCloseCh:
 				return
+			case <-stopCh:
+				return
 			}
 			importContext, cancel := context.WithTimeout(importParentCtx, backgroundImportTimeout)
-			if err := m.Import(importContext); err != nil {
-				bklog.G(ctx).WithError(err).Error("failed to import cache")
-			}
+			stats, err := m.ImportWithStats(importContext)
 			cancel()
+			if err == nil {
+				bklog.G(ctx).Debugf("imported cache: %d records, %d layers", stats.Records, stats.Layers)
+			}
+			importTimer.Reset(breaker.next(ctx, err))
 		}
 	}()
 
 	// loop for periodic async exports
 	go func() {
-		defer close(m.doneCh)
+		defer close(doneCh)
 		var shutdown bool
-		exportTicker := time.NewTicker(config.ExportPeriod)
-		defer exportTicker.Stop()
+		breaker := m.newLoopBreaker("export", m.config().ExportPeriod)
+		exportTimer := time.NewTimer(breaker.wait())
+		defer exportTimer.Stop()
 		for {
 			select {
-			case <-exportTicker.C:
+			case <-exportTimer.C:
+			case <-m.configReloadedCh():
+				breaker.period = m.config().ExportPeriod
+				exportTimer.Reset(breaker.wait())
+				continue
 			case <-m.startCloseCh:
 				shutdown = true
-				// always run a final export before shutdown
+				// always run a final export before shutdown, unless the service is disabled
+				if m.isRemoteDisabled() {
+					return
+				}
+			case <-stopCh:
+				return
 			}
-			exportCtx, cancel := context.WithTimeout(context.Background(), config.ExportTimeout)
+			exportCtx, cancel := m.exportContext(context.Background())
 			defer cancel()
-			if err := m.Export(exportCtx); err != nil {
-				bklog.G(ctx).WithError(err).Error("failed to export cache")
+			stats, err := m.sharedExport(exportCtx)
+			if err == nil {
+				bklog.G(ctx).Debugf("exported cache: %d cache keys, %d records, %d layers, %d bytes uploaded, skipped %v",
+					stats.CacheKeys, stats.ExportedRecords, stats.PushedLayers, stats.UploadedBytes, stats.SkipReasons)
 			}
 			if shutdown {
+				if err != nil {
+					bklog.G(ctx).WithError(err).Error("failed to export cache")
+				}
 				return
 			}
+			exportTimer.Reset(breaker.next(ctx, err))
 		}
 	}()
+}
 
-	return m, nil
+// loopsDone returns a channel closed once the periodic loops have stopped.
+func (m *manager) loopsDone() <-chan struct{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.doneCh
 }
 
 func (m *manager) Export(ctx context.Context) error {
+	_, err := m.ExportWithStats(ctx)
+	return err
+}
+
+// ExportWithStats is Export, also returning stats of the export.
+func (m *manager) ExportWithStats(ctx context.Context) (ExportStats, error) {
+	var stats ExportStats
+	ctx, done, err := m.remoteContext(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer done()
+	err = m.export(ctx, &stats)
+	return stats, err
+}
+
+// Flush exports the cache to the service right away, e.g. before the engine's node is drained,
+// leaving the periodic exports running. It times out after the ExportTimeout of the service's
+// config like periodic exports, and joins one already in progress rather than exporting twice.
+func (m *manager) Flush(ctx context.Context) error {
+	ctx, cancel := m.exportContext(ctx)
+	defer cancel()
+	_, err := m.sharedExport(ctx)
+	return err
+}
+
+// sharedExport runs an export, or waits for the one the export loop or Flush is running to finish
+// and returns its result instead. A waiter gives up when its own context is done, but the
+// export is done with the context of the caller that started it.
+func (m *manager) sharedExport(ctx context.Context) (ExportStats, error) {
+	ch := m.exportGroup.DoChan("export", func() (any, error) {
+		return m.ExportWithStats(ctx)
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(ExportStats), res.Err
+	case <-ctx.Done():
+		return ExportStats{}, context.Cause(ctx)
+	}
+}
+
+func (m *manager) export(ctx context.Context, stats *ExportStats) (rerr error) {
+	if m.ExportConcurrency == ExportCancelInFlight {
+		var done func()
+		ctx, done = m.supersedeInFlightExport(ctx)
+		defer done()
+	}
+
+	m.exportMu.Lock()
+	defer m.exportMu.Unlock()
+	if ctx.Err() != nil {
+		// canceled while waiting for the previous export to finish
+		return context.Cause(ctx)
+	}
+
 	bklog.G(ctx).Debug("starting cache export")
 	cacheExportStart := time.Now()
 	defer func() {
 		bklog.G(ctx).Debugf("finished cache export in %s", time.Since(cacheExportStart))
 	}()
 
+	uploadedBytesStart := m.uploadedBytes.Load()
+	defer func() {
+		stats.Duration = time.Since(cacheExportStart)
+		stats.Err = rerr
+		stats.UploadedBytes = m.uploadedBytes.Load() - uploadedBytesStart
+		m.metrics().RecordExport(*stats)
+
+		m.mu.Lock()
+		if rerr != nil {
+			m.lastErr, m.lastErrAt = rerr, m.now()
+		} else {
+			m.exportedAt = m.now()
+		}
+		m.mu.Unlock()
+	}()
+
+	// In incremental mode only keys with results created since the last successful export are
+	// walked, with a full export every so often so the service can reconcile its view of the cache.
+	incremental := m.ExportIncremental &&
+		!m.exportWatermark.IsZero() &&
+		m.incrementalExports < maxIncrementalExports
+	watermark := m.exportWatermark
+	defer func() {
+		if rerr != nil {
+			return
+		}
+		m.exportWatermark = cacheExportStart
+		if incremental {
+			m.incrementalExports++
+		} else {
+			m.incrementalExports = 0
+		}
+	}()
+
 	var cacheKeys []CacheKey
 	var links []Link
+	filteredKeys := make(map[string]struct{}) // rejected by ExportFilter
+
+	// the results loaded during the walk are held until their layers have been pushed, rather
+	// than getting their refs again later, which can race with them being garbage collected
+	var loadedResults []solver.Result
+	walkedRefs := make(map[string]cache.ImmutableRef)
+	defer func() {
+		for _, res := range loadedResults {
+			res.Release(context.Background())
+		}
+	}()
 
-	bklog.G(ctx).Debug("starting cache export key store walk")
+	bklog.G(ctx).Debugf("starting cache export key store walk (incremental: %t)", incremental)
 	keyStoreWalkStart := time.Now()
+	// the walk can take a while over a large key store, so each callback checks whether the
+	// export has been canceled or timed out to bail out promptly
 	err := m.KeyStore.Walk(func(id string) error {
-		cacheKey := CacheKey{ID: id}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		cacheKey := CacheKey{ID: m.KeyPrefix + id}
 
+		var keyLinks []Link
 		err := m.KeyStore.WalkBacklinks(id, func(linkedID string, linkInfo solver.CacheInfoLink) error {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
 			link := Link{
-				ID:       id,
-				LinkedID: linkedID,
+				ID:       m.KeyPrefix + id,
+				LinkedID: m.KeyPrefix + linkedID,
 				Input:    int(linkInfo.Input),
 				Digest:   linkInfo.Digest,
 				Selector: linkInfo.Selector,
 			}
-			links = append(links, link)
+			keyLinks = append(keyLinks, link)
 			return nil
 		})
 		if err != nil {
@@ -182,6 +904,12 @@ func (m *manager) Export(ctx context.Context) error {
 		}
 
 		err = m.KeyStore.WalkResults(id, func(cacheResult solver.CacheResult) error {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			if incremental && !cacheResult.CreatedAt.After(watermark) {
+				return nil
+			}
 			res, err := m.ResultStore.Load(ctx, cacheResult)
 			if err != nil {
 				// The ref may be lazy or pruned, we'll just skip it, but if it's not found we can
@@ -192,267 +920,1038 @@ func (m *manager) Export(ctx context.Context) error {
 				// It's safe to do this while walking because all the Walk* methods in KeyStore are just
 				// a no-op when called with an id that's not found, as opposed to returning an error.
 				bklog.G(ctx).Debugf("skipping cache result %s for %s: %v", cacheResult.ID, id, err)
-
-				// TODO: the error we want to match against is `errNotFound` in buildkit's cache
-				// package, but that's not exported. Should modify upstream, in meantime have to
-				// resort to string matching.
-				if strings.HasSuffix(err.Error(), "not found") {
+				reason := refSkipReason(err)
+				stats.skip(cacheResult.ID, reason)
+				if reason == SkipNotFound {
 					if err := m.KeyStore.Release(cacheResult.ID); err != nil {
 						bklog.G(ctx).WithError(err).Errorf("failed to release cache result %s", cacheResult.ID)
 					}
 				}
 				return nil
 			}
-			defer res.Release(context.Background()) // TODO: hold on until later export?
+			loadedResults = append(loadedResults, res)
 			workerRef, ok := res.Sys().(*worker.WorkerRef)
 			if !ok {
 				bklog.G(ctx).Debugf("skipping cache result %s for %s: not an immutable ref", cacheResult.ID, id)
+				stats.skip(cacheResult.ID, SkipNotImmutable)
 				return nil
 			}
 			cacheRef := workerRef.ImmutableRef
 			if cacheRef == nil {
 				bklog.G(ctx).Debugf("skipping cache result %s for %s: nil", cacheResult.ID, id)
+				stats.skip(cacheResult.ID, SkipNotImmutable)
 				return nil
 			}
-			cacheKey.Results = append(cacheKey.Results, Result{
+			if _, ok := walkedRefs[cacheRef.ID()]; !ok {
+				walkedRefs[cacheRef.ID()] = cacheRef
+			}
+			result := Result{
 				ID:          cacheRef.ID(),
 				CreatedAt:   cacheResult.CreatedAt,
 				Description: cacheRef.GetDescription(),
-			})
+			}
+			result.ExpiresAt = m.expiryHint(result, cacheExportStart)
+			result.Retention = m.retentionPolicy(result)
+			if m.AttestationSource != nil {
+				attestations, err := m.AttestationSource(ctx, cacheRef)
+				if err != nil {
+					bklog.G(ctx).WithError(err).Warnf("failed to get attestations for cache result %s", cacheResult.ID)
+				}
+				result.Attestations = attestations
+			}
+			cacheKey.Results = append(cacheKey.Results, result)
 			return nil
 		})
 		if err != nil {
 			return err
 		}
 
+		if incremental && len(cacheKey.Results) == 0 {
+			return nil
+		}
+		if m.ExportFilter != nil && !m.ExportFilter(cacheKey) {
+			filteredKeys[cacheKey.ID] = struct{}{}
+			return nil
+		}
 		cacheKeys = append(cacheKeys, cacheKey)
+		links = append(links, keyLinks...)
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+	if len(filteredKeys) > 0 {
+		// drop links of the keys exported to those filtered out
+		links = slices.DeleteFunc(links, func(link Link) bool {
+			_, ok := filteredKeys[link.LinkedID]
+			return ok
+		})
+		bklog.G(ctx).Debugf("filtered %d cache keys out of export", len(filteredKeys))
+	}
 	bklog.G(ctx).Debugf("finished cache export key store walk in %s", time.Since(keyStoreWalkStart))
 
-	bklog.G(ctx).Debug("calling update cache records")
+	if m.NormalizeExportedRecords {
+		cacheKeys, links = normalizeCacheRecords(cacheKeys, links)
+	}
+
+	var delta bool
+	var removedKeys []string
+	var removedLinks []Link
+	if m.ExportDelta && !incremental {
+		exported := newExportedRecords(cacheKeys, links)
+		delta = m.lastExported != nil && m.deltaExports < maxIncrementalExports
+		if delta {
+			cacheKeys, links, removedKeys, removedLinks = m.lastExported.delta(cacheKeys, links)
+		}
+		defer func() {
+			if rerr != nil {
+				return
+			}
+			m.lastExported = exported
+			if delta {
+				m.deltaExports++
+			} else {
+				m.deltaExports = 0
+			}
+		}()
+	}
+
+	updateCacheRecordsReqs := []UpdateCacheRecordsRequest{{
+		CacheKeys:        cacheKeys,
+		Links:            links,
+		RemovedCacheKeys: removedKeys,
+		RemovedLinks:     removedLinks,
+	}}
+	if m.ExportBatchMaxBytes > 0 {
+		updateCacheRecordsReqs, err = batchCacheRecords(cacheKeys, links, removedKeys, removedLinks, m.ExportBatchMaxBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	stats.CacheKeys = len(cacheKeys)
+
+	bklog.G(ctx).Debugf("calling update cache records in %d batches", len(updateCacheRecordsReqs))
 	updateCacheRecordsStart := time.Now()
-	updateCacheRecordsResp, err := m.cacheClient.UpdateCacheRecords(ctx, UpdateCacheRecordsRequest{
-		CacheKeys: cacheKeys,
-		Links:     links,
-	})
+	var recordsToExport []ExportRecord
+	for i, req := range updateCacheRecordsReqs {
+		req.Namespace = m.Namespace
+		req.Incremental = incremental
+		req.Delta = delta
+		req.MoreBatches = i < len(updateCacheRecordsReqs)-1
+		updateCacheRecordsResp, err := m.service().UpdateCacheRecords(ctx, req)
+		if err != nil {
+			return err
+		}
+		recordsToExport = append(recordsToExport, updateCacheRecordsResp.ExportRecords...)
+	}
+	bklog.G(ctx).Debugf("finished update cache records call in %s", time.Since(updateCacheRecordsStart))
+	stats.ExportedRecords = len(recordsToExport)
+
+	if len(recordsToExport) == 0 {
+		bklog.G(ctx).Debug("no cache records to export")
+		return nil
+	}
+
+	var layerKeyID string
+	if m.LayerKeys != nil {
+		layerKeyID, _, err = m.LayerKeys.CurrentKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get layer encryption key: %w", err)
+		}
+	}
+
+	// with ContinueOnRecordError, records that fail to export are skipped, with their errors
+	// returned once the rest have been exported
+	var recordErrs []error
+	skipFailedRecord := func(refID string, err error) bool {
+		if !m.ContinueOnRecordError || ctx.Err() != nil {
+			return false
+		}
+		bklog.G(ctx).WithError(err).Errorf("skipping cache ref for export %s: failed to export", refID)
+		stats.skip(refID, SkipFailed)
+		recordErrs = append(recordErrs, fmt.Errorf("cache ref %s: %w", refID, err))
+		return true
+	}
+
+	// get the remotes of all the records first, so that the service can be asked which of their
+	// layers it already has in one call
+	var exportRefs []exportRef
+	var gotRefs []cache.ImmutableRef // refs that weren't walked, released once pushed
+	defer func() {
+		for _, ref := range gotRefs {
+			ref.Release(context.Background())
+		}
+	}()
+	for _, record := range recordsToExport {
+		bklog.G(ctx).Debugf("getting remotes for cache ref %s", record.CacheRefID)
+		getRemotesStart := time.Now()
+
+		cacheRef, ok := walkedRefs[record.CacheRefID]
+		if !ok {
+			var err error
+			cacheRef, err = m.Worker.CacheManager().Get(ctx, record.CacheRefID, nil, cache.NoUpdateLastUsed)
+			if err != nil {
+				// the ref may be lazy or pruned, just skip it
+				bklog.G(ctx).Debugf("skipping cache ref for export %s: %v", record.CacheRefID, err)
+				stats.skip(record.CacheRefID, refSkipReason(err))
+				continue
+			}
+			gotRefs = append(gotRefs, cacheRef)
+		}
+		remotes, err := m.exportRemotes(ctx, cacheRef)
+		if err != nil {
+			if skipFailedRecord(record.CacheRefID, err) {
+				continue
+			}
+			return err
+		}
+		if len(remotes) == 0 {
+			bklog.G(ctx).Errorf("skipping cache ref for export %s: no remotes", record.CacheRefID)
+			stats.skip(record.CacheRefID, SkipNoRemotes)
+			continue
+		}
+		exportRefs = append(exportRefs, exportRef{record: record, remotes: remotes})
+		bklog.G(ctx).Debugf("finished getting remotes for cache ref %s in %s", record.CacheRefID, time.Since(getRemotesStart))
+	}
+
+	// keep track of what layers we've already pushed as they can show up multiple times
+	// across different cache refs, starting with those the service already has
+	pushedLayers, err := m.existingLayers(ctx, exportRefs)
 	if err != nil {
 		return err
 	}
-	bklog.G(ctx).Debugf("finished update cache records call in %s", time.Since(updateCacheRecordsStart))
 
-	recordsToExport := updateCacheRecordsResp.ExportRecords
-	if len(recordsToExport) == 0 {
-		bklog.G(ctx).Debug("no cache records to export")
-		return nil
+	updatedRecords := make([]RecordLayers, 0, len(exportRefs))
+	pushLayersStart := time.Now()
+	// the pushed layers along with the refs they're layers of, for LayerGC
+	exportedLayers := make(map[digest.Digest]*exportedLayer)
+	// layers that timed out in ExportTimeoutPerLayer mode, which aren't tried again this export
+	timedOutLayers := make(map[digest.Digest]struct{})
+	// how long each layer uploaded took, for the percentiles in the stats
+	var uploadTimes []time.Duration
+	defer func() {
+		stats.UploadTimeP50 = percentile(uploadTimes, 50)
+		stats.UploadTimeP95 = percentile(uploadTimes, 95)
+	}()
+	for _, ref := range exportRefs {
+		record := ref.record
+		bklog.G(ctx).Debugf("pushing layers for cache ref %s", record.CacheRefID)
+		pushRefLayersStart := time.Now()
+		uploadURLs, err := m.layerUploadURLs(ctx, ref, pushedLayers)
+		if err != nil {
+			return err
+		}
+		var timedOut, failed bool
+	pushRemotes:
+		for _, remote := range ref.remotes {
+			provider := m.exportProvider(remote.Provider)
+			for _, layer := range remote.Descriptors {
+				if _, ok := timedOutLayers[layer.Digest]; ok {
+					timedOut = true
+					break pushRemotes
+				}
+				if _, ok := pushedLayers[layer.Digest]; ok {
+					continue
+				}
+				uploadTime, layerTimedOut, err := m.pushExportLayer(ctx, layer, provider, uploadURLs[layer.Digest])
+				if err != nil {
+					if skipFailedRecord(record.CacheRefID, err) {
+						failed = true
+						break pushRemotes
+					}
+					return err
+				}
+				if layerTimedOut {
+					timedOutLayers[layer.Digest] = struct{}{}
+					timedOut = true
+					break pushRemotes
+				}
+				pushedLayers[layer.Digest] = struct{}{}
+				if uploadTime > 0 {
+					uploadTimes = append(uploadTimes, uploadTime)
+				}
+			}
+		}
+		bklog.G(ctx).Debugf("finished pushing layers for cache ref %s in %s", record.CacheRefID, time.Since(pushRefLayersStart))
+		if failed {
+			continue
+		}
+		if timedOut {
+			bklog.G(ctx).Warnf("skipping cache ref for export %s: a layer push timed out", record.CacheRefID)
+			stats.skip(record.CacheRefID, SkipTimedOut)
+			continue
+		}
+		for _, remote := range ref.remotes {
+			for _, layer := range remote.Descriptors {
+				if exported, ok := exportedLayers[layer.Digest]; ok {
+					exported.refIDs = append(exported.refIDs, record.CacheRefID)
+				} else {
+					exportedLayers[layer.Digest] = &exportedLayer{desc: layer, refIDs: []string{record.CacheRefID}}
+					stats.PushedLayers++
+				}
+			}
+		}
+
+		// records are updated even if the service already had all their layers
+		updatedRecord := RecordLayers{RecordDigest: record.Digest}
+		for i, remote := range ref.remotes {
+			layers := remote.Descriptors
+			if layerKeyID != "" {
+				layers = withEncryptionAnnotation(layers, layerKeyID)
+			}
+			if i == 0 {
+				updatedRecord.Layers = layers
+			} else {
+				updatedRecord.Variants = append(updatedRecord.Variants, layers)
+			}
+		}
+		updatedRecords = append(updatedRecords, updatedRecord)
+	}
+	bklog.G(ctx).Debugf("finished pushing layers in %s", time.Since(pushLayersStart))
+
+	if m.NormalizeExportedLayers {
+		updatedRecords = normalizeRecordLayers(updatedRecords)
+	}
+
+	bklog.G(ctx).Debugf("calling update cache layers")
+	updateCacheLayersStart := time.Now()
+	if err := m.service().UpdateCacheLayers(ctx, UpdateCacheLayersRequest{
+		UpdatedRecords: updatedRecords,
+		Namespace:      m.Namespace,
+	}); err != nil {
+		return err
+	}
+	bklog.G(ctx).Debugf("finished update cache layers call in %s", time.Since(updateCacheLayersStart))
+
+	if m.LayerGC != nil {
+		if err := m.gcExportedLayers(ctx, exportedLayers); err != nil {
+			bklog.G(ctx).WithError(err).Warn("failed to garbage collect exported layers")
+		}
+	}
+
+	if len(recordErrs) > 0 {
+		return fmt.Errorf("failed to export %d cache refs: %w", len(recordErrs), errors.Join(recordErrs...))
+	}
+	return nil
+}
+
+// exportProvider returns the provider to read the layers of an exported remote from.
+func (m *manager) exportProvider(provider content.Provider) content.Provider {
+	if m.ExportProvider == nil {
+		return provider
+	}
+	return m.ExportProvider(provider)
+}
+
+// refSkipReason returns why a ref that failed to load with the given error is skipped by exports.
+func refSkipReason(err error) SkipReason {
+	// TODO: the error we want to match against is `errNotFound` in buildkit's cache
+	// package, but that's not exported. Should modify upstream, in meantime have to
+	// resort to string matching.
+	if strings.HasSuffix(err.Error(), "not found") {
+		return SkipNotFound
+	}
+	return SkipNotLoaded
+}
+
+// exportContext returns the context for a periodic, after-save or flush export, which times out
+// after the ExportTimeout of the service's config unless it's applied per layer.
+func (m *manager) exportContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if m.ExportTimeoutMode == ExportTimeoutPerLayer {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, m.exportTimeout())
+}
+
+func (m *manager) exportTimeout() time.Duration {
+	if timeout := m.config().ExportTimeout; timeout > 0 {
+		return timeout
 	}
+	return defaultExportTimeout
+}
 
-	updatedRecords := make([]RecordLayers, 0, len(recordsToExport))
-	pushLayersStart := time.Now()
-	// keep track of what layers we've already pushed as they can show up multiple times
-	// across different cache refs
-	pushedLayers := make(map[string]struct{})
-	for _, record := range recordsToExport {
-		if err := func() error {
-			bklog.G(ctx).Debugf("exporting cache ref %s", record.CacheRefID)
-			exportCacheRefStart := time.Now()
-			defer func() {
-				bklog.G(ctx).Debugf("finished exporting cache ref %s in %s", record.CacheRefID, time.Since(exportCacheRefStart))
-			}()
-
-			cacheRef, err := m.Worker.CacheManager().Get(ctx, record.CacheRefID, nil, cache.NoUpdateLastUsed)
-			if err != nil {
-				// the ref may be lazy or pruned, just skip it
-				bklog.G(ctx).Debugf("skipping cache ref for export %s: %v", record.CacheRefID, err)
-				return nil
-			}
-			defer cacheRef.Release(context.Background())
+// pushExportLayer pushes a layer of a record being exported, to the given upload URL if it was
+// already requested, returning how long uploading it took as pushLayerTo does. In
+// ExportTimeoutPerLayer mode the push has its own timeout, returning whether it timed out rather
+// than failing the export.
+func (m *manager) pushExportLayer(ctx context.Context, layer ocispecs.Descriptor, provider content.Provider, uploadURL *GetLayerUploadURLResponse) (time.Duration, bool, error) {
+	if m.ExportTimeoutMode != ExportTimeoutPerLayer {
+		uploadTime, err := m.pushLayerTo(ctx, layer, provider, uploadURL)
+		return uploadTime, false, err
+	}
+	layerCtx, cancel := context.WithTimeout(ctx, m.exportTimeout())
+	defer cancel()
+	uploadTime, err := m.pushLayerTo(layerCtx, layer, provider, uploadURL)
+	if err != nil && ctx.Err() == nil && errors.Is(layerCtx.Err(), context.DeadlineExceeded) {
+		bklog.G(ctx).WithError(err).Warnf("pushing layer %s timed out after %s", layer.Digest, m.exportTimeout())
+		return 0, true, nil
+	}
+	return uploadTime, false, err
+}
 
-			bklog.G(ctx).Debugf("getting remotes for cache ref %s", record.CacheRefID)
-			getRemotesStart := time.Now()
-			remotes, err := cacheRef.GetRemotes(ctx, true, cacheconfig.RefConfig{
-				Compression: compression.Config{
-					Type: compression.Zstd,
-				},
-			}, false, nil)
-			if err != nil {
-				return err
-			}
-			bklog.G(ctx).Debugf("finished getting remotes for cache ref %s in %s", record.CacheRefID, time.Since(getRemotesStart))
+// exportRef is a record to export along with the remotes of its cache ref to export its layers
+// from, the first of which is the main one and any others variants of it.
+type exportRef struct {
+	record  ExportRecord
+	remotes []*solver.Remote
+}
 
-			if len(remotes) == 0 {
-				bklog.G(ctx).Errorf("skipping cache ref for export %s: no remotes", record.CacheRefID)
-				return nil
+// layerUploadURLs returns the upload URLs of the layers of the given ref that haven't been pushed
+// yet, in a single call if the service supports it. They're requested per record rather than for
+// the whole export so that they don't expire before the record's layers get pushed. Layers
+// without a URL in the returned map have theirs requested when pushed.
+func (m *manager) layerUploadURLs(ctx context.Context, ref exportRef, pushedLayers map[digest.Digest]struct{}) (map[digest.Digest]*GetLayerUploadURLResponse, error) {
+	if !m.config().BatchLayerUploadURLs {
+		return nil, nil
+	}
+	var layers []GetLayerUploadURLRequest
+	seen := make(map[digest.Digest]struct{})
+	for _, remote := range ref.remotes {
+		for _, layer := range remote.Descriptors {
+			if _, ok := pushedLayers[layer.Digest]; ok {
+				continue
 			}
-			if len(remotes) > 1 {
-				bklog.G(ctx).Debugf("multiple remotes for cache ref %s, using the first one", record.CacheRefID)
+			if _, ok := seen[layer.Digest]; ok {
+				continue
 			}
-			remote := remotes[0]
+			seen[layer.Digest] = struct{}{}
+			layers = append(layers, GetLayerUploadURLRequest{
+				Digest:    layer.Digest,
+				Resumable: m.resumableUpload(layer),
+			})
+		}
+	}
+	if len(layers) == 0 {
+		return nil, nil
+	}
+	resp, err := m.service().GetLayerUploadURLs(ctx, GetLayerUploadURLsRequest{Layers: layers})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layer upload URLs: %w", err)
+	}
+	uploadURLs := make(map[digest.Digest]*GetLayerUploadURLResponse, len(resp.URLs))
+	for dgst, uploadURL := range resp.URLs {
+		if _, ok := seen[dgst]; !ok {
+			// only ever upload a layer to the URL requested for it
+			continue
+		}
+		uploadURLs[dgst] = &uploadURL
+	}
+	return uploadURLs, nil
+}
 
-			bklog.G(ctx).Debugf("pushing layers for cache ref %s", record.CacheRefID)
-			pushRefLayersStart := time.Now()
+// existingLayers returns the layers of the given refs that the service already has, if it
+// supports telling, in a single call.
+func (m *manager) existingLayers(ctx context.Context, exportRefs []exportRef) (map[digest.Digest]struct{}, error) {
+	existing := make(map[digest.Digest]struct{})
+	if !m.config().LayersExist {
+		return existing, nil
+	}
+	var digests []digest.Digest
+	seen := make(map[digest.Digest]struct{})
+	for _, ref := range exportRefs {
+		for _, remote := range ref.remotes {
 			for _, layer := range remote.Descriptors {
-				if _, ok := pushedLayers[layer.Digest.String()]; ok {
-					continue
+				if _, ok := seen[layer.Digest]; !ok {
+					seen[layer.Digest] = struct{}{}
+					digests = append(digests, layer.Digest)
 				}
-				if err := m.pushLayer(ctx, layer, remote.Provider); err != nil {
-					return err
-				}
-				pushedLayers[layer.Digest.String()] = struct{}{}
 			}
-			bklog.G(ctx).Debugf("finished pushing layers for cache ref %s in %s", record.CacheRefID, time.Since(pushRefLayersStart))
-			updatedRecords = append(updatedRecords, RecordLayers{
-				RecordDigest: record.Digest,
-				Layers:       remote.Descriptors,
-			})
-			return nil
-		}(); err != nil {
-			return err
 		}
 	}
-	bklog.G(ctx).Debugf("finished pushing layers in %s", time.Since(pushLayersStart))
+	if len(digests) == 0 {
+		return existing, nil
+	}
+	resp, err := m.service().LayersExist(ctx, LayersExistRequest{Digests: digests})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for existing layers: %w", err)
+	}
+	for _, dgst := range resp.Existing {
+		existing[dgst] = struct{}{}
+	}
+	bklog.G(ctx).Debugf("service already has %d of %d layers to export", len(existing), len(digests))
+	return existing, nil
+}
 
-	bklog.G(ctx).Debugf("calling update cache layers")
-	updateCacheLayersStart := time.Now()
-	if err := m.cacheClient.UpdateCacheLayers(ctx, UpdateCacheLayersRequest{
-		UpdatedRecords: updatedRecords,
-	}); err != nil {
-		return err
+// expiryHint returns when the service may expire the given result, if configured.
+func (m *manager) expiryHint(result Result, exportTime time.Time) *time.Time {
+	var expiresAt time.Time
+	switch {
+	case m.ExportExpiry != nil:
+		expiresAt = m.ExportExpiry(result)
+	case m.ExportTTL > 0:
+		expiresAt = exportTime.Add(m.ExportTTL)
 	}
-	bklog.G(ctx).Debugf("finished update cache layers call in %s", time.Since(updateCacheLayersStart))
+	if expiresAt.IsZero() {
+		return nil
+	}
+	return &expiresAt
+}
 
-	return nil
+// retentionPolicy returns the retention policy to export the given result with, if any.
+func (m *manager) retentionPolicy(result Result) *RetentionPolicy {
+	policy := m.ExportRetentionPolicy
+	if m.ExportRetention != nil {
+		policy = m.ExportRetention(result)
+	}
+	if policy == (RetentionPolicy{}) {
+		return nil
+	}
+	return &policy
+}
+
+// supersedeInFlightExport cancels any in-progress export and returns a context for the new export
+// that will in turn be canceled if another export starts before it's done.
+func (m *manager) supersedeInFlightExport(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	m.inFlightExportMu.Lock()
+	defer m.inFlightExportMu.Unlock()
+	if m.cancelInFlightExport != nil {
+		m.cancelInFlightExport(errExportSuperseded)
+	}
+	m.inFlightExportGen++
+	gen := m.inFlightExportGen
+	m.cancelInFlightExport = cancel
+
+	return ctx, func() {
+		m.inFlightExportMu.Lock()
+		defer m.inFlightExportMu.Unlock()
+		if m.inFlightExportGen == gen {
+			m.cancelInFlightExport = nil
+		}
+		cancel(nil)
+	}
 }
 
 func (m *manager) pushLayer(ctx context.Context, layerDesc ocispecs.Descriptor, provider content.Provider) error {
+	_, err := m.pushLayerTo(ctx, layerDesc, provider, nil)
+	return err
+}
+
+// pushLayerTo pushes the layer to the given upload URL, requesting one from the service if it's
+// nil. It returns how long uploading the layer took, zero if the service already had it or it
+// was written to LayerMirror to be uploaded in the background.
+func (m *manager) pushLayerTo(ctx context.Context, layerDesc ocispecs.Descriptor, provider content.Provider, getURLResp *GetLayerUploadURLResponse) (uploadTime time.Duration, rerr error) {
 	bklog.G(ctx).Debugf("pushing layer %s", layerDesc.Digest)
 	pushLayerStart := time.Now()
+	layerProgress := m.startLayerProgress(layerDesc)
 
 	var skipped bool
+	// set once the layer starts uploading, after its upload URL is got
+	var uploadStart time.Time
+	uploadSize := layerDesc.Size
 	defer func() {
+		layerProgress.done(skipped, rerr)
 		verbPrefix := "finished"
 		if skipped {
 			verbPrefix = "skipped"
 		}
 
 		bklog.G(ctx).Debugf("%s pushing layer %s in %s", verbPrefix, layerDesc.Digest, time.Since(pushLayerStart))
+		if rerr == nil && !uploadStart.IsZero() {
+			uploadTime = time.Since(uploadStart)
+			m.checkUploadThroughput(ctx, layerDesc, uploadSize, uploadTime)
+		}
 	}()
 
-	getURLResp, err := m.cacheClient.GetLayerUploadURL(ctx, GetLayerUploadURLRequest{Digest: layerDesc.Digest})
-	if err != nil {
-		return err
+	if getURLResp == nil {
+		var err error
+		getURLResp, err = m.service().GetLayerUploadURL(ctx, GetLayerUploadURLRequest{
+			Digest:    layerDesc.Digest,
+			Resumable: m.resumableUpload(layerDesc),
+		})
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	if skipped = getURLResp.Skip; skipped {
-		return nil
+		return 0, nil
+	}
+
+	if m.LayerMirror != nil {
+		return 0, m.mirrorLayer(ctx, layerDesc, provider, getURLResp)
+	}
+
+	if streamer, ok := provider.(layerStreamer); ok && !m.ChunkedLayers && !getURLResp.Resumable {
+		uploadStart = time.Now()
+		return 0, m.putBlob(ctx, getURLResp, func() (io.Reader, int64, error) {
+			stream, err := streamer.StreamLayer(ctx, layerDesc)
+			if err != nil {
+				return nil, 0, err
+			}
+			stream = layerProgress.reader(stream)
+			body, size, err := m.encryptBlob(ctx, stream, layerDesc.Size)
+			if err != nil {
+				stream.Close()
+				return nil, 0, err
+			}
+			// the request closes its body once done with it, which closes the stream too
+			return struct {
+				io.Reader
+				io.Closer
+			}{body, stream}, size, nil
+		})
 	}
 
 	readerAt, err := provider.ReaderAt(ctx, layerDesc)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer readerAt.Close()
-	reader := content.NewReader(readerAt)
+	// the content read, which the descriptor's size may not match if the provider transforms it
+	uploadSize = readerAt.Size()
+	uploadStart = time.Now()
+	return 0, m.uploadLayer(ctx, layerDesc, layerProgress.readerAt(readerAt), getURLResp)
+}
 
-	req, err := http.NewRequest("PUT", getURLResp.URL, reader)
-	if err != nil {
-		return err
+// checkUploadThroughput warns about a layer that took long to upload for its size, with
+// throughput below SlowUploadThroughput, so that a pathological layer slowing down exports can be
+// told apart from the service being slow in general.
+func (m *manager) checkUploadThroughput(ctx context.Context, layerDesc ocispecs.Descriptor, size int64, uploadTime time.Duration) {
+	if m.SlowUploadThroughput <= 0 || size < minSlowUploadSize || uploadTime <= 0 {
+		return
+	}
+	throughput := float64(size) / uploadTime.Seconds()
+	if throughput < float64(m.SlowUploadThroughput) {
+		bklog.G(ctx).Warnf("slow upload of layer %s: %d bytes in %s (%.2f MB/s)",
+			layerDesc.Digest, size, uploadTime, throughput/1e6)
+	}
+}
+
+// uploadLayer uploads the layer read from readerAt to the given upload URL, in chunks if
+// ChunkedLayers is set, or in parts if the URL accepts a resumable upload.
+func (m *manager) uploadLayer(ctx context.Context, layerDesc ocispecs.Descriptor, readerAt content.ReaderAt, uploadURL *GetLayerUploadURLResponse) error {
+	if m.ChunkedLayers {
+		return m.pushLayerChunks(ctx, layerDesc, readerAt, uploadURL)
 	}
-	defer req.Body.Close()
-	req.ContentLength = readerAt.Size()
-	for k, v := range getURLResp.Headers {
-		req.Header.Set(k, v)
+	if uploadURL.Resumable {
+		return m.putBlobResumable(ctx, uploadURL, readerAt)
 	}
+	return m.putBlob(ctx, uploadURL, func() (io.Reader, int64, error) {
+		return m.encryptBlob(ctx, content.NewReader(readerAt), readerAt.Size())
+	})
+}
+
+// layerStreamer is implemented by providers that can stream a layer as it's being computed, so
+// that it can be uploaded without waiting for the full blob to be available to a ReaderAt.
+type layerStreamer interface {
+	StreamLayer(ctx context.Context, desc ocispecs.Descriptor) (io.ReadCloser, error)
+}
 
-	resp, err := m.httpClient.Do(req)
+// encryptBlob returns a reader of the blob to upload for the given content, along with its size,
+// encrypting it if layer encryption is enabled.
+func (m *manager) encryptBlob(ctx context.Context, reader io.Reader, size int64) (io.Reader, int64, error) {
+	if m.LayerKeys == nil {
+		return reader, size, nil
+	}
+	encryptor, err := newLayerEncryptor(ctx, m.LayerKeys)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
-	if err := checkResponse(resp); err != nil {
-		return err
+	return encryptor.Reader(reader), encryptor.Size(size), nil
+}
+
+// putBlob uploads the blob read from the reader returned by newBody, which is called again for
+// each retry.
+func (m *manager) putBlob(ctx context.Context, uploadURL *GetLayerUploadURLResponse, newBody func() (io.Reader, int64, error)) error {
+	return m.uploadRetryPolicy().do(ctx, func() error {
+		body, contentLength, err := newBody()
+		if err != nil {
+			return err
+		}
+		if uploader := m.uploader(); uploader != nil {
+			if closer, ok := body.(io.Closer); ok {
+				defer closer.Close()
+			}
+			if err := uploader.PutBlob(ctx, uploadURL, body, contentLength); err != nil {
+				return err
+			}
+			m.uploadedBytes.Add(contentLength)
+			return nil
+		}
+		req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL.URL, body)
+		if err != nil {
+			return err
+		}
+		defer req.Body.Close()
+		req.ContentLength = contentLength
+		for k, v := range uploadURL.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := m.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+		m.uploadedBytes.Add(contentLength)
+		return nil
+	})
+}
+
+// layerHTTPClient returns the client to upload and download layers with.
+func (m *manager) layerHTTPClient(tlsConfig *tls.Config) *http.Client {
+	if m.HTTPClient != nil {
+		// copied so that the auth transport set on it isn't set on the caller's
+		httpClient := *m.HTTPClient
+		return &httpClient
+	}
+	return &http.Client{
+		Transport: newLayerTransport(tlsConfig),
+		Timeout:   m.HTTPTimeout,
 	}
-	return nil
 }
 
+// Import imports the service's cache config, replacing the previously imported one. If an import
+// is already in progress, it waits for that one instead and returns its result; the import is
+// done with the context of the caller that started it.
 func (m *manager) Import(ctx context.Context) error {
+	_, err := m.ImportWithStats(ctx)
+	return err
+}
+
+// ImportWithStats is Import, also returning stats of the import.
+func (m *manager) ImportWithStats(ctx context.Context) (ImportStats, error) {
+	ch := m.importGroup.DoChan("import", func() (any, error) {
+		ctx, done, err := m.remoteContext(ctx)
+		if err != nil {
+			return ImportStats{}, err
+		}
+		defer done()
+		return m.doImport(ctx)
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(ImportStats), res.Err
+	case <-ctx.Done():
+		return ImportStats{}, context.Cause(ctx)
+	}
+}
+
+func (m *manager) doImport(ctx context.Context) (stats ImportStats, rerr error) {
+	if m.ScopedImport {
+		// records are imported on demand as they're queried, so just drop those imported so far
+		// for them to be fetched again with fresh results
+		m.resetScopedImports()
+		return stats, nil
+	}
+
 	bklog.G(ctx).Debug("importing cache")
 	importCacheStart := time.Now()
 	defer func() {
 		bklog.G(ctx).Debugf("finished importing cache in %s", time.Since(importCacheStart))
+		m.mu.Lock()
+		m.importErr = rerr
+		if rerr != nil {
+			m.lastErr, m.lastErrAt = rerr, m.now()
+		}
+		m.mu.Unlock()
+		stats.Duration = time.Since(importCacheStart)
+		stats.Err = rerr
+		m.metrics().RecordImport(stats)
 	}()
 
 	bklog.G(ctx).Debug("calling import cache")
 	importCacheCallStart := time.Now()
-	cacheConfig, err := m.cacheClient.ImportCache(ctx)
+	cacheConfig, err := m.service().ImportCache(ctx, ImportCacheRequest{
+		KeyPrefix: m.KeyPrefix,
+		Namespace: m.Namespace,
+	})
 	if err != nil {
-		return err
+		return stats, err
 	}
 	bklog.G(ctx).Debugf("finished import cache call in %s", time.Since(importCacheCallStart))
+	stats.Records = len(cacheConfig.Records)
+	stats.Layers = len(cacheConfig.Layers)
+
+	// the snapshot is of the config as imported, before it's repaired or deduped
+	var rawConfig []byte
+	if m.ChainCacheDir != "" {
+		rawConfig, err = json.Marshal(&cacheConfig.CacheConfig)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	importedCache, attestations, err := m.loadCacheConfig(ctx, &cacheConfig.CacheConfig, m.ID()+"-import")
+	if err != nil {
+		return stats, err
+	}
+	cacheManagers := []solver.CacheManager{importedCache}
+	if m.ReferrersSubject != "" {
+		referrerCaches, err := m.importReferrers(ctx)
+		if err != nil {
+			// the service's cache is still worth using without the referrers
+			bklog.G(ctx).WithError(err).Warnf("failed to import cache referrers of %s", m.ReferrersSubject)
+		}
+		cacheManagers = append(cacheManagers, referrerCaches...)
+	}
+	newInner := m.combine(cacheManagers...)
+
+	importedAt := m.now()
+	if rawConfig != nil {
+		if err := m.saveChainSnapshot(cacheConfig.CacheGeneration, importedAt, rawConfig); err != nil {
+			bklog.G(ctx).WithError(err).Warn("failed to save cache snapshot")
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.remoteDisabled {
+		// disabled while the import was finishing
+		return stats, errRemoteDisabled
+	}
+	m.inner = newInner
+	m.importedAt = importedAt
+	m.attestations = attestations
+	return stats, nil
+}
+
+// loadCacheConfig turns an imported cache config into a cache manager with the given ID, along
+// with the attestations of its records if ImportAttestations is set.
+func (m *manager) loadCacheConfig(
+	ctx context.Context,
+	cacheConfig *remotecache.CacheConfig,
+	id string,
+) (solver.CacheManager, map[digest.Digest][]Attestation, error) {
+	if err := m.prepareCacheConfig(ctx, cacheConfig); err != nil {
+		return nil, nil, err
+	}
 
 	bklog.G(ctx).Debug("creating descriptor provider pairs")
 	createDescProviderPairsStart := time.Now()
 	descProvider := remotecache.DescriptorProvider{}
+	provider := m.layerProvider.forImport()
 	for _, layer := range cacheConfig.Layers {
-		providerPair, err := m.descriptorProviderPair(layer)
+		providerPair, err := m.descriptorProviderPair(layer, provider)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		descProvider[layer.Blob] = *providerPair
 	}
 	bklog.G(ctx).Debugf("finished creating descriptor provider pairs in %s", time.Since(createDescProviderPairsStart))
 
+	var attestations map[digest.Digest][]Attestation
+	if m.ImportAttestations {
+		var err error
+		attestations, err = m.importAttestations(ctx, cacheConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to import attestations: %w", err)
+		}
+	}
+
+	importedCache, err := m.parseCacheConfig(ctx, cacheConfig, descProvider, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return importedCache, attestations, nil
+}
+
+// prepareCacheConfig repairs the links of an imported cache config and, if DedupeImportedResults
+// is set, drops its results that are already cached locally.
+func (m *manager) prepareCacheConfig(ctx context.Context, cacheConfig *remotecache.CacheConfig) error {
+	droppedLinks, droppedRecords, err := repairCacheConfigLinks(cacheConfig, m.StrictImport)
+	if err != nil {
+		return fmt.Errorf("invalid cache config: %w", err)
+	}
+	if droppedLinks > 0 {
+		bklog.G(ctx).Warnf("dropped %d dangling links and %d records left without them from imported cache config", droppedLinks, droppedRecords)
+	}
+
+	if m.DedupeImportedResults {
+		dedupedRecords, err := dropLocallyCachedResults(cacheConfig, m.KeyStore)
+		if err != nil {
+			return err
+		}
+		bklog.G(ctx).Debugf("dropped imported results of %d records already in the local cache", dedupedRecords)
+	}
+	return nil
+}
+
+// parseCacheConfig turns a prepared cache config, whose layers are provided by descProvider,
+// into a cache manager with the given ID.
+func (m *manager) parseCacheConfig(
+	ctx context.Context,
+	cacheConfig *remotecache.CacheConfig,
+	descProvider remotecache.DescriptorProvider,
+	id string,
+) (solver.CacheManager, error) {
 	bklog.G(ctx).Debug("parsing cache config")
 	parseCacheConfigStart := time.Now()
 	chain := remotecache.NewCacheChains()
 	if err := remotecache.ParseConfig(*cacheConfig, descProvider, chain); err != nil {
-		return err
+		return nil, err
 	}
 	bklog.G(ctx).Debugf("finished parsing cache config in %s", time.Since(parseCacheConfigStart))
 
 	keyStore, resultStore, err := remotecache.NewCacheKeyStorage(chain, m.Worker)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	importedCache := solver.NewCacheManager(ctx, m.ID()+"-import", keyStore, resultStore)
-	newInner := solver.NewCombinedCacheManager([]solver.CacheManager{m.localCache, importedCache}, m.localCache)
+	return solver.NewCacheManager(ctx, id, keyStore, resultStore), nil
+}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.inner = newInner
-	return nil
+func (m *manager) importAttestations(ctx context.Context, cacheConfig *remotecache.CacheConfig) (map[digest.Digest][]Attestation, error) {
+	var recordDigests []digest.Digest
+	for _, record := range cacheConfig.Records {
+		if len(record.Results) > 0 || len(record.ChainedResults) > 0 {
+			recordDigests = append(recordDigests, record.Digest)
+		}
+	}
+	if len(recordDigests) == 0 {
+		return nil, nil
+	}
+	resp, err := m.service().GetAttestations(ctx, GetAttestationsRequest{
+		RecordDigests: recordDigests,
+		Namespace:     m.Namespace,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Attestations, nil
+}
+
+// Attestations returns the attestations exported along with the results of the imported record
+// with the given digest, if ImportAttestations is set.
+func (m *manager) Attestations(recordDigest digest.Digest) []Attestation {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.attestations[recordDigest]
 }
 
 // Close will block until the final export has finished or ctx is canceled.
 func (m *manager) Close(ctx context.Context) (rerr error) {
+	m.saveExportMu.Lock()
+	if m.saveExportTimer != nil {
+		// the final export covers whatever the pending one would have
+		m.saveExportTimer.Stop()
+	}
+	m.saveExportMu.Unlock()
+
 	close(m.startCloseCh)
-	if m.stopCacheMountSync != nil {
-		rerr = m.stopCacheMountSync(ctx)
+	m.mountSyncMu.Lock()
+	stopCacheMountSync := m.stopCacheMountSync
+	m.mountSyncMu.Unlock()
+	if stopCacheMountSync != nil {
+		rerr = stopCacheMountSync(ctx)
 	}
 	select {
-	case <-m.doneCh:
+	case <-m.loopsDone():
 	case <-ctx.Done():
 	}
+	m.waitForReplications(ctx)
+	if err := m.disconnect(); err != nil && rerr == nil {
+		rerr = err
+	}
 	return rerr
 }
 
 func (m *manager) ID() string {
-	return "enginecache"
+	id := "enginecache"
+	if m.Namespace != "" {
+		id += "-" + m.Namespace
+	}
+	if m.multi != nil {
+		// the managers of a multiManager are queried side by side, so each needs its own ID
+		id += fmt.Sprintf("-%d", m.multi.index)
+	}
+	return id
 }
 
 func (m *manager) Query(inp []solver.CacheKeyWithSelector, inputIndex solver.Index, dgst digest.Digest, outputIndex solver.Index) ([]*solver.CacheKey, error) {
+	keys, err := m.query(inp, inputIndex, dgst, outputIndex)
+	if err != nil || len(keys) > 0 || !m.ScopedImport {
+		return keys, err
+	}
+
+	// on a miss, fetch the record from the service in case it has it
+	ctx, cancel := context.WithTimeout(context.Background(), scopedImportTimeout)
+	defer cancel()
+	imported, err := m.importScoped(ctx, recordDigest(dgst, outputIndex))
+	if err != nil {
+		bklog.G(ctx).WithError(err).Warnf("failed to import cache record for %s", dgst)
+		return keys, nil
+	}
+	if !imported {
+		return keys, nil
+	}
+	return m.query(inp, inputIndex, dgst, outputIndex)
+}
+
+func (m *manager) query(inp []solver.CacheKeyWithSelector, inputIndex solver.Index, dgst digest.Digest, outputIndex solver.Index) ([]*solver.CacheKey, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.inner.Query(inp, inputIndex, dgst, outputIndex)
+	return m.queried().Query(inp, inputIndex, dgst, outputIndex)
 }
 
 func (m *manager) Records(ctx context.Context, ck *solver.CacheKey) ([]*solver.CacheRecord, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.inner.Records(ctx, ck)
+	queried := m.queried()
+	recs, err := queried.Records(ctx, ck)
+	if err != nil {
+		return nil, err
+	}
+	localRecs := recs
+	if queried != m.localCache {
+		// the combined cache returns the local cache's record of results it shares with the
+		// imported one, so any record with the ID of a local one is that one
+		localRecs, err = m.localCache.Records(ctx, ck)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rec := range localRecs {
+		m.localRecordIDs.Store(rec.ID, struct{}{})
+	}
+	return recs, nil
+}
+
+const (
+	RecordSourceLocal  = "local"
+	RecordSourceRemote = "remote"
+)
+
+// RecordSource returns whether a record returned by Records comes from the local cache or the
+// one imported from the service, as RecordSourceLocal or RecordSourceRemote, for debugging.
+func (m *manager) RecordSource(rec *solver.CacheRecord) string {
+	if _, ok := m.localRecordIDs.Load(rec.ID); ok {
+		return RecordSourceLocal
+	}
+	return RecordSourceRemote
+}
+
+// queried returns the cache manager to query for cache hits, which is just the local cache if the
+// imported snapshot is older than MaxSnapshotAge. Must be called with mu held.
+func (m *manager) queried() solver.CacheManager {
+	if m.MaxSnapshotAge > 0 && !m.importedAt.IsZero() && m.now().Sub(m.importedAt) > m.MaxSnapshotAge {
+		return m.combine()
+	}
+	return m.inner
+}
+
+// combine returns the cache to query for hits, of the local cache and the given imported ones.
+// Managers of a multiManager leave the local cache out, as the multiManager queries it once for
+// all of them.
+func (m *manager) combine(imported ...solver.CacheManager) solver.CacheManager {
+	if m.multi == nil {
+		if len(imported) == 0 {
+			return m.localCache
+		}
+		return solver.NewCombinedCacheManager(append([]solver.CacheManager{m.localCache}, imported...), m.localCache)
+	}
+	switch len(imported) {
+	case 0:
+		return solver.NewInMemoryCacheManager()
+	case 1:
+		return imported[0]
+	}
+	return solver.NewCombinedCacheManager(imported, imported[0])
 }
 
 func (m *manager) Load(ctx context.Context, rec *solver.CacheRecord) (solver.Result, error) {
@@ -464,7 +1963,32 @@ func (m *manager) Load(ctx context.Context, rec *solver.CacheRecord) (solver.Res
 func (m *manager) Save(key *solver.CacheKey, s solver.Result, createdAt time.Time) (*solver.ExportableCacheKey, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.inner.Save(key, s, createdAt)
+	exportableKey, err := m.inner.Save(key, s, createdAt)
+	if err == nil && m.ExportAfterSave > 0 {
+		m.scheduleExportAfterSave()
+	}
+	return exportableKey, err
+}
+
+// scheduleExportAfterSave schedules an export ExportAfterSave from now, unless one is already
+// pending, in which case that one will cover the newly saved results too.
+func (m *manager) scheduleExportAfterSave() {
+	m.saveExportMu.Lock()
+	defer m.saveExportMu.Unlock()
+	if m.saveExportTimer != nil {
+		return
+	}
+	m.saveExportTimer = time.AfterFunc(m.ExportAfterSave, func() {
+		m.saveExportMu.Lock()
+		m.saveExportTimer = nil
+		m.saveExportMu.Unlock()
+
+		ctx, cancel := m.exportContext(context.Background())
+		defer cancel()
+		if err := m.Export(ctx); err != nil && !errors.Is(err, errRemoteDisabled) {
+			bklog.G(ctx).WithError(err).Error("failed to export cache after save")
+		}
+	})
 }
 
 func (m *manager) ReleaseUnreferenced(ctx context.Context) error {
@@ -479,22 +2003,50 @@ func (m *manager) ReleaseUnreferenced(ctx context.Context) error {
 	return nil
 }
 
-func (m *manager) descriptorProviderPair(layerMetadata remotecache.CacheLayer) (*remotecache.DescriptorProviderPair, error) {
+// descriptorProviderPair returns the descriptor of an imported layer along with the given provider
+// of its content. Layers without a size have it looked up by the provider when read.
+func (m *manager) descriptorProviderPair(layerMetadata remotecache.CacheLayer, provider content.Provider) (*remotecache.DescriptorProviderPair, error) {
 	if layerMetadata.Annotations == nil {
 		return nil, fmt.Errorf("missing annotations for layer %s", layerMetadata.Blob)
 	}
 
+	// both the OCI and docker media types are supported, including the OCI zstd one
+	compressionType, err := compression.FromMediaType(layerMetadata.Annotations.MediaType)
+	if err != nil {
+		return nil, fmt.Errorf("layer %s has media type %q, whose compression is not supported by this engine: %w",
+			layerMetadata.Blob, layerMetadata.Annotations.MediaType, err)
+	}
+
+	// layers may be addressed with any algorithm the engine supports, not just sha256
+	if err := layerMetadata.Blob.Validate(); err != nil {
+		return nil, fmt.Errorf("layer %s has an invalid digest: %w", layerMetadata.Blob, err)
+	}
+
 	annotations := map[string]string{}
 	if layerMetadata.Annotations.DiffID == "" {
 		return nil, fmt.Errorf("missing diffID for layer %s", layerMetadata.Blob)
 	}
+	if err := layerMetadata.Annotations.DiffID.Validate(); err != nil {
+		return nil, fmt.Errorf("layer %s has an invalid diffID: %w", layerMetadata.Blob, err)
+	}
+	// the blob of an uncompressed layer is its diff, so a media type that doesn't match how the
+	// layer was stored would only fail once buildkit tries to decompress it
+	uncompressed := compressionType == compression.Uncompressed
+	if uncompressed != (layerMetadata.Blob == layerMetadata.Annotations.DiffID) {
+		stored := "compressed"
+		if !uncompressed {
+			stored = "uncompressed"
+		}
+		return nil, fmt.Errorf("layer %s has media type %q, but its diffID %s says it was stored %s",
+			layerMetadata.Blob, layerMetadata.Annotations.MediaType, layerMetadata.Annotations.DiffID, stored)
+	}
 	annotations["containerd.io/uncompressed"] = layerMetadata.Annotations.DiffID.String()
 	if !layerMetadata.Annotations.CreatedAt.IsZero() {
 		createdAt, err := layerMetadata.Annotations.CreatedAt.MarshalText()
 		if err != nil {
 			return nil, err
 		}
-		annotations["buildkit/createdat"] = string(createdAt)
+		annotations[createdAtAnnotation] = string(createdAt)
 	}
 	desc := ocispecs.Descriptor{
 		MediaType:   layerMetadata.Annotations.MediaType,
@@ -503,7 +2055,7 @@ func (m *manager) descriptorProviderPair(layerMetadata remotecache.CacheLayer) (
 		Annotations: annotations,
 	}
 	return &remotecache.DescriptorProviderPair{
-		Provider:   m.layerProvider,
+		Provider:   provider,
 		Descriptor: desc,
 	}, nil
 }
@@ -511,12 +2063,21 @@ func (m *manager) descriptorProviderPair(layerMetadata remotecache.CacheLayer) (
 type Manager interface {
 	solver.CacheManager
 	StartCacheMountSynchronization(context.Context) error
+	CacheMountSyncStatus() CacheMountSyncStatus
+	ExportCacheMounts(context.Context) error
+	Prune(context.Context, PruneOptions) error
+	ReloadConfig(context.Context) error
+	Flush(context.Context) error
+	DisableRemote()
+	EnableRemote(context.Context) error
+	CacheHealth(context.Context) CacheHealth
 	ReleaseUnreferenced(context.Context) error
 	Close(context.Context) error
 }
 
 type defaultCacheManager struct {
 	solver.CacheManager
+	keyStore solver.CacheKeyStorage // the local cache's, for pruning
 }
 
 var _ Manager = defaultCacheManager{}
@@ -525,6 +2086,10 @@ func (defaultCacheManager) StartCacheMountSynchronization(ctx context.Context) e
 	return nil
 }
 
+func (defaultCacheManager) ExportCacheMounts(ctx context.Context) error {
+	return nil
+}
+
 func (c defaultCacheManager) ReleaseUnreferenced(ctx context.Context) error {
 	// this method isn't in the solver.CacheManager interface (this is how buildkit calls it upstream too)
 	if c, ok := c.CacheManager.(interface {
@@ -535,6 +2100,14 @@ func (c defaultCacheManager) ReleaseUnreferenced(ctx context.Context) error {
 	return nil
 }
 
+func (defaultCacheManager) ReloadConfig(context.Context) error {
+	return nil
+}
+
+func (defaultCacheManager) Flush(context.Context) error {
+	return nil
+}
+
 func (defaultCacheManager) Close(context.Context) error {
 	return nil
 }
@@ -0,0 +1,3959 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/leases"
+	"github.com/moby/buildkit/cache"
+	cacheconfig "github.com/moby/buildkit/cache/config"
+	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/moby/buildkit/util/progress"
+	"github.com/moby/buildkit/worker"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeService is a Service whose behavior is defined by the func fields set by each test.
+// Any method without a func set returns a zero response.
+type fakeService struct {
+	getConfig              func(context.Context, GetConfigRequest) (*Config, error)
+	updateCacheRecords     func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error)
+	updateCacheLayers      func(context.Context, UpdateCacheLayersRequest) error
+	importCache            func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error)
+	getLayerDownloadURL    func(context.Context, GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error)
+	getLayerUploadURL      func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error)
+	getAttestations        func(context.Context, GetAttestationsRequest) (*GetAttestationsResponse, error)
+	getCacheMountConfig    func(context.Context, GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error)
+	getCacheMountUploadURL func(context.Context, GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error)
+	pruneCacheRecords      func(context.Context, PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error)
+	layersExist            func(context.Context, LayersExistRequest) (*LayersExistResponse, error)
+	ping                   func(context.Context) error
+	getLayerUploadURLs     func(context.Context, GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error)
+
+	cacheGeneration string // returned along with the configs of importCache
+}
+
+var _ Service = &fakeService{}
+
+func (s *fakeService) GetConfig(ctx context.Context, req GetConfigRequest) (*Config, error) {
+	if s.getConfig == nil {
+		return &Config{}, nil
+	}
+	return s.getConfig(ctx, req)
+}
+
+func (s *fakeService) UpdateCacheRecords(ctx context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+	if s.updateCacheRecords == nil {
+		return &UpdateCacheRecordsResponse{}, nil
+	}
+	return s.updateCacheRecords(ctx, req)
+}
+
+func (s *fakeService) UpdateCacheLayers(ctx context.Context, req UpdateCacheLayersRequest) error {
+	if s.updateCacheLayers == nil {
+		return nil
+	}
+	return s.updateCacheLayers(ctx, req)
+}
+
+func (s *fakeService) ImportCache(ctx context.Context, req ImportCacheRequest) (*ImportCacheResponse, error) {
+	resp := &ImportCacheResponse{CacheGeneration: s.cacheGeneration}
+	if s.importCache == nil {
+		return resp, nil
+	}
+	cacheConfig, err := s.importCache(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.CacheConfig = *cacheConfig
+	return resp, nil
+}
+
+func (s *fakeService) GetLayerDownloadURL(ctx context.Context, req GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error) {
+	if s.getLayerDownloadURL == nil {
+		return &GetLayerDownloadURLResponse{}, nil
+	}
+	return s.getLayerDownloadURL(ctx, req)
+}
+
+func (s *fakeService) GetLayerUploadURL(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+	if s.getLayerUploadURL == nil {
+		return &GetLayerUploadURLResponse{}, nil
+	}
+	return s.getLayerUploadURL(ctx, req)
+}
+
+func (s *fakeService) GetAttestations(ctx context.Context, req GetAttestationsRequest) (*GetAttestationsResponse, error) {
+	if s.getAttestations == nil {
+		return &GetAttestationsResponse{}, nil
+	}
+	return s.getAttestations(ctx, req)
+}
+
+func (s *fakeService) GetCacheMountConfig(ctx context.Context, req GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error) {
+	if s.getCacheMountConfig == nil {
+		return &GetCacheMountConfigResponse{}, nil
+	}
+	return s.getCacheMountConfig(ctx, req)
+}
+
+func (s *fakeService) GetCacheMountUploadURL(ctx context.Context, req GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error) {
+	if s.getCacheMountUploadURL == nil {
+		return &GetCacheMountUploadURLResponse{}, nil
+	}
+	return s.getCacheMountUploadURL(ctx, req)
+}
+
+func (s *fakeService) PruneCacheRecords(ctx context.Context, req PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error) {
+	if s.pruneCacheRecords == nil {
+		return &PruneCacheRecordsResponse{}, nil
+	}
+	return s.pruneCacheRecords(ctx, req)
+}
+
+func (s *fakeService) LayersExist(ctx context.Context, req LayersExistRequest) (*LayersExistResponse, error) {
+	if s.layersExist == nil {
+		return &LayersExistResponse{}, nil
+	}
+	return s.layersExist(ctx, req)
+}
+
+func (s *fakeService) GetLayerUploadURLs(ctx context.Context, req GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+	if s.getLayerUploadURLs == nil {
+		return &GetLayerUploadURLsResponse{}, nil
+	}
+	return s.getLayerUploadURLs(ctx, req)
+}
+
+func (s *fakeService) Ping(ctx context.Context) error {
+	if s.ping == nil {
+		return nil
+	}
+	return s.ping(ctx)
+}
+
+// fakeRef is an ImmutableRef that only supports the methods used when walking the cache.
+type fakeRef struct {
+	cache.ImmutableRef
+	id string
+}
+
+func (r *fakeRef) ID() string                    { return r.id }
+func (r *fakeRef) GetDescription() string        { return "fake ref " + r.id }
+func (r *fakeRef) Release(context.Context) error { return nil }
+
+// fakeResultStore is a CacheResultStorage that loads worker ref results by result ID.
+type fakeResultStore struct {
+	results sync.Map
+}
+
+var _ solver.CacheResultStorage = &fakeResultStore{}
+
+func (s *fakeResultStore) add(resultID string, ref cache.ImmutableRef) {
+	s.results.Store(resultID, worker.NewWorkerRefResult(ref, nil))
+}
+
+func (s *fakeResultStore) Save(res solver.Result, createdAt time.Time) (solver.CacheResult, error) {
+	s.results.Store(res.ID(), res)
+	return solver.CacheResult{ID: res.ID(), CreatedAt: createdAt}, nil
+}
+
+// testResult is a worker ref result backed by a fakeRef, for saving to the cache manager.
+type testResult struct {
+	solver.Result
+	id string
+}
+
+func newTestResult(refID string) *testResult {
+	return &testResult{
+		Result: worker.NewWorkerRefResult(&fakeRef{id: refID}, nil),
+		id:     refID,
+	}
+}
+
+func (r *testResult) ID() string { return r.id }
+
+func (s *fakeResultStore) Load(_ context.Context, res solver.CacheResult) (solver.Result, error) {
+	v, ok := s.results.Load(res.ID)
+	if !ok {
+		return nil, solver.ErrNotFound
+	}
+	return v.(solver.Result), nil
+}
+
+func (s *fakeResultStore) LoadRemotes(context.Context, solver.CacheResult, *compression.Config, session.Group) ([]*solver.Remote, error) {
+	return nil, nil
+}
+
+func (s *fakeResultStore) Exists(_ context.Context, id string) bool {
+	_, ok := s.results.Load(id)
+	return ok
+}
+
+// addTestResult adds a result backed by a fakeRef with the given ID to the key store.
+func addTestResult(t *testing.T, cfg ManagerConfig, keyID, refID string, createdAt time.Time) {
+	t.Helper()
+	cfg.ResultStore.(*fakeResultStore).add(refID, &fakeRef{id: refID})
+	require.NoError(t, cfg.KeyStore.AddResult(keyID, solver.CacheResult{ID: refID, CreatedAt: createdAt}))
+}
+
+// newTestManager returns a manager wired up to the given service with an in-memory local cache.
+func newTestManager(svc Service, cfg ManagerConfig) *manager {
+	localCache := solver.NewInMemoryCacheManager()
+	if cfg.KeyStore != nil {
+		localCache = solver.NewCacheManager(context.Background(), LocalCacheID, cfg.KeyStore, cfg.ResultStore)
+	}
+	m := &manager{
+		ManagerConfig:  cfg,
+		cacheClient:    svc,
+		localCache:     localCache,
+		inner:          localCache,
+		startCloseCh:   make(chan struct{}),
+		doneCh:         make(chan struct{}),
+		configReloaded: make(chan struct{}),
+		httpClient:     &http.Client{},
+		now:            time.Now,
+	}
+	m.layerProvider = &layerProvider{
+		httpClient: m.httpClient,
+		service:    m.service,
+		keys:       cfg.LayerKeys,
+		chunked:    cfg.ChunkedLayers,
+		downloads:  newDownloadLimit(cfg.MaxConcurrentDownloads),
+	}
+	return m
+}
+
+// newTestStore returns a mock object store that keeps uploaded blobs in memory, along with a
+// service that hands out URLs to it.
+func newTestStore(t *testing.T) (*httptest.Server, *fakeService, *sync.Map) {
+	t.Helper()
+
+	var blobs sync.Map
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if r.ContentLength != int64(len(data)) {
+				http.Error(w, "content length mismatch", http.StatusBadRequest)
+				return
+			}
+			blobs.Store(r.URL.Path, data)
+		case http.MethodGet:
+			data, ok := blobs.Load(r.URL.Path)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data.([]byte)))
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(store.Close)
+
+	svc := &fakeService{
+		getLayerUploadURL: func(_ context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: store.URL + "/" + req.Digest.Encoded()}, nil
+		},
+		getLayerDownloadURL: func(_ context.Context, req GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error) {
+			return &GetLayerDownloadURLResponse{URL: store.URL + "/" + req.Digest.Encoded()}, nil
+		},
+	}
+	return store, svc, &blobs
+}
+
+// newTestLayer returns a random layer of the given size in a content provider.
+func newTestLayer(t *testing.T, size int) ([]byte, ocispecs.Descriptor, content.InfoReaderProvider) {
+	t.Helper()
+
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	desc, provider := newTestLayerFrom(t, data)
+	return data, desc, provider
+}
+
+// newTestLayerFrom returns a layer of the given data in a content provider.
+func newTestLayerFrom(t *testing.T, data []byte) (ocispecs.Descriptor, content.InfoReaderProvider) {
+	t.Helper()
+
+	desc := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	provider := contentutil.NewBuffer()
+	require.NoError(t, content.WriteBlob(context.Background(), provider, "test", bytes.NewReader(data), desc))
+	return desc, provider
+}
+
+func TestImportDanglingLinks(t *testing.T) {
+	ctx := context.Background()
+
+	danglingConfig := func() *remotecache.CacheConfig {
+		return &remotecache.CacheConfig{
+			Records: []remotecache.CacheRecord{
+				{Digest: digest.FromString("base")},
+				{
+					Digest: digest.FromString("child"),
+					Inputs: [][]remotecache.CacheInput{{
+						{LinkIndex: 0},
+						{LinkIndex: 7},
+					}},
+				},
+			},
+		}
+	}
+
+	t.Run("repair", func(t *testing.T) {
+		cacheConfig := danglingConfig()
+		droppedLinks, droppedRecords, err := repairCacheConfigLinks(cacheConfig, false)
+		require.NoError(t, err)
+		require.Equal(t, 1, droppedLinks)
+		require.Zero(t, droppedRecords)
+		require.Equal(t, []remotecache.CacheInput{{LinkIndex: 0}}, cacheConfig.Records[1].Inputs[0])
+
+		// records left with an input without links are dropped, along with the links to them,
+		// and the links to the records after them are renumbered
+		cacheConfig = &remotecache.CacheConfig{
+			Records: []remotecache.CacheRecord{
+				{Digest: digest.FromString("orphan"), Inputs: [][]remotecache.CacheInput{{{LinkIndex: 7}}}},
+				{Digest: digest.FromString("orphan child"), Inputs: [][]remotecache.CacheInput{{{LinkIndex: 0}}}},
+				{Digest: digest.FromString("base")},
+				{
+					Digest: digest.FromString("child"),
+					Inputs: [][]remotecache.CacheInput{{{LinkIndex: 1}, {LinkIndex: 2}}},
+				},
+			},
+		}
+		droppedLinks, droppedRecords, err = repairCacheConfigLinks(cacheConfig, false)
+		require.NoError(t, err)
+		require.Equal(t, 3, droppedLinks)
+		require.Equal(t, 2, droppedRecords)
+		require.Equal(t, []remotecache.CacheRecord{
+			{Digest: digest.FromString("base")},
+			{
+				Digest: digest.FromString("child"),
+				Inputs: [][]remotecache.CacheInput{{{LinkIndex: 0}}},
+			},
+		}, cacheConfig.Records)
+
+		m := newTestManager(&fakeService{
+			importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+				return danglingConfig(), nil
+			},
+		}, ManagerConfig{})
+		require.NoError(t, m.Import(ctx))
+		require.NotSame(t, m.localCache, m.inner)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		_, _, err := repairCacheConfigLinks(danglingConfig(), true)
+		require.ErrorContains(t, err, "links to missing record 7")
+
+		m := newTestManager(&fakeService{
+			importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+				return danglingConfig(), nil
+			},
+		}, ManagerConfig{StrictImport: true})
+		require.ErrorContains(t, m.Import(ctx), "links to missing record 7")
+		require.Same(t, m.localCache, m.inner)
+	})
+}
+
+func TestNormalizeRecordLayers(t *testing.T) {
+	base := digest.FromString("base layer")
+	top := digest.FromString("top layer")
+	layers := func(engine string) []ocispecs.Descriptor {
+		return []ocispecs.Descriptor{
+			{
+				MediaType: ocispecs.MediaTypeImageLayerZstd,
+				Digest:    base,
+				Size:      10,
+				Annotations: map[string]string{
+					"containerd.io/uncompressed":               digest.FromString("base diff").String(),
+					createdAtAnnotation:                        engine + "-time",
+					distributionSourceAnnotation + "docker.io": "library/" + engine,
+				},
+			},
+			{
+				MediaType: ocispecs.MediaTypeImageLayerZstd,
+				Digest:    top,
+				Size:      20,
+				Annotations: map[string]string{
+					createdAtAnnotation: engine + "-time",
+				},
+			},
+		}
+	}
+
+	recordA := digest.FromString("record a")
+	recordB := digest.FromString("record b")
+	engine1 := normalizeRecordLayers([]RecordLayers{
+		{RecordDigest: recordA, Layers: layers("engine1")},
+		{RecordDigest: recordB, Layers: layers("engine1")},
+	})
+	engine2 := normalizeRecordLayers([]RecordLayers{
+		{RecordDigest: recordB, Layers: layers("engine2")},
+		{RecordDigest: recordA, Layers: layers("engine2")},
+	})
+	require.Equal(t, UpdateCacheLayersRequest{UpdatedRecords: engine1}.String(), UpdateCacheLayersRequest{UpdatedRecords: engine2}.String())
+
+	for _, record := range engine1 {
+		// application order of the layers is preserved
+		require.Equal(t, base, record.Layers[0].Digest)
+		require.Equal(t, top, record.Layers[1].Digest)
+		require.Equal(t, map[string]string{
+			"containerd.io/uncompressed": digest.FromString("base diff").String(),
+		}, record.Layers[0].Annotations)
+		require.Nil(t, record.Layers[1].Annotations)
+	}
+}
+
+func TestNormalizeCacheRecords(t *testing.T) {
+	ctx := context.Background()
+
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	type key struct {
+		id, refID string
+	}
+	keys := []key{{"a", "a-ref"}, {"b", "b-ref"}, {"c", "c-ref"}}
+	links := []struct {
+		id, linkedID string
+		vertex       string
+	}{{"a", "b", "b vertex"}, {"a", "c", "c vertex"}, {"b", "c", "c vertex"}}
+
+	// two engines with the same content added in opposite orders and in different time zones
+	newManager := func(reversed bool, loc *time.Location) (*manager, *[]byte) {
+		var payload []byte
+		cfg := ManagerConfig{
+			KeyStore:                 solver.NewInMemoryCacheStorage(),
+			ResultStore:              &fakeResultStore{},
+			NormalizeExportedRecords: true,
+		}
+		orderedKeys := slices.Clone(keys)
+		orderedLinks := slices.Clone(links)
+		if reversed {
+			slices.Reverse(orderedKeys)
+			slices.Reverse(orderedLinks)
+		}
+		for _, k := range orderedKeys {
+			addTestResult(t, cfg, k.id, k.refID, createdAt.In(loc))
+		}
+		for _, l := range orderedLinks {
+			require.NoError(t, cfg.KeyStore.AddLink(l.id, solver.CacheInfoLink{Digest: digest.FromString(l.vertex)}, l.linkedID))
+		}
+		m := newTestManager(&fakeService{
+			updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+				var err error
+				payload, err = json.Marshal(req)
+				return &UpdateCacheRecordsResponse{}, err
+			},
+		}, cfg)
+		return m, &payload
+	}
+
+	m1, payload1 := newManager(false, time.UTC)
+	require.NoError(t, m1.Export(ctx))
+	first := *payload1
+	require.NoError(t, m1.Export(ctx))
+	require.Equal(t, string(first), string(*payload1))
+
+	m2, payload2 := newManager(true, time.FixedZone("UTC+2", 2*60*60))
+	require.NoError(t, m2.Export(ctx))
+	require.Equal(t, string(first), string(*payload2))
+
+	var req UpdateCacheRecordsRequest
+	require.NoError(t, json.Unmarshal(first, &req))
+	require.Len(t, req.CacheKeys, 3)
+	require.Len(t, req.Links, 3)
+}
+
+func TestExportIncremental(t *testing.T) {
+	ctx := context.Background()
+
+	var lastReq UpdateCacheRecordsRequest
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			lastReq = req
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:          solver.NewInMemoryCacheStorage(),
+		ResultStore:       &fakeResultStore{},
+		ExportIncremental: true,
+	}
+	m := newTestManager(svc, cfg)
+
+	exportedKeys := func() []string {
+		var ids []string
+		for _, key := range lastReq.CacheKeys {
+			ids = append(ids, key.ID)
+		}
+		return ids
+	}
+
+	// nothing has been exported yet, so the first export is a full one
+	addTestResult(t, cfg, "old", "old-ref", time.Now())
+	require.NoError(t, m.Export(ctx))
+	require.False(t, lastReq.Incremental)
+	require.Equal(t, []string{"old"}, exportedKeys())
+
+	// after the watermark advances only new results are considered
+	addTestResult(t, cfg, "new", "new-ref", time.Now())
+	require.NoError(t, m.Export(ctx))
+	require.True(t, lastReq.Incremental)
+	require.Equal(t, []string{"new"}, exportedKeys())
+
+	require.NoError(t, m.Export(ctx))
+	require.True(t, lastReq.Incremental)
+	require.Empty(t, lastReq.CacheKeys)
+
+	// a periodic full export picks everything up again
+	m.incrementalExports = maxIncrementalExports
+	require.NoError(t, m.Export(ctx))
+	require.False(t, lastReq.Incremental)
+	require.ElementsMatch(t, []string{"old", "new"}, exportedKeys())
+}
+
+type fakeMetricsRecorder struct {
+	exports []ExportStats
+	imports []ImportStats
+}
+
+func (r *fakeMetricsRecorder) RecordExport(stats ExportStats) { r.exports = append(r.exports, stats) }
+func (r *fakeMetricsRecorder) RecordImport(stats ImportStats) { r.imports = append(r.imports, stats) }
+
+func TestMetricsRecorder(t *testing.T) {
+	ctx := context.Background()
+
+	failing := false
+	svc := &fakeService{
+		updateCacheRecords: func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			if failing {
+				return nil, errors.New("service unavailable")
+			}
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			if failing {
+				return nil, errors.New("service unavailable")
+			}
+			return &remotecache.CacheConfig{
+				Records: []remotecache.CacheRecord{
+					{Digest: digest.FromString("a")},
+					{Digest: digest.FromString("b")},
+				},
+			}, nil
+		},
+	}
+	recorder := &fakeMetricsRecorder{}
+	cfg := ManagerConfig{
+		KeyStore:        solver.NewInMemoryCacheStorage(),
+		ResultStore:     &fakeResultStore{},
+		MetricsRecorder: recorder,
+	}
+	m := newTestManager(svc, cfg)
+
+	addTestResult(t, cfg, "a", "a-ref", time.Now())
+	// a result whose ref has been pruned
+	require.NoError(t, cfg.KeyStore.AddResult("pruned", solver.CacheResult{ID: "pruned-ref", CreatedAt: time.Now()}))
+
+	require.NoError(t, m.Export(ctx))
+	require.Len(t, recorder.exports, 1)
+	stats := recorder.exports[0]
+	require.NoError(t, stats.Err)
+	require.Positive(t, stats.Duration)
+	require.Equal(t, 2, stats.CacheKeys)
+	require.Equal(t, 1, stats.SkippedRefs)
+	require.Equal(t, map[SkipReason]int{SkipNotFound: 1}, stats.SkipReasons)
+	require.Equal(t, []SkippedRef{{ID: "pruned-ref", Reason: SkipNotFound}}, stats.SkippedSample)
+	require.Zero(t, stats.ExportedRecords)
+
+	require.NoError(t, m.Import(ctx))
+	require.Len(t, recorder.imports, 1)
+	require.NoError(t, recorder.imports[0].Err)
+	require.Equal(t, 2, recorder.imports[0].Records)
+
+	// failures are recorded too
+	failing = true
+	require.Error(t, m.Export(ctx))
+	require.Len(t, recorder.exports, 2)
+	require.ErrorContains(t, recorder.exports[1].Err, "service unavailable")
+	require.Error(t, m.Import(ctx))
+	require.Len(t, recorder.imports, 2)
+	require.ErrorContains(t, recorder.imports[1].Err, "service unavailable")
+
+	// and nothing breaks without a recorder
+	m.MetricsRecorder = nil
+	failing = false
+	require.NoError(t, m.Export(ctx))
+	require.NoError(t, m.Import(ctx))
+	require.Len(t, recorder.exports, 2)
+}
+
+func TestCacheHealth(t *testing.T) {
+	ctx := context.Background()
+
+	var pingErr, importErr error
+	svc := &fakeService{
+		ping: func(context.Context) error { return pingErr },
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			if importErr != nil {
+				return nil, importErr
+			}
+			return &remotecache.CacheConfig{}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{})
+	m.now = func() time.Time { return time.Unix(1000, 0) }
+
+	health := m.CacheHealth(ctx)
+	require.True(t, health.Reachable)
+	require.NoError(t, health.LastError)
+	require.True(t, health.LastImport.IsZero())
+
+	require.NoError(t, m.Import(ctx))
+	health = m.CacheHealth(ctx)
+	require.True(t, health.Reachable)
+	require.Equal(t, time.Unix(1000, 0), health.LastImport)
+
+	// a failed import is reported even while the service is reachable
+	importErr = errors.New("import failed")
+	require.Error(t, m.Import(ctx))
+	health = m.CacheHealth(ctx)
+	require.True(t, health.Reachable)
+	require.ErrorIs(t, health.LastError, importErr)
+	require.Equal(t, time.Unix(1000, 0), health.LastImport)
+
+	pingErr = errors.New("service unavailable")
+	health = m.CacheHealth(ctx)
+	require.False(t, health.Reachable)
+	require.ErrorIs(t, health.LastError, pingErr)
+
+	require.True(t, defaultCacheManager{}.CacheHealth(ctx).Reachable)
+}
+
+func TestLastImportExport(t *testing.T) {
+	ctx := context.Background()
+
+	var failure error
+	svc := &fakeService{
+		updateCacheRecords: func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			if failure != nil {
+				return nil, failure
+			}
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			if failure != nil {
+				return nil, failure
+			}
+			return &remotecache.CacheConfig{}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	})
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+
+	require.True(t, m.LastImport().IsZero())
+	require.True(t, m.LastExport().IsZero())
+	errAt, err := m.LastError()
+	require.NoError(t, err)
+	require.True(t, errAt.IsZero())
+
+	require.NoError(t, m.Import(ctx))
+	require.NoError(t, m.Export(ctx))
+	require.Equal(t, now, m.LastImport())
+	require.Equal(t, now, m.LastExport())
+
+	// failures are tracked without moving the time of the last success
+	now = time.Unix(2000, 0)
+	failure = errors.New("service unavailable")
+	require.Error(t, m.Import(ctx))
+	require.Error(t, m.Export(ctx))
+	require.Equal(t, time.Unix(1000, 0), m.LastImport())
+	require.Equal(t, time.Unix(1000, 0), m.LastExport())
+	errAt, err = m.LastError()
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, now, errAt)
+
+	// and the last error is kept after a success
+	now = time.Unix(3000, 0)
+	failure = nil
+	require.NoError(t, m.Export(ctx))
+	require.Equal(t, now, m.LastExport())
+	errAt, err = m.LastError()
+	require.Error(t, err)
+	require.Equal(t, time.Unix(2000, 0), errAt)
+}
+
+func TestExportImportStats(t *testing.T) {
+	ctx := context.Background()
+
+	svc := &fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			return &remotecache.CacheConfig{
+				Layers: []remotecache.CacheLayer{
+					{
+						Blob:        digest.FromString("layer"),
+						ParentIndex: -1,
+						Annotations: &remotecache.LayerAnnotations{
+							MediaType: ocispecs.MediaTypeImageLayerGzip,
+							DiffID:    digest.FromString("layer diff"),
+							Size:      1,
+						},
+					},
+				},
+				Records: []remotecache.CacheRecord{
+					{Digest: digest.FromString("a")},
+					{Digest: digest.FromString("b")},
+				},
+			}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	}
+	m := newTestManager(svc, cfg)
+	addTestResult(t, cfg, "a", "a-ref", time.Now())
+	addTestResult(t, cfg, "b", "b-ref", time.Now())
+
+	exportStats, err := m.ExportWithStats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, exportStats.CacheKeys)
+	require.Zero(t, exportStats.ExportedRecords)
+	require.Positive(t, exportStats.Duration)
+
+	importStats, err := m.ImportWithStats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, importStats.Records)
+	require.Equal(t, 1, importStats.Layers)
+
+	// errors are returned along with the stats of as much as got done
+	svc.importCache = func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+		return nil, errors.New("service unavailable")
+	}
+	importStats, err = m.ImportWithStats(ctx)
+	require.ErrorContains(t, err, "service unavailable")
+	require.ErrorContains(t, importStats.Err, "service unavailable")
+}
+
+func TestChainSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	vertex := digest.FromString("vertex")
+	svc := &fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			return &remotecache.CacheConfig{
+				Layers: []remotecache.CacheLayer{{
+					Blob:        digest.FromString("layer"),
+					ParentIndex: -1,
+					Annotations: &remotecache.LayerAnnotations{
+						MediaType: ocispecs.MediaTypeImageLayerGzip,
+						DiffID:    digest.FromString("layer diff"),
+						Size:      1,
+					},
+				}},
+				Records: []remotecache.CacheRecord{{
+					Digest:  recordDigest(vertex, 0),
+					Results: []remotecache.CacheResult{{LayerIndex: 0}},
+				}},
+			}, nil
+		},
+	}
+	svc.cacheGeneration = "1"
+	m := newTestManager(svc, ManagerConfig{ChainCacheDir: dir})
+	// the snapshot is of the generation imported, rather than the one reported at startup
+	m.runtimeConfig.CacheGeneration = "0"
+	require.NoError(t, m.Import(ctx))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// a restarted engine uses the snapshot until it imports, if the service's cache is unchanged
+	svc.importCache = func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+		return nil, errors.New("service unavailable")
+	}
+	restarted := newTestManager(svc, ManagerConfig{ChainCacheDir: dir})
+	loaded, err := restarted.loadChainSnapshot(ctx, "1")
+	require.NoError(t, err)
+	require.True(t, loaded)
+	require.True(t, m.LastImport().Equal(restarted.LastImport()))
+	require.Error(t, restarted.Import(ctx))
+	keys, err := restarted.Query(nil, 0, vertex, 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	// stale snapshots, and those of services without generations, aren't used
+	for _, generation := range []string{"2", ""} {
+		stale := newTestManager(svc, ManagerConfig{ChainCacheDir: dir})
+		loaded, err := stale.loadChainSnapshot(ctx, generation)
+		require.NoError(t, err)
+		require.False(t, loaded)
+		require.Same(t, stale.localCache, stale.inner)
+	}
+
+	// nor are those of other namespaces
+	other := newTestManager(svc, ManagerConfig{ChainCacheDir: dir, Namespace: "other"})
+	loaded, err = other.loadChainSnapshot(ctx, "1")
+	require.NoError(t, err)
+	require.False(t, loaded)
+}
+
+func TestExportFilter(t *testing.T) {
+	ctx := context.Background()
+
+	var req UpdateCacheRecordsRequest
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, r UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			req = r
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		ExportFilter: func(cacheKey CacheKey) bool {
+			return !strings.HasPrefix(cacheKey.ID, "scratch")
+		},
+	}
+	// a child of both a key that's exported and one that's filtered out
+	addTestResult(t, cfg, "root", "root-ref", time.Now())
+	addTestResult(t, cfg, "scratch-root", "scratch-root-ref", time.Now())
+	addTestResult(t, cfg, "child", "child-ref", time.Now())
+	require.NoError(t, cfg.KeyStore.AddLink("root", solver.CacheInfoLink{Digest: digest.FromString("op")}, "child"))
+	require.NoError(t, cfg.KeyStore.AddLink("scratch-root", solver.CacheInfoLink{Digest: digest.FromString("op")}, "child"))
+
+	m := newTestManager(svc, cfg)
+	require.NoError(t, m.Export(ctx))
+	var ids []string
+	for _, cacheKey := range req.CacheKeys {
+		ids = append(ids, cacheKey.ID)
+	}
+	require.ElementsMatch(t, []string{"root", "child"}, ids)
+	require.Len(t, req.Links, 1)
+	require.Equal(t, "child", req.Links[0].ID)
+	require.Equal(t, "root", req.Links[0].LinkedID)
+}
+
+func TestExportCanceledDuringWalk(t *testing.T) {
+	var updated bool
+	svc := &fakeService{
+		updateCacheRecords: func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			updated = true
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		addTestResult(t, cfg, id, id+"-ref", time.Now())
+	}
+
+	// the export is canceled while its first result is being walked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var walked int
+	cfg.AttestationSource = func(context.Context, cache.ImmutableRef) ([]Attestation, error) {
+		walked++
+		cancel()
+		return nil, nil
+	}
+	m := newTestManager(svc, cfg)
+
+	require.ErrorIs(t, m.Export(ctx), context.Canceled)
+	require.Equal(t, 1, walked)
+	require.False(t, updated)
+}
+
+// remoteRef is a fakeRef with a remote, tracking whether it's been released.
+type remoteRef struct {
+	fakeRef
+	remote     *solver.Remote
+	remotesErr error // returned by GetRemotes if set
+	released   atomic.Bool
+}
+
+func (r *remoteRef) GetRemotes(context.Context, bool, cacheconfig.RefConfig, bool, session.Group) ([]*solver.Remote, error) {
+	if r.remotesErr != nil {
+		return nil, r.remotesErr
+	}
+	return []*solver.Remote{r.remote}, nil
+}
+
+func (r *remoteRef) Release(context.Context) error {
+	r.released.Store(true)
+	return nil
+}
+
+func TestExportHoldsWalkedRefs(t *testing.T) {
+	ctx := context.Background()
+	_, svc, blobs := newTestStore(t)
+	_, desc, provider := newTestLayer(t, 1024)
+
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	}
+	ref := &remoteRef{
+		fakeRef: fakeRef{id: "a-ref"},
+		remote:  &solver.Remote{Descriptors: []ocispecs.Descriptor{desc}, Provider: provider},
+	}
+	cfg.ResultStore.(*fakeResultStore).add("a-ref", ref)
+	require.NoError(t, cfg.KeyStore.AddResult("a", solver.CacheResult{ID: "a-ref", CreatedAt: time.Now()}))
+
+	recordDigest := digest.FromString("a")
+	svc.updateCacheRecords = func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+		return &UpdateCacheRecordsResponse{
+			ExportRecords: []ExportRecord{{Digest: recordDigest, CacheRefID: "a-ref"}},
+		}, nil
+	}
+	getLayerUploadURL := svc.getLayerUploadURL
+	svc.getLayerUploadURL = func(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+		require.False(t, ref.released.Load(), "ref released before its layers were pushed")
+		return getLayerUploadURL(ctx, req)
+	}
+	var updatedRecords []RecordLayers
+	svc.updateCacheLayers = func(_ context.Context, req UpdateCacheLayersRequest) error {
+		updatedRecords = req.UpdatedRecords
+		return nil
+	}
+
+	// the ref walked is exported without getting it from the worker again, which isn't set
+	m := newTestManager(svc, cfg)
+	require.NoError(t, m.Export(ctx))
+	require.Equal(t, []RecordLayers{{RecordDigest: recordDigest, Layers: []ocispecs.Descriptor{desc}}}, updatedRecords)
+	_, ok := blobs.Load("/" + desc.Digest.Encoded())
+	require.True(t, ok)
+	require.True(t, ref.released.Load())
+
+	// and it's released when the export fails too
+	ref.released.Store(false)
+	svc.updateCacheLayers = func(context.Context, UpdateCacheLayersRequest) error {
+		return errors.New("service unavailable")
+	}
+	require.Error(t, m.Export(ctx))
+	require.True(t, ref.released.Load())
+}
+
+// countingProvider counts the layers read from a provider.
+type countingProvider struct {
+	content.Provider
+	reads sync.Map // digest -> *atomic.Int32
+}
+
+func (p *countingProvider) ReaderAt(ctx context.Context, desc ocispecs.Descriptor) (content.ReaderAt, error) {
+	count, _ := p.reads.LoadOrStore(desc.Digest, &atomic.Int32{})
+	count.(*atomic.Int32).Add(1)
+	return p.Provider.ReaderAt(ctx, desc)
+}
+
+func TestExportProvider(t *testing.T) {
+	ctx := context.Background()
+	_, svc, blobs := newTestStore(t)
+	data, desc, provider := newTestLayer(t, 1024)
+
+	var wrapped *countingProvider
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		ExportProvider: func(provider content.Provider) content.Provider {
+			wrapped = &countingProvider{Provider: provider}
+			return wrapped
+		},
+	}
+	cfg.ResultStore.(*fakeResultStore).add("a-ref", &remoteRef{
+		fakeRef: fakeRef{id: "a-ref"},
+		remote:  &solver.Remote{Descriptors: []ocispecs.Descriptor{desc}, Provider: provider},
+	})
+	require.NoError(t, cfg.KeyStore.AddResult("a", solver.CacheResult{ID: "a-ref", CreatedAt: time.Now()}))
+	svc.updateCacheRecords = func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+		return &UpdateCacheRecordsResponse{
+			ExportRecords: []ExportRecord{{Digest: digest.FromString("a"), CacheRefID: "a-ref"}},
+		}, nil
+	}
+
+	// the layer is read through the wrapped provider
+	m := newTestManager(svc, cfg)
+	require.NoError(t, m.Export(ctx))
+	require.NotNil(t, wrapped)
+	count, ok := wrapped.reads.Load(desc.Digest)
+	require.True(t, ok)
+	require.EqualValues(t, 1, count.(*atomic.Int32).Load())
+	uploaded, ok := blobs.Load("/" + desc.Digest.Encoded())
+	require.True(t, ok)
+	require.Equal(t, data, uploaded)
+}
+
+func TestUploadTimes(t *testing.T) {
+	ctx := context.Background()
+
+	var durations []time.Duration
+	for i := 10; i > 0; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, 5*time.Millisecond, percentile(durations, 50))
+	require.Equal(t, 10*time.Millisecond, percentile(durations, 95))
+	require.Equal(t, time.Millisecond, percentile(durations, 0))
+	require.Zero(t, percentile(nil, 50))
+
+	_, svc, _ := newTestStore(t)
+	_, descA, providerA := newTestLayer(t, 1024)
+	_, descB, providerB := newTestLayer(t, 1024)
+	recorder := &fakeMetricsRecorder{}
+	cfg := ManagerConfig{
+		KeyStore:        solver.NewInMemoryCacheStorage(),
+		ResultStore:     &fakeResultStore{},
+		MetricsRecorder: recorder,
+	}
+	for _, ref := range []struct {
+		id       string
+		desc     ocispecs.Descriptor
+		provider content.InfoReaderProvider
+	}{{"a", descA, providerA}, {"b", descB, providerB}} {
+		cfg.ResultStore.(*fakeResultStore).add(ref.id+"-ref", &remoteRef{
+			fakeRef: fakeRef{id: ref.id + "-ref"},
+			remote:  &solver.Remote{Descriptors: []ocispecs.Descriptor{ref.desc}, Provider: ref.provider},
+		})
+		require.NoError(t, cfg.KeyStore.AddResult(ref.id, solver.CacheResult{ID: ref.id + "-ref", CreatedAt: time.Now()}))
+	}
+	svc.updateCacheRecords = func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+		return &UpdateCacheRecordsResponse{
+			ExportRecords: []ExportRecord{
+				{Digest: digest.FromString("a"), CacheRefID: "a-ref"},
+				{Digest: digest.FromString("b"), CacheRefID: "b-ref"},
+			},
+		}, nil
+	}
+	m := newTestManager(svc, cfg)
+
+	// uploads are timed
+	uploadTime, err := m.pushLayerTo(ctx, descA, providerA, nil)
+	require.NoError(t, err)
+	require.Positive(t, uploadTime)
+
+	// layers the service already has aren't, as they aren't uploaded
+	uploadTime, err = m.pushLayerTo(ctx, descA, providerA, &GetLayerUploadURLResponse{Skip: true})
+	require.NoError(t, err)
+	require.Zero(t, uploadTime)
+
+	require.NoError(t, m.Export(ctx))
+	require.Len(t, recorder.exports, 1)
+	stats := recorder.exports[0]
+	require.Positive(t, stats.UploadTimeP50)
+	require.GreaterOrEqual(t, stats.UploadTimeP95, stats.UploadTimeP50)
+}
+
+func TestContinueOnRecordError(t *testing.T) {
+	ctx := context.Background()
+	_, svc, _ := newTestStore(t)
+
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	}
+	var exportRecords []ExportRecord
+	addRef := func(id string, ref *remoteRef) {
+		cfg.ResultStore.(*fakeResultStore).add(id, ref)
+		require.NoError(t, cfg.KeyStore.AddResult(id, solver.CacheResult{ID: id, CreatedAt: time.Now()}))
+		exportRecords = append(exportRecords, ExportRecord{Digest: digest.FromString(id), CacheRefID: id})
+	}
+	_, goodLayer, goodProvider := newTestLayer(t, 1024)
+	addRef("good-ref", &remoteRef{
+		fakeRef: fakeRef{id: "good-ref"},
+		remote:  &solver.Remote{Descriptors: []ocispecs.Descriptor{goodLayer}, Provider: goodProvider},
+	})
+	// a ref whose remotes can't be got
+	addRef("corrupt-ref", &remoteRef{
+		fakeRef:    fakeRef{id: "corrupt-ref"},
+		remotesErr: errors.New("corrupt ref"),
+	})
+	// and one whose layer fails to push
+	_, badLayer, badProvider := newTestLayer(t, 1024)
+	addRef("bad-layer-ref", &remoteRef{
+		fakeRef: fakeRef{id: "bad-layer-ref"},
+		remote:  &solver.Remote{Descriptors: []ocispecs.Descriptor{badLayer}, Provider: badProvider},
+	})
+
+	svc.updateCacheRecords = func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+		return &UpdateCacheRecordsResponse{ExportRecords: exportRecords}, nil
+	}
+	getLayerUploadURL := svc.getLayerUploadURL
+	svc.getLayerUploadURL = func(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+		if req.Digest == badLayer.Digest {
+			return nil, errors.New("upload rejected")
+		}
+		return getLayerUploadURL(ctx, req)
+	}
+	var updatedRecords []RecordLayers
+	svc.updateCacheLayers = func(_ context.Context, req UpdateCacheLayersRequest) error {
+		updatedRecords = req.UpdatedRecords
+		return nil
+	}
+
+	// by default a failing record fails the export
+	m := newTestManager(svc, cfg)
+	require.ErrorContains(t, m.Export(ctx), "corrupt ref")
+	require.Nil(t, updatedRecords)
+
+	// otherwise the rest are still exported, with the failures returned
+	m = newTestManager(svc, cfg)
+	m.ContinueOnRecordError = true
+	stats, err := m.ExportWithStats(ctx)
+	require.ErrorContains(t, err, "failed to export 2 cache refs")
+	require.ErrorContains(t, err, "cache ref corrupt-ref: corrupt ref")
+	require.ErrorContains(t, err, "cache ref bad-layer-ref: upload rejected")
+	require.Equal(t, []RecordLayers{{RecordDigest: digest.FromString("good-ref"), Layers: []ocispecs.Descriptor{goodLayer}}}, updatedRecords)
+	require.Equal(t, 2, stats.SkipReasons[SkipFailed])
+}
+
+// variantRef is a fakeRef with a zstd remote and optionally an estargz one.
+type variantRef struct {
+	fakeRef
+	zstd, estargz *solver.Remote
+}
+
+func (r *variantRef) GetRemotes(_ context.Context, createIfNeeded bool, cfg cacheconfig.RefConfig, all bool, _ session.Group) ([]*solver.Remote, error) {
+	switch {
+	case all && r.estargz != nil:
+		return []*solver.Remote{r.zstd, r.estargz}, nil
+	case cfg.Compression.Type == compression.EStargz:
+		if r.estargz == nil && !createIfNeeded {
+			return nil, errors.New("not found")
+		}
+		return []*solver.Remote{r.estargz}, nil
+	default:
+		return []*solver.Remote{r.zstd}, nil
+	}
+}
+
+func TestRemoteSelection(t *testing.T) {
+	ctx := context.Background()
+	_, zstdLayer, _ := newTestLayer(t, 10)
+	_, estargzLayer, _ := newTestLayer(t, 10)
+	zstd := &solver.Remote{Descriptors: []ocispecs.Descriptor{zstdLayer}}
+	estargz := &solver.Remote{Descriptors: []ocispecs.Descriptor{estargzLayer}}
+	withEstargz := &variantRef{fakeRef: fakeRef{id: "a"}, zstd: zstd, estargz: estargz}
+	withoutEstargz := &variantRef{fakeRef: fakeRef{id: "b"}, zstd: zstd}
+
+	m := newTestManager(&fakeService{}, ManagerConfig{})
+	remotes, err := m.exportRemotes(ctx, withEstargz)
+	require.NoError(t, err)
+	require.Equal(t, []*solver.Remote{zstd}, remotes)
+
+	m.RemoteSelection = PreferCompression(compression.EStargz)
+	remotes, err = m.exportRemotes(ctx, withEstargz)
+	require.NoError(t, err)
+	require.Equal(t, []*solver.Remote{estargz}, remotes)
+	// without creating the preferred variant if it doesn't exist
+	remotes, err = m.exportRemotes(ctx, withoutEstargz)
+	require.NoError(t, err)
+	require.Equal(t, []*solver.Remote{zstd}, remotes)
+
+	m.RemoteSelection = RemoteSelectAll
+	remotes, err = m.exportRemotes(ctx, withEstargz)
+	require.NoError(t, err)
+	require.Equal(t, []*solver.Remote{zstd, estargz}, remotes)
+
+	// variants are normalized like the main layers
+	annotated := estargzLayer
+	annotated.Annotations = map[string]string{createdAtAnnotation: "now"}
+	normalized := normalizeRecordLayers([]RecordLayers{{
+		Layers:   zstd.Descriptors,
+		Variants: [][]ocispecs.Descriptor{{annotated}},
+	}})
+	require.Equal(t, [][]ocispecs.Descriptor{{estargzLayer}}, normalized[0].Variants)
+}
+
+// fakeProgressWriter records the latest progress status written for each ID.
+type fakeProgressWriter struct {
+	mu       sync.Mutex
+	statuses map[string][]progress.Status
+}
+
+func (w *fakeProgressWriter) Write(id string, v any) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.statuses == nil {
+		w.statuses = map[string][]progress.Status{}
+	}
+	w.statuses[id] = append(w.statuses[id], v.(progress.Status))
+	return nil
+}
+
+func (w *fakeProgressWriter) Close() error { return nil }
+
+func TestProgressWriter(t *testing.T) {
+	ctx := context.Background()
+	_, svc, _ := newTestStore(t)
+	data, desc, provider := newTestLayer(t, 256*1024)
+
+	pw := &fakeProgressWriter{}
+	m := newTestManager(svc, ManagerConfig{ProgressWriter: pw})
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+
+	statuses := pw.statuses[desc.Digest.String()]
+	require.Greater(t, len(statuses), 2)
+	require.Equal(t, "uploading", statuses[0].Action)
+	require.NotNil(t, statuses[0].Started)
+	current := 0
+	for _, status := range statuses {
+		require.Equal(t, len(data), status.Total)
+		require.GreaterOrEqual(t, status.Current, current)
+		current = status.Current
+	}
+	last := statuses[len(statuses)-1]
+	require.Equal(t, "done", last.Action)
+	require.Equal(t, len(data), last.Current)
+	require.NotNil(t, last.Completed)
+
+	// layers the service already has are completed as skipped
+	_, skippedDesc, skippedProvider := newTestLayer(t, 1024)
+	svc.getLayerUploadURL = func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+		return &GetLayerUploadURLResponse{Skip: true}, nil
+	}
+	require.NoError(t, m.pushLayer(ctx, skippedDesc, skippedProvider))
+	statuses = pw.statuses[skippedDesc.Digest.String()]
+	require.Len(t, statuses, 2)
+	require.Equal(t, "skipped", statuses[1].Action)
+	require.Zero(t, statuses[1].Current)
+}
+
+func TestExistingLayers(t *testing.T) {
+	ctx := context.Background()
+
+	_, layerA, _ := newTestLayer(t, 10)
+	_, layerB, _ := newTestLayer(t, 10)
+	_, layerC, _ := newTestLayer(t, 10)
+	exportRefs := []exportRef{
+		{remotes: []*solver.Remote{{Descriptors: []ocispecs.Descriptor{layerA, layerB}}}},
+		{remotes: []*solver.Remote{{Descriptors: []ocispecs.Descriptor{layerA}}, {Descriptors: []ocispecs.Descriptor{layerC}}}},
+	}
+
+	var requests []LayersExistRequest
+	svc := &fakeService{
+		layersExist: func(_ context.Context, req LayersExistRequest) (*LayersExistResponse, error) {
+			requests = append(requests, req)
+			return &LayersExistResponse{Existing: []digest.Digest{layerA.Digest, layerC.Digest}}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{})
+
+	// services that don't advertise it aren't asked
+	existing, err := m.existingLayers(ctx, exportRefs)
+	require.NoError(t, err)
+	require.Empty(t, existing)
+	require.Empty(t, requests)
+
+	// otherwise all the layers are checked in one call
+	m.runtimeConfig.LayersExist = true
+	existing, err = m.existingLayers(ctx, exportRefs)
+	require.NoError(t, err)
+	require.Equal(t, map[digest.Digest]struct{}{layerA.Digest: {}, layerC.Digest: {}}, existing)
+	require.Equal(t, []LayersExistRequest{{Digests: []digest.Digest{layerA.Digest, layerB.Digest, layerC.Digest}}}, requests)
+
+	svc.layersExist = func(context.Context, LayersExistRequest) (*LayersExistResponse, error) {
+		return nil, errors.New("service unavailable")
+	}
+	_, err = m.existingLayers(ctx, exportRefs)
+	require.ErrorContains(t, err, "failed to check for existing layers")
+}
+
+func TestBatchLayerUploadURLs(t *testing.T) {
+	ctx := context.Background()
+
+	store, svc, blobs := newTestStore(t)
+	dataA, layerA, providerA := newTestLayer(t, 10)
+	_, layerB, _ := newTestLayer(t, 10)
+	_, layerC, _ := newTestLayer(t, 10)
+	ref := exportRef{remotes: []*solver.Remote{
+		{Descriptors: []ocispecs.Descriptor{layerA, layerB}},
+		{Descriptors: []ocispecs.Descriptor{layerA, layerC}},
+	}}
+	pushedLayers := map[digest.Digest]struct{}{layerC.Digest: {}}
+
+	var requests []GetLayerUploadURLsRequest
+	svc.getLayerUploadURLs = func(_ context.Context, req GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+		requests = append(requests, req)
+		return &GetLayerUploadURLsResponse{URLs: map[digest.Digest]GetLayerUploadURLResponse{
+			layerA.Digest: {URL: store.URL + "/batched"},
+			layerB.Digest: {Skip: true},
+			// never requested, so not used
+			layerC.Digest: {URL: store.URL + "/unrequested"},
+		}}, nil
+	}
+	m := newTestManager(svc, ManagerConfig{})
+
+	// services that don't advertise it aren't asked
+	uploadURLs, err := m.layerUploadURLs(ctx, ref, pushedLayers)
+	require.NoError(t, err)
+	require.Empty(t, uploadURLs)
+	require.Empty(t, requests)
+
+	// otherwise the URLs of the layers not pushed yet are requested in one call
+	m.runtimeConfig.BatchLayerUploadURLs = true
+	uploadURLs, err = m.layerUploadURLs(ctx, ref, pushedLayers)
+	require.NoError(t, err)
+	require.Equal(t, []GetLayerUploadURLsRequest{{Layers: []GetLayerUploadURLRequest{
+		{Digest: layerA.Digest},
+		{Digest: layerB.Digest},
+	}}}, requests)
+	require.Equal(t, map[digest.Digest]*GetLayerUploadURLResponse{
+		layerA.Digest: {URL: store.URL + "/batched"},
+		layerB.Digest: {Skip: true},
+	}, uploadURLs)
+
+	// the layer is uploaded to its batched URL without requesting another
+	svc.getLayerUploadURL = func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+		return nil, errors.New("unexpected upload URL request")
+	}
+	_, _, err = m.pushExportLayer(ctx, layerA, providerA, uploadURLs[layerA.Digest])
+	require.NoError(t, err)
+	data, ok := blobs.Load("/batched")
+	require.True(t, ok)
+	require.Equal(t, dataA, data)
+
+	svc.getLayerUploadURLs = func(context.Context, GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+		return nil, errors.New("service unavailable")
+	}
+	_, err = m.layerUploadURLs(ctx, ref, pushedLayers)
+	require.ErrorContains(t, err, "failed to get layer upload URLs")
+}
+
+func TestExportTimeoutPerLayer(t *testing.T) {
+	ctx := context.Background()
+	_, desc, provider := newTestLayer(t, 1024)
+
+	// a store that never completes uploads
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client going away once the body is read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer store.Close()
+	svc := &fakeService{
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: store.URL}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{})
+	m.runtimeConfig.ExportTimeout = 50 * time.Millisecond
+
+	// by default the timeout applies to the export as a whole
+	exportCtx, cancel := m.exportContext(ctx)
+	_, hasDeadline := exportCtx.Deadline()
+	require.True(t, hasDeadline)
+	_, timedOut, err := m.pushExportLayer(exportCtx, desc, provider, nil)
+	cancel()
+	require.Error(t, err)
+	require.False(t, timedOut)
+
+	// in per-layer mode it applies to each layer, whose timeout doesn't fail the export
+	m.ExportTimeoutMode = ExportTimeoutPerLayer
+	exportCtx, cancel = m.exportContext(ctx)
+	defer cancel()
+	_, hasDeadline = exportCtx.Deadline()
+	require.False(t, hasDeadline)
+	_, timedOut, err = m.pushExportLayer(exportCtx, desc, provider, nil)
+	require.NoError(t, err)
+	require.True(t, timedOut)
+
+	// unless the export itself is canceled
+	canceledCtx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, timedOut, err = m.pushExportLayer(canceledCtx, desc, provider, nil)
+	require.Error(t, err)
+	require.False(t, timedOut)
+}
+
+func TestImportSingleflight(t *testing.T) {
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	m := newTestManager(&fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			calls.Add(1)
+			started <- struct{}{}
+			<-release
+			return nil, errors.New("service unavailable")
+		},
+	}, ManagerConfig{})
+
+	errs := make(chan error, 3)
+	go func() { errs <- m.Import(ctx) }()
+	<-started
+	// these join the import in progress rather than starting their own
+	go func() { errs <- m.Import(ctx) }()
+	go func() { errs <- m.Import(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	for range 3 {
+		require.ErrorContains(t, <-errs, "service unavailable")
+	}
+	require.EqualValues(t, 1, calls.Load())
+
+	// once it's done, the next import starts afresh
+	release = make(chan struct{})
+	close(release)
+	require.Error(t, m.Import(ctx))
+	require.EqualValues(t, 2, calls.Load())
+	<-started
+
+	// a waiter gives up when its own context is done
+	release = make(chan struct{})
+	go m.Import(ctx)
+	<-started
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, m.Import(canceledCtx), context.Canceled)
+	close(release)
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+
+	var calls atomic.Int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	}
+	m := newTestManager(&fakeService{
+		updateCacheRecords: func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			calls.Add(1)
+			started <- struct{}{}
+			<-release
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}, cfg)
+	addTestResult(t, cfg, "a", "a-ref", time.Now())
+
+	// a flush during a periodic export joins it rather than exporting again
+	errs := make(chan error, 2)
+	go func() {
+		exportCtx, cancel := m.exportContext(ctx)
+		defer cancel()
+		_, err := m.sharedExport(exportCtx)
+		errs <- err
+	}()
+	<-started
+	go func() { errs <- m.Flush(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for range 2 {
+		require.NoError(t, <-errs)
+	}
+	require.EqualValues(t, 1, calls.Load())
+	require.False(t, m.LastExport().IsZero())
+
+	// otherwise it exports right away
+	require.NoError(t, m.Flush(ctx))
+	require.EqualValues(t, 2, calls.Load())
+	<-started
+
+	// with the export timeout of the service's config
+	m.runtimeConfig.ExportTimeout = 50 * time.Millisecond
+	release = make(chan struct{})
+	defer close(release)
+	require.ErrorIs(t, m.Flush(ctx), context.DeadlineExceeded)
+}
+
+func TestDisableRemote(t *testing.T) {
+	ctx := context.Background()
+
+	var configs, imports, exports atomic.Int32
+	var blockImport atomic.Bool
+	importStarted := make(chan struct{}, 1)
+	svc := &fakeService{
+		getConfig: func(context.Context, GetConfigRequest) (*Config, error) {
+			configs.Add(1)
+			return &Config{ImportPeriod: time.Minute, ExportPeriod: time.Minute, ExportTimeout: time.Minute}, nil
+		},
+		importCache: func(ctx context.Context, _ ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			imports.Add(1)
+			if blockImport.Load() {
+				importStarted <- struct{}{}
+				<-ctx.Done()
+				return nil, context.Cause(ctx)
+			}
+			return &remotecache.CacheConfig{}, nil
+		},
+		updateCacheRecords: func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			exports.Add(1)
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	}
+	addTestResult(t, cfg, "a", "a-ref", time.Now())
+	m := newTestManager(svc, cfg)
+	require.NoError(t, m.Import(ctx))
+	require.NotSame(t, m.localCache, m.inner)
+
+	// while disabled, only the local cache is used and the service isn't called
+	m.DisableRemote()
+	require.Same(t, m.localCache, m.inner)
+	require.ErrorIs(t, m.Import(ctx), errRemoteDisabled)
+	require.ErrorIs(t, m.Export(ctx), errRemoteDisabled)
+	require.EqualValues(t, 1, imports.Load())
+	require.Zero(t, exports.Load())
+
+	// enabling it again fetches the config and imports right away
+	require.NoError(t, m.EnableRemote(ctx))
+	require.EqualValues(t, 1, configs.Load())
+	require.EqualValues(t, 2, imports.Load())
+	require.NotSame(t, m.localCache, m.inner)
+	require.NoError(t, m.Export(ctx))
+	require.EqualValues(t, 1, exports.Load())
+
+	// disabling it cancels imports in progress, which then don't replace the local cache
+	blockImport.Store(true)
+	errs := make(chan error, 1)
+	go func() { errs <- m.Import(ctx) }()
+	<-importStarted
+	m.DisableRemote()
+	require.ErrorIs(t, <-errs, errRemoteDisabled)
+	require.Same(t, m.localCache, m.inner)
+
+	// the periodic loops started when it was enabled stop
+	select {
+	case <-m.loopsDone():
+	case <-time.After(10 * time.Second):
+		t.Fatal("periodic loops didn't stop")
+	}
+
+	// enabling it creates the service client again, and disabling it closes that one
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/config" {
+			json.NewEncoder(w).Encode(Config{ImportPeriod: time.Minute, ExportPeriod: time.Minute, ExportTimeout: time.Minute})
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+	serviceURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	m.ServiceURL = srv.URL
+	m.serviceURL = serviceURL
+	recordingPath := filepath.Join(t.TempDir(), "recording")
+	m.ServiceRecordingPath = recordingPath
+	require.NoError(t, m.EnableRemote(ctx))
+	require.IsType(t, &recordingService{}, m.service())
+	require.NotNil(t, m.serviceRecording)
+	m.DisableRemote()
+	require.Nil(t, m.serviceRecording)
+	<-m.loopsDone()
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	oldTime := now.Add(-48 * time.Hour)
+
+	newConfig := func() ManagerConfig {
+		cfg := ManagerConfig{
+			KeyStore:    solver.NewInMemoryCacheStorage(),
+			ResultStore: &fakeResultStore{},
+			KeyPrefix:   "prefix-",
+		}
+		addTestResult(t, cfg, "old", "old-ref", oldTime)
+		addTestResult(t, cfg, "mixed", "mixed-old-ref", oldTime)
+		addTestResult(t, cfg, "mixed", "mixed-new-ref", now)
+		addTestResult(t, cfg, "new", "new-ref", now)
+		return cfg
+	}
+	keys := func(cfg ManagerConfig) []string {
+		var ids []string
+		require.NoError(t, cfg.KeyStore.Walk(func(id string) error {
+			return cfg.KeyStore.WalkResults(id, func(res solver.CacheResult) error {
+				ids = append(ids, id+"/"+res.ID)
+				return nil
+			})
+		}))
+		return ids
+	}
+
+	var lastReq PruneCacheRecordsRequest
+	var failing bool
+	svc := &fakeService{
+		pruneCacheRecords: func(_ context.Context, req PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error) {
+			if failing {
+				return nil, errors.New("service unavailable")
+			}
+			lastReq = req
+			return &PruneCacheRecordsResponse{PrunedResults: 2}, nil
+		},
+	}
+
+	cfg := newConfig()
+	m := newTestManager(svc, cfg)
+	require.NoError(t, m.Prune(ctx, PruneOptions{MaxAge: 24 * time.Hour, KeepBytes: 1 << 30}))
+	require.Equal(t, 24*time.Hour, lastReq.MaxAge)
+	require.Equal(t, int64(1<<30), lastReq.KeepBytes)
+	require.ElementsMatch(t, []CacheKey{
+		{ID: "prefix-old", Results: []Result{{ID: "old-ref", CreatedAt: oldTime}}},
+		{ID: "prefix-mixed", Results: []Result{{ID: "mixed-old-ref", CreatedAt: oldTime}}},
+	}, lastReq.CacheKeys)
+	require.ElementsMatch(t, []string{"mixed/mixed-new-ref", "new/new-ref"}, keys(cfg))
+
+	// nothing is pruned locally if the service fails to prune
+	cfg = newConfig()
+	m = newTestManager(svc, cfg)
+	failing = true
+	require.ErrorContains(t, m.Prune(ctx, PruneOptions{MaxAge: 24 * time.Hour}), "service unavailable")
+	require.Len(t, keys(cfg), 4)
+
+	// without a service only the local cache is pruned
+	cfg = newConfig()
+	local := defaultCacheManager{CacheManager: solver.NewInMemoryCacheManager(), keyStore: cfg.KeyStore}
+	require.NoError(t, local.Prune(ctx, PruneOptions{MaxAge: 24 * time.Hour}))
+	require.ElementsMatch(t, []string{"mixed/mixed-new-ref", "new/new-ref"}, keys(cfg))
+
+	require.Equal(t, "ref", refIDOfResult("worker::ref"))
+	require.Equal(t, "ref", refIDOfResult("ref"))
+}
+
+func TestExportDelta(t *testing.T) {
+	ctx := context.Background()
+
+	var lastReq UpdateCacheRecordsRequest
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			lastReq = req
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		ExportDelta: true,
+	}
+	m := newTestManager(svc, cfg)
+
+	exportedKeys := func() []string {
+		var ids []string
+		for _, key := range lastReq.CacheKeys {
+			ids = append(ids, key.ID)
+		}
+		return ids
+	}
+
+	addTestResult(t, cfg, "a", "a-ref", time.Now())
+	addTestResult(t, cfg, "b", "b-ref", time.Now())
+	require.NoError(t, cfg.KeyStore.AddLink("b", solver.CacheInfoLink{Digest: digest.FromString("op")}, "a"))
+	// the key store reports links by the record digest of the linked output
+	link := Link{ID: "a", LinkedID: "b", Digest: recordDigest(digest.FromString("op"), 0)}
+
+	// nothing has been exported yet, so the first export is a full one
+	require.NoError(t, m.Export(ctx))
+	require.False(t, lastReq.Delta)
+	require.ElementsMatch(t, []string{"a", "b"}, exportedKeys())
+	require.Equal(t, []Link{link}, lastReq.Links)
+
+	// with nothing changed there's nothing to send
+	require.NoError(t, m.Export(ctx))
+	require.True(t, lastReq.Delta)
+	require.Empty(t, lastReq.CacheKeys)
+	require.Empty(t, lastReq.Links)
+	require.Empty(t, lastReq.RemovedCacheKeys)
+	require.Empty(t, lastReq.RemovedLinks)
+
+	// only the changes are sent
+	addTestResult(t, cfg, "b", "b-ref-2", time.Now())
+	addTestResult(t, cfg, "c", "c-ref", time.Now())
+	require.NoError(t, cfg.KeyStore.Release("a-ref")) // takes the link along with the key
+	require.NoError(t, m.Export(ctx))
+	require.True(t, lastReq.Delta)
+	require.ElementsMatch(t, []string{"b", "c"}, exportedKeys())
+	require.Empty(t, lastReq.Links)
+	require.Equal(t, []string{"a"}, lastReq.RemovedCacheKeys)
+	require.Equal(t, []Link{link}, lastReq.RemovedLinks)
+
+	// a periodic full export sends everything again
+	m.deltaExports = maxIncrementalExports
+	require.NoError(t, m.Export(ctx))
+	require.False(t, lastReq.Delta)
+	require.ElementsMatch(t, []string{"b", "c"}, exportedKeys())
+	require.Empty(t, lastReq.RemovedCacheKeys)
+
+	require.NoError(t, m.Export(ctx))
+	require.True(t, lastReq.Delta)
+	require.Empty(t, lastReq.CacheKeys)
+
+	// expiry hints moving forward with each export don't make the keys count as changed
+	m.ExportTTL = time.Hour
+	m.deltaExports = maxIncrementalExports
+	require.NoError(t, m.Export(ctx))
+	require.False(t, lastReq.Delta)
+	require.NotNil(t, lastReq.CacheKeys[0].Results[0].ExpiresAt)
+	require.NoError(t, m.Export(ctx))
+	require.True(t, lastReq.Delta)
+	require.Empty(t, lastReq.CacheKeys)
+}
+
+func TestLayerVerification(t *testing.T) {
+	ctx := context.Background()
+	_, svc, blobs := newTestStore(t)
+	m := newTestManager(svc, ManagerConfig{})
+
+	data, desc, provider := newTestLayer(t, 3*1024*1024+123)
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+
+	readerAt, err := m.layerProvider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	imported, err := io.ReadAll(content.NewReader(readerAt))
+	require.NoError(t, err)
+	require.Equal(t, data, imported)
+	require.NoError(t, readerAt.Close())
+
+	// the service serves content that doesn't match the layer's digest
+	tampered := bytes.Clone(data)
+	tampered[len(tampered)-1]++
+	blobs.Store("/"+desc.Digest.Encoded(), tampered)
+
+	readerAt, err = m.layerProvider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	_, err = io.ReadAll(content.NewReader(readerAt))
+	require.ErrorContains(t, err, "doesn't match its digest")
+	require.NoError(t, readerAt.Close())
+
+	// or content that's cut short
+	blobs.Store("/"+desc.Digest.Encoded(), data[:len(data)-1])
+	readerAt, err = m.layerProvider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	_, err = io.ReadAll(content.NewReader(readerAt))
+	require.ErrorContains(t, err, "doesn't match its digest")
+	require.NoError(t, readerAt.Close())
+
+	// partial reads can't be verified
+	blobs.Store("/"+desc.Digest.Encoded(), tampered)
+	readerAt, err = m.layerProvider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer readerAt.Close()
+	buf := make([]byte, 100)
+	n, err := readerAt.ReadAt(buf, desc.Size-100)
+	require.Equal(t, 100, n)
+	if err != nil {
+		require.ErrorIs(t, err, io.EOF)
+	}
+	require.Equal(t, tampered[desc.Size-100:], buf)
+}
+
+func TestLayerSizeLookup(t *testing.T) {
+	ctx := context.Background()
+	data, desc, _ := newTestLayer(t, 1024)
+
+	var heads atomic.Int32
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+desc.Digest.Encoded() {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer store.Close()
+	svc := &fakeService{
+		getLayerDownloadURL: func(_ context.Context, req GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error) {
+			return &GetLayerDownloadURLResponse{URL: store.URL + "/" + req.Digest.Encoded()}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{})
+
+	// layers imported without a size have it looked up once per import
+	unsized := desc
+	unsized.Size = 0
+	provider := m.layerProvider.forImport()
+	for range 2 {
+		readerAt, err := provider.ReaderAt(ctx, unsized)
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), readerAt.Size())
+		imported, err := io.ReadAll(content.NewReader(readerAt))
+		require.NoError(t, err)
+		require.Equal(t, data, imported)
+		require.NoError(t, readerAt.Close())
+	}
+	require.EqualValues(t, 1, heads.Load())
+
+	readerAt, err := m.layerProvider.forImport().ReaderAt(ctx, unsized)
+	require.NoError(t, err)
+	require.NoError(t, readerAt.Close())
+	require.EqualValues(t, 2, heads.Load())
+
+	// layers with a size don't need it
+	readerAt, err = provider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	require.NoError(t, readerAt.Close())
+	require.EqualValues(t, 2, heads.Load())
+
+	_, missing, _ := newTestLayer(t, 10)
+	missing.Size = 0
+	_, err = provider.ReaderAt(ctx, missing)
+	require.ErrorContains(t, err, "failed to get size of layer")
+
+	// stores that only allow GET, like presigned URLs, have it looked up with a ranged GET instead
+	_, getOnlySvc, blobs := newTestStore(t)
+	blobs.Store("/"+desc.Digest.Encoded(), data)
+	readerAt, err = newTestManager(getOnlySvc, ManagerConfig{}).layerProvider.forImport().ReaderAt(ctx, unsized)
+	require.NoError(t, err)
+	defer readerAt.Close()
+	require.EqualValues(t, len(data), readerAt.Size())
+	imported, err := io.ReadAll(content.NewReader(readerAt))
+	require.NoError(t, err)
+	require.Equal(t, data, imported)
+}
+
+func TestWarmKeys(t *testing.T) {
+	ctx := context.Background()
+	_, svc, blobs := newTestStore(t)
+
+	var layers []remotecache.CacheLayer
+	var descs []ocispecs.Descriptor
+	for _, parent := range []int{-1, 0, -1} {
+		data, desc, _ := newTestLayer(t, 1024)
+		blobs.Store("/"+desc.Digest.Encoded(), data)
+		descs = append(descs, desc)
+		layers = append(layers, remotecache.CacheLayer{
+			Blob:        desc.Digest,
+			ParentIndex: parent,
+			Annotations: &remotecache.LayerAnnotations{
+				MediaType: desc.MediaType,
+				DiffID:    desc.Digest,
+				Size:      desc.Size,
+			},
+		})
+	}
+	warmed := digest.FromString("warmed")
+	var requested []digest.Digest
+	svc.importCache = func(_ context.Context, req ImportCacheRequest) (*remotecache.CacheConfig, error) {
+		requested = req.RecordDigests
+		return &remotecache.CacheConfig{
+			Layers: layers,
+			Records: []remotecache.CacheRecord{
+				{Digest: digest.FromString("linked"), Results: []remotecache.CacheResult{{LayerIndex: 2}}},
+				{
+					Digest:  warmed,
+					Results: []remotecache.CacheResult{{LayerIndex: 1}},
+					Inputs:  [][]remotecache.CacheInput{{{LinkIndex: 0}}},
+				},
+			},
+		}, nil
+	}
+	m := newTestManager(svc, ManagerConfig{WarmKeys: []digest.Digest{warmed}})
+
+	// the whole chain of the warmed record's result is copied and loaded, under a lease, but not
+	// the layers of records it links to
+	store := contentutil.NewBuffer()
+	lm := &fakeLeaseManager{}
+	var loaded [][]digest.Digest
+	load := func(ctx context.Context, remote *solver.Remote) (cache.ImmutableRef, error) {
+		leaseID, ok := leases.FromContext(ctx)
+		require.True(t, ok)
+		require.Equal(t, []string{leaseID}, lm.active())
+		var chain []digest.Digest
+		for _, desc := range remote.Descriptors {
+			chain = append(chain, desc.Digest)
+		}
+		loaded = append(loaded, chain)
+		return &fakeRef{id: "warmed-ref"}, nil
+	}
+	require.NoError(t, m.warmKeys(ctx, store, lm, load))
+	require.Equal(t, []digest.Digest{warmed}, requested)
+	for _, desc := range descs[:2] {
+		readerAt, err := store.ReaderAt(ctx, desc)
+		require.NoError(t, err)
+		require.NoError(t, readerAt.Close())
+	}
+	_, err := store.ReaderAt(ctx, descs[2])
+	require.Error(t, err)
+	require.Equal(t, [][]digest.Digest{{descs[0].Digest, descs[1].Digest}}, loaded)
+	require.Empty(t, lm.active())
+
+	// a layer that can't be downloaded fails the warming
+	blobs.Delete("/" + descs[0].Digest.Encoded())
+	require.Error(t, m.warmKeys(ctx, contentutil.NewBuffer(), lm, load))
+	require.Empty(t, lm.active())
+}
+
+// fakeLeaseManager tracks the leases created and not yet deleted.
+type fakeLeaseManager struct {
+	leases.Manager
+	mu     sync.Mutex
+	leases map[string]struct{}
+}
+
+func (lm *fakeLeaseManager) Create(_ context.Context, opts ...leases.Opt) (leases.Lease, error) {
+	var l leases.Lease
+	for _, opt := range opts {
+		if err := opt(&l); err != nil {
+			return leases.Lease{}, err
+		}
+	}
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.leases == nil {
+		lm.leases = map[string]struct{}{}
+	}
+	lm.leases[l.ID] = struct{}{}
+	return l, nil
+}
+
+func (lm *fakeLeaseManager) Delete(_ context.Context, l leases.Lease, _ ...leases.DeleteOpt) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	delete(lm.leases, l.ID)
+	return nil
+}
+
+func (lm *fakeLeaseManager) active() []string {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	var ids []string
+	for id := range lm.leases {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestMaxConcurrentDownloads(t *testing.T) {
+	ctx := context.Background()
+	_, svc, _ := newTestStore(t)
+	m := newTestManager(svc, ManagerConfig{MaxConcurrentDownloads: 1})
+
+	data, desc, provider := newTestLayer(t, 1024)
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+
+	readerAt, err := m.layerProvider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+
+	// another download waits for the first one's reader to be closed, unless canceled
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = m.layerProvider.ReaderAt(waitCtx, desc)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var waited content.ReaderAt
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		waited, err = m.layerProvider.ReaderAt(ctx, desc)
+		errs <- err
+	}()
+	select {
+	case <-errs:
+		t.Fatal("download didn't wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, readerAt.Close())
+	require.NoError(t, <-errs)
+	readerAt = waited
+	imported, err := io.ReadAll(content.NewReader(readerAt))
+	require.NoError(t, err)
+	require.Equal(t, data, imported)
+	require.NoError(t, readerAt.Close())
+}
+
+func TestLayerEncryptionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	_, svc, blobs := newTestStore(t)
+	keys := StaticLayerKey{ID: "test", Secret: bytes.Repeat([]byte{1}, 32)}
+
+	// span several chunks, with a partial last one
+	data, desc, provider := newTestLayer(t, 3*encryptedLayerChunkSize+123)
+
+	exporter := newTestManager(svc, ManagerConfig{LayerKeys: keys})
+	require.NoError(t, exporter.pushLayer(ctx, desc, provider))
+
+	stored, ok := blobs.Load("/" + desc.Digest.Encoded())
+	require.True(t, ok)
+	require.True(t, bytes.HasPrefix(stored.([]byte), []byte(encryptedLayerMagic)))
+	require.False(t, bytes.Contains(stored.([]byte), data[:1024]))
+
+	importer := newTestManager(svc, ManagerConfig{LayerKeys: keys})
+	readerAt, err := importer.layerProvider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer readerAt.Close()
+	require.Equal(t, desc.Size, readerAt.Size())
+
+	imported, err := io.ReadAll(content.NewReader(readerAt))
+	require.NoError(t, err)
+	require.Equal(t, data, imported)
+
+	// random access across a chunk boundary
+	buf := make([]byte, 100)
+	off := int64(2*encryptedLayerChunkSize - 50)
+	n, err := readerAt.ReadAt(buf, off)
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, data[off:off+100], buf)
+
+	// the wrong key can't decrypt the layer
+	wrongKey := newTestManager(svc, ManagerConfig{LayerKeys: StaticLayerKey{ID: "test", Secret: bytes.Repeat([]byte{2}, 32)}})
+	_, err = wrongKey.layerProvider.ReaderAt(ctx, desc)
+	require.ErrorContains(t, err, "failed to unwrap data key")
+}
+
+func TestExportCancelInFlight(t *testing.T) {
+	ctx := context.Background()
+
+	var calls int
+	firstStarted := make(chan struct{})
+	svc := &fakeService{
+		updateCacheRecords: func(ctx context.Context, _ UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			calls++
+			if calls == 1 {
+				// the first export is slow and only finishes once canceled
+				close(firstStarted)
+				<-ctx.Done()
+				return nil, context.Cause(ctx)
+			}
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{
+		KeyStore:          solver.NewInMemoryCacheStorage(),
+		ResultStore:       &fakeResultStore{},
+		ExportConcurrency: ExportCancelInFlight,
+	})
+
+	firstErr := make(chan error, 1)
+	go func() {
+		firstErr <- m.Export(ctx)
+	}()
+	<-firstStarted
+
+	require.NoError(t, m.Export(ctx))
+	err := <-firstErr
+	require.True(t, errors.Is(err, errExportSuperseded), "unexpected error: %v", err)
+	require.Equal(t, 2, calls)
+}
+
+func TestExportExpiryHints(t *testing.T) {
+	ctx := context.Background()
+
+	var lastReq UpdateCacheRecordsRequest
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			lastReq = req
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	newConfig := func() ManagerConfig {
+		cfg := ManagerConfig{
+			KeyStore:    solver.NewInMemoryCacheStorage(),
+			ResultStore: &fakeResultStore{},
+		}
+		addTestResult(t, cfg, "release", "release-ref", time.Now())
+		addTestResult(t, cfg, "scratch", "scratch-ref", time.Now())
+		return cfg
+	}
+	expiries := func() map[string]*time.Time {
+		expiries := map[string]*time.Time{}
+		for _, key := range lastReq.CacheKeys {
+			for _, res := range key.Results {
+				expiries[res.ID] = res.ExpiresAt
+			}
+		}
+		return expiries
+	}
+
+	t.Run("none", func(t *testing.T) {
+		require.NoError(t, newTestManager(svc, newConfig()).Export(ctx))
+		require.Equal(t, map[string]*time.Time{"release-ref": nil, "scratch-ref": nil}, expiries())
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.ExportTTL = time.Hour
+		before := time.Now()
+		require.NoError(t, newTestManager(svc, cfg).Export(ctx))
+		for id, expiresAt := range expiries() {
+			require.NotNil(t, expiresAt, id)
+			require.WithinDuration(t, before.Add(time.Hour), *expiresAt, time.Minute)
+		}
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		releaseExpiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		cfg := newConfig()
+		cfg.ExportTTL = time.Hour // overridden by the callback
+		cfg.ExportExpiry = func(res Result) time.Time {
+			if res.Description == "fake ref release-ref" {
+				return releaseExpiry
+			}
+			return time.Time{}
+		}
+		require.NoError(t, newTestManager(svc, cfg).Export(ctx))
+		require.Equal(t, map[string]*time.Time{"release-ref": &releaseExpiry, "scratch-ref": nil}, expiries())
+	})
+}
+
+func TestLayerHTTPClient(t *testing.T) {
+	ctx := context.Background()
+
+	// the default client doesn't bound the transfer of layers, unless HTTPTimeout is set
+	m := newTestManager(&fakeService{}, ManagerConfig{})
+	httpClient := m.layerHTTPClient(nil)
+	require.Zero(t, httpClient.Timeout)
+	transport, ok := httpClient.Transport.(*http.Transport)
+	require.True(t, ok)
+	require.Equal(t, layerResponseHeaderTimeout, transport.ResponseHeaderTimeout)
+	require.Equal(t, layerMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+
+	m.HTTPTimeout = time.Hour
+	require.Equal(t, time.Hour, m.layerHTTPClient(nil).Timeout)
+
+	// a client passed in is used as is, but not modified
+	custom := &http.Client{Transport: &http.Transport{}, Timeout: time.Minute}
+	m.HTTPClient = custom
+	httpClient = m.layerHTTPClient(nil)
+	require.NotSame(t, custom, httpClient)
+	require.Same(t, custom.Transport, httpClient.Transport)
+	require.Equal(t, time.Minute, httpClient.Timeout)
+
+	// uploads stop at the deadline of their context
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client going away once the body is read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer store.Close()
+	m = newTestManager(&fakeService{
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: store.URL}, nil
+		},
+	}, ManagerConfig{})
+	_, desc, provider := newTestLayer(t, 1024)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, m.pushLayer(timeoutCtx, desc, provider), context.DeadlineExceeded)
+}
+
+func TestAuthToken(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	authHeaders := map[string][]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authHeaders[r.Method+" "+r.URL.Path] = append(authHeaders[r.Method+" "+r.URL.Path], r.Header.Get("Authorization"))
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/config":
+			json.NewEncoder(w).Encode(Config{
+				ImportPeriod:  time.Hour,
+				ExportPeriod:  time.Hour,
+				ExportTimeout: time.Minute,
+			})
+		case "/layerUploadURL":
+			json.NewEncoder(w).Encode(GetLayerUploadURLResponse{URL: "http://" + r.Host + "/blob"})
+		case "/import", "/records":
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer srv.Close()
+
+	// each request gets a fresh token
+	var tokens int
+	mgr, err := NewManager(ctx, ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		ServiceURL:  srv.URL,
+		Token:       "test",
+		EngineID:    "test-engine",
+		HTTPTimeout: time.Hour,
+		AuthTokenProvider: func(context.Context) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			tokens++
+			return fmt.Sprintf("token-%d", tokens), nil
+		},
+	})
+	require.NoError(t, err)
+	m := mgr.(*manager)
+
+	_, desc, provider := newTestLayer(t, 1024)
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	require.NoError(t, m.Close(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"Bearer token-1"}, authHeaders["GET /config"])
+	require.Equal(t, []string{"Bearer token-2"}, authHeaders["GET /import"])
+	require.Equal(t, []string{"Bearer token-3"}, authHeaders["GET /layerUploadURL"])
+	require.Equal(t, []string{"Bearer token-4"}, authHeaders["PUT /blob"])
+	require.Equal(t, []string{"Bearer token-5"}, authHeaders["POST /records"])
+
+	// failing to get a token fails the request without sending it
+	transport := newAuthTransport(nil, func(context.Context) (string, error) {
+		return "", errors.New("token expired")
+	})
+	_, err = (&http.Client{Transport: transport}).Get(srv.URL + "/config")
+	require.ErrorContains(t, err, "failed to get auth token: token expired")
+	require.Len(t, authHeaders["GET /config"], 1)
+
+	// registries don't get the token
+	require.IsType(t, &authTransport{}, m.httpClient.Transport)
+	_, ok := withoutAuth(m.httpClient).Transport.(*authTransport)
+	require.False(t, ok)
+
+	// the layer client keeps its timeout with the token added
+	require.Equal(t, time.Hour, m.httpClient.Timeout)
+	require.Equal(t, time.Hour, withoutAuth(m.httpClient).Timeout)
+}
+
+func TestLoopBreaker(t *testing.T) {
+	ctx := context.Background()
+	failure := errors.New("service unavailable")
+
+	m := newTestManager(&fakeService{}, ManagerConfig{
+		CircuitBreakerThreshold: 3,
+		CircuitBreakerMaxPeriod: 10 * time.Minute,
+	})
+	breaker := m.newLoopBreaker("import", time.Minute)
+
+	// failures below the threshold keep the normal period
+	require.Equal(t, time.Minute, breaker.next(ctx, failure))
+	require.Equal(t, time.Minute, breaker.next(ctx, failure))
+
+	// after which the period doubles with each failure, up to the max
+	require.Equal(t, 2*time.Minute, breaker.next(ctx, failure))
+	require.Equal(t, 4*time.Minute, breaker.next(ctx, failure))
+	require.Equal(t, 8*time.Minute, breaker.next(ctx, failure))
+	require.Equal(t, 10*time.Minute, breaker.next(ctx, failure))
+	require.Equal(t, 10*time.Minute, breaker.next(ctx, failure))
+
+	// a success resets it
+	require.Equal(t, time.Minute, breaker.next(ctx, nil))
+	require.Equal(t, time.Minute, breaker.next(ctx, failure))
+
+	// without a threshold it never backs off
+	m = newTestManager(&fakeService{}, ManagerConfig{})
+	breaker = m.newLoopBreaker("export", time.Minute)
+	for range 20 {
+		require.Equal(t, time.Minute, breaker.next(ctx, failure))
+	}
+}
+
+func TestLoopJitter(t *testing.T) {
+	ctx := context.Background()
+
+	waits := func(engineID string) []time.Duration {
+		m := newTestManager(&fakeService{}, ManagerConfig{EngineID: engineID, LoopJitter: 0.1})
+		breaker := m.newLoopBreaker("import", time.Hour)
+		var waits []time.Duration
+		for range 20 {
+			waits = append(waits, breaker.next(ctx, nil))
+		}
+		return waits
+	}
+
+	// waits are spread around the period
+	engineWaits := waits("engine-a")
+	for _, wait := range engineWaits {
+		require.GreaterOrEqual(t, wait, 54*time.Minute)
+		require.LessOrEqual(t, wait, 66*time.Minute)
+	}
+	require.Greater(t, slices.Max(engineWaits), slices.Min(engineWaits))
+
+	// reproducibly for each engine, but differently across engines
+	require.Equal(t, engineWaits, waits("engine-a"))
+	require.NotEqual(t, engineWaits, waits("engine-b"))
+
+	// and not at all by default
+	m := newTestManager(&fakeService{}, ManagerConfig{EngineID: "engine-a"})
+	require.Equal(t, time.Hour, m.newLoopBreaker("import", time.Hour).wait())
+}
+
+func TestReloadConfig(t *testing.T) {
+	ctx := context.Background()
+
+	config := &Config{
+		ImportPeriod:  time.Minute,
+		ExportPeriod:  2 * time.Minute,
+		ExportTimeout: time.Minute,
+	}
+	svc := &fakeService{
+		getConfig: func(context.Context, GetConfigRequest) (*Config, error) {
+			c := *config
+			return &c, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{})
+	reloaded := m.configReloadedCh()
+
+	require.NoError(t, m.ReloadConfig(ctx))
+	require.Equal(t, *config, m.config())
+	select {
+	case <-reloaded:
+	default:
+		t.Fatal("loops weren't notified of the reload")
+	}
+
+	// an invalid config is rejected, keeping the current one
+	reloaded = m.configReloadedCh()
+	config = &Config{
+		ImportPeriod:  time.Millisecond,
+		ExportPeriod:  time.Minute,
+		ExportTimeout: time.Minute,
+	}
+	require.ErrorContains(t, m.ReloadConfig(ctx), "invalid cache config")
+	require.Equal(t, 2*time.Minute, m.config().ExportPeriod)
+	select {
+	case <-reloaded:
+		t.Fatal("loops were notified of a rejected config")
+	default:
+	}
+
+	// a backing off loop keeps backing off relative to the new period
+	breaker := m.newLoopBreaker("import", time.Minute)
+	breaker.threshold = 1
+	breaker.next(ctx, errors.New("service unavailable"))
+	breaker.period = 5 * time.Minute
+	require.Equal(t, 10*time.Minute, breaker.wait())
+}
+
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+
+	config := &Config{
+		ImportPeriod:  time.Minute,
+		ExportPeriod:  time.Minute,
+		ExportTimeout: time.Minute,
+		Namespaces:    true,
+	}
+	var namespaces []string
+	_, svc, _ := newTestStore(t)
+	svc.getConfig = func(_ context.Context, req GetConfigRequest) (*Config, error) {
+		namespaces = append(namespaces, req.Namespace)
+		c := *config
+		return &c, nil
+	}
+	svc.importCache = func(_ context.Context, req ImportCacheRequest) (*remotecache.CacheConfig, error) {
+		namespaces = append(namespaces, req.Namespace)
+		return &remotecache.CacheConfig{}, nil
+	}
+	svc.updateCacheRecords = func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+		namespaces = append(namespaces, req.Namespace)
+		return &UpdateCacheRecordsResponse{
+			ExportRecords: []ExportRecord{{Digest: digest.FromString("a"), CacheRefID: "a-ref"}},
+		}, nil
+	}
+	svc.updateCacheLayers = func(_ context.Context, req UpdateCacheLayersRequest) error {
+		namespaces = append(namespaces, req.Namespace)
+		return nil
+	}
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		Namespace:   "tenant-a",
+	}
+	_, desc, provider := newTestLayer(t, 1024)
+	cfg.ResultStore.(*fakeResultStore).add("a-ref", &remoteRef{
+		fakeRef: fakeRef{id: "a-ref"},
+		remote:  &solver.Remote{Descriptors: []ocispecs.Descriptor{desc}, Provider: provider},
+	})
+	require.NoError(t, cfg.KeyStore.AddResult("a", solver.CacheResult{ID: "a-ref", CreatedAt: time.Now()}))
+	m := newTestManager(svc, cfg)
+	require.Equal(t, "enginecache-tenant-a", m.ID())
+
+	// the namespace is sent with the calls touching records
+	require.NoError(t, m.ReloadConfig(ctx))
+	require.NoError(t, m.Import(ctx))
+	require.NoError(t, m.Export(ctx))
+	require.Equal(t, []string{"tenant-a", "tenant-a", "tenant-a", "tenant-a"}, namespaces)
+
+	// a service that doesn't support namespaces isn't used
+	config.Namespaces = false
+	require.ErrorContains(t, m.ReloadConfig(ctx), "doesn't support namespaces")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(config)
+	}))
+	defer srv.Close()
+	cfg.ServiceURL = srv.URL
+	cfg.Token = "test"
+	mgr, err := NewManager(ctx, cfg)
+	require.NoError(t, err)
+	require.IsType(t, defaultCacheManager{}, mgr)
+
+	// managers without a namespace keep the same ID
+	require.Equal(t, "enginecache", newTestManager(svc, ManagerConfig{}).ID())
+}
+
+func TestInitialImportFailure(t *testing.T) {
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config" {
+			// the service is reachable, but everything else is failing
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(Config{
+			ImportPeriod:  time.Hour,
+			ExportPeriod:  time.Hour,
+			ExportTimeout: time.Minute,
+		})
+	}))
+	defer srv.Close()
+
+	newConfig := func() ManagerConfig {
+		return ManagerConfig{
+			KeyStore:    solver.NewInMemoryCacheStorage(),
+			ResultStore: &fakeResultStore{},
+			ServiceURL:  srv.URL,
+			Token:       "test",
+			EngineID:    "test-engine",
+		}
+	}
+
+	t.Run("fallback", func(t *testing.T) {
+		mgr, err := NewManager(ctx, newConfig())
+		require.NoError(t, err)
+		m, ok := mgr.(*manager)
+		require.True(t, ok)
+		require.NotNil(t, m.inner)
+
+		// the local cache is still queried
+		recs, err := m.Query([]solver.CacheKeyWithSelector{}, 0, digest.FromString("test"), 0)
+		require.NoError(t, err)
+		require.Empty(t, recs)
+
+		closeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		m.Close(closeCtx) // the final export fails too, which is only logged
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.FailOnInitialImportError = true
+		_, err := NewManager(ctx, cfg)
+		require.ErrorContains(t, err, "failed to import cache at startup")
+	})
+}
+
+func TestMultipleServices(t *testing.T) {
+	ctx := context.Background()
+
+	// a service that counts the calls made to it
+	newService := func() (*httptest.Server, *sync.Map) {
+		var calls sync.Map
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count, _ := calls.LoadOrStore(r.Method+" "+r.URL.Path, &atomic.Int32{})
+			count.(*atomic.Int32).Add(1)
+			switch r.URL.Path {
+			case "/config":
+				json.NewEncoder(w).Encode(Config{
+					ImportPeriod:  time.Hour,
+					ExportPeriod:  time.Hour,
+					ExportTimeout: time.Minute,
+				})
+			case "/import", "/records":
+				w.Write([]byte("{}"))
+			}
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &calls
+	}
+	calledOnce := func(calls *sync.Map, call string) bool {
+		count, ok := calls.Load(call)
+		return ok && count.(*atomic.Int32).Load() == 1
+	}
+	regional, regionalCalls := newService()
+	global, globalCalls := newService()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		ServiceURLs: []string{regional.URL, down.URL, global.URL},
+		Token:       "test",
+		EngineID:    "test-engine",
+	}
+	mgr, err := NewManager(ctx, cfg)
+	require.NoError(t, err)
+	mm, ok := mgr.(*multiManager)
+	require.True(t, ok)
+
+	// the service that's down is skipped, the others are imported from in order
+	require.Len(t, mm.managers, 2)
+	require.Equal(t, regional.URL, mm.managers[0].ServiceURL)
+	require.Equal(t, global.URL, mm.managers[1].ServiceURL)
+	require.True(t, calledOnce(regionalCalls, "GET /import"))
+	require.True(t, calledOnce(globalCalls, "GET /import"))
+
+	// they share the local cache, which only the multiManager queries, and have their own IDs
+	require.Same(t, mm.managers[0].localCache, mm.managers[1].localCache)
+	for _, m := range mm.managers {
+		require.NotSame(t, m.localCache, m.inner)
+	}
+	require.NotEqual(t, mm.managers[0].ID(), mm.managers[1].ID())
+
+	recs, err := mm.Query([]solver.CacheKeyWithSelector{}, 0, digest.FromString("test"), 0)
+	require.NoError(t, err)
+	require.Empty(t, recs)
+
+	// and both are exported to on close
+	require.NoError(t, mm.Close(ctx))
+	require.True(t, calledOnce(regionalCalls, "POST /records"))
+	require.True(t, calledOnce(globalCalls, "POST /records"))
+
+	// with every service down, only the local cache is left
+	cfg.ServiceURLs = []string{down.URL}
+	mgr, err = NewManager(ctx, cfg)
+	require.NoError(t, err)
+	require.IsType(t, defaultCacheManager{}, mgr)
+}
+
+func TestExportRetentionPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	var lastReq UpdateCacheRecordsRequest
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			lastReq = req
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	newConfig := func() ManagerConfig {
+		cfg := ManagerConfig{
+			KeyStore:    solver.NewInMemoryCacheStorage(),
+			ResultStore: &fakeResultStore{},
+		}
+		addTestResult(t, cfg, "release", "release-ref", time.Now())
+		addTestResult(t, cfg, "pr", "pr-ref", time.Now())
+		addTestResult(t, cfg, "scratch", "scratch-ref", time.Now())
+		return cfg
+	}
+	policies := func() map[string]*RetentionPolicy {
+		policies := map[string]*RetentionPolicy{}
+		for _, key := range lastReq.CacheKeys {
+			for _, res := range key.Results {
+				policies[res.ID] = res.Retention
+			}
+		}
+		return policies
+	}
+
+	t.Run("none", func(t *testing.T) {
+		require.NoError(t, newTestManager(svc, newConfig()).Export(ctx))
+		require.Equal(t, map[string]*RetentionPolicy{"release-ref": nil, "pr-ref": nil, "scratch-ref": nil}, policies())
+	})
+
+	t.Run("default", func(t *testing.T) {
+		cfg := newConfig()
+		defaultPolicy := RetentionPolicy{TTL: 24 * time.Hour}
+		cfg.ExportRetentionPolicy = defaultPolicy
+		require.NoError(t, newTestManager(svc, cfg).Export(ctx))
+		require.Equal(t, map[string]*RetentionPolicy{
+			"release-ref": &defaultPolicy,
+			"pr-ref":      &defaultPolicy,
+			"scratch-ref": &defaultPolicy,
+		}, policies())
+	})
+
+	t.Run("callback", func(t *testing.T) {
+		releasePolicy := RetentionPolicy{TTL: 90 * 24 * time.Hour, Priority: 10}
+		prPolicy := RetentionPolicy{TTL: 24 * time.Hour}
+		cfg := newConfig()
+		cfg.ExportRetentionPolicy = RetentionPolicy{TTL: time.Hour} // overridden by the callback
+		cfg.ExportRetention = func(res Result) RetentionPolicy {
+			switch res.Description {
+			case "fake ref release-ref":
+				return releasePolicy
+			case "fake ref pr-ref":
+				return prPolicy
+			default:
+				return RetentionPolicy{}
+			}
+		}
+		require.NoError(t, newTestManager(svc, cfg).Export(ctx))
+		require.Equal(t, map[string]*RetentionPolicy{
+			"release-ref": &releasePolicy,
+			"pr-ref":      &prPolicy,
+			"scratch-ref": nil,
+		}, policies())
+	})
+}
+
+func TestImportDedupe(t *testing.T) {
+	ctx := context.Background()
+
+	rootVertex := digest.FromString("root vertex")
+	childVertex := digest.FromString("child vertex")
+	otherVertex := digest.FromString("other vertex")
+
+	// the local cache has a root key and a key linked from it, both with results
+	cfg := ManagerConfig{
+		KeyStore:              solver.NewInMemoryCacheStorage(),
+		ResultStore:           &fakeResultStore{},
+		DedupeImportedResults: true,
+	}
+	rootID := recordDigest(rootVertex, 0).String()
+	addTestResult(t, cfg, rootID, "root-ref", time.Now())
+	require.NoError(t, cfg.KeyStore.AddLink(rootID, solver.CacheInfoLink{Digest: childVertex}, "child"))
+	addTestResult(t, cfg, "child", "child-ref", time.Now())
+
+	// the imported config has the same two records, plus one the local cache doesn't have
+	newLayer := func(s string) remotecache.CacheLayer {
+		return remotecache.CacheLayer{
+			Blob:        digest.FromString(s),
+			ParentIndex: -1,
+			Annotations: &remotecache.LayerAnnotations{
+				MediaType: ocispecs.MediaTypeImageLayerGzip,
+				DiffID:    digest.FromString(s + " diff"),
+				Size:      1,
+			},
+		}
+	}
+	importedConfig := func() *remotecache.CacheConfig {
+		return &remotecache.CacheConfig{
+			Layers: []remotecache.CacheLayer{newLayer("root"), newLayer("child"), newLayer("other")},
+			Records: []remotecache.CacheRecord{
+				{
+					Digest:  recordDigest(rootVertex, 0),
+					Results: []remotecache.CacheResult{{LayerIndex: 0}},
+				},
+				{
+					Digest:  recordDigest(childVertex, 0),
+					Inputs:  [][]remotecache.CacheInput{{{LinkIndex: 0}}},
+					Results: []remotecache.CacheResult{{LayerIndex: 1}},
+				},
+				{
+					Digest:  recordDigest(otherVertex, 0),
+					Results: []remotecache.CacheResult{{LayerIndex: 2}},
+				},
+			},
+		}
+	}
+
+	cacheConfig := importedConfig()
+	deduped, err := dropLocallyCachedResults(cacheConfig, cfg.KeyStore)
+	require.NoError(t, err)
+	require.Equal(t, 2, deduped)
+	require.Empty(t, cacheConfig.Records[0].Results)
+	require.Empty(t, cacheConfig.Records[1].Results)
+	require.Len(t, cacheConfig.Records[2].Results, 1)
+
+	m := newTestManager(&fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			return importedConfig(), nil
+		},
+	}, cfg)
+	require.NoError(t, m.Import(ctx))
+
+	// only the local copy of the duplicated record is left
+	keys, err := m.Query(nil, 0, rootVertex, 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	records, err := m.Records(ctx, keys[0])
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "root-ref", records[0].ID)
+	require.Equal(t, RecordSourceLocal, m.RecordSource(records[0]))
+
+	// records only in the imported cache still resolve
+	keys, err = m.Query(nil, 0, otherVertex, 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	records, err = m.Records(ctx, keys[0])
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, RecordSourceRemote, m.RecordSource(records[0]))
+
+	// records are local before anything's imported too
+	m = newTestManager(&fakeService{}, cfg)
+	keys, err = m.Query(nil, 0, rootVertex, 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	records, err = m.Records(ctx, keys[0])
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, RecordSourceLocal, m.RecordSource(records[0]))
+}
+
+func TestKeyPrefix(t *testing.T) {
+	ctx := context.Background()
+
+	rootVertex := digest.FromString("root vertex")
+	rootID := recordDigest(rootVertex, 0).String()
+
+	// the service keeps exported keys as is and builds imported configs from the root keys
+	// matching the requested prefix
+	var exported UpdateCacheRecordsRequest
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			exported = req
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+		importCache: func(_ context.Context, req ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			linked := map[string]bool{}
+			for _, link := range exported.Links {
+				linked[link.ID] = true
+			}
+			cacheConfig := &remotecache.CacheConfig{}
+			for _, key := range exported.CacheKeys {
+				id, ok := strings.CutPrefix(key.ID, req.KeyPrefix)
+				if !ok || linked[key.ID] {
+					continue
+				}
+				cacheConfig.Records = append(cacheConfig.Records, remotecache.CacheRecord{
+					Digest: digest.Digest(id),
+				})
+			}
+			return cacheConfig, nil
+		},
+	}
+
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		KeyPrefix:   "team-a/",
+	}
+	addTestResult(t, cfg, rootID, "root-ref", time.Now())
+	require.NoError(t, cfg.KeyStore.AddLink(rootID, solver.CacheInfoLink{Digest: digest.FromString("child vertex")}, "child"))
+	addTestResult(t, cfg, "child", "child-ref", time.Now())
+
+	exporter := newTestManager(svc, cfg)
+	require.NoError(t, exporter.Export(ctx))
+	require.Len(t, exported.CacheKeys, 2)
+	for _, key := range exported.CacheKeys {
+		require.True(t, strings.HasPrefix(key.ID, "team-a/"), key.ID)
+	}
+	require.Len(t, exported.Links, 1)
+	require.Equal(t, "team-a/child", exported.Links[0].ID)
+	require.Equal(t, "team-a/"+rootID, exported.Links[0].LinkedID)
+
+	sameTeam := newTestManager(svc, ManagerConfig{KeyPrefix: "team-a/"})
+	require.NoError(t, sameTeam.Import(ctx))
+	keys, err := sameTeam.Query(nil, 0, rootVertex, 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	otherTeam := newTestManager(svc, ManagerConfig{KeyPrefix: "team-b/"})
+	require.NoError(t, otherTeam.Import(ctx))
+	keys, err = otherTeam.Query(nil, 0, rootVertex, 0)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func TestChunkedLayers(t *testing.T) {
+	ctx := context.Background()
+
+	// the service skips blobs the store already has
+	_, svc, blobs := newTestStore(t)
+	var uploads []digest.Digest
+	getLayerUploadURL := svc.getLayerUploadURL
+	svc.getLayerUploadURL = func(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+		if _, ok := blobs.Load("/" + req.Digest.Encoded()); ok {
+			return &GetLayerUploadURLResponse{Skip: true}, nil
+		}
+		uploads = append(uploads, req.Digest)
+		return getLayerUploadURL(ctx, req)
+	}
+	m := newTestManager(svc, ManagerConfig{ChunkedLayers: true})
+
+	data, desc, provider := newTestLayer(t, 32*1024*1024)
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	require.Greater(t, len(uploads), 1+32*1024*1024/maxChunkSize)
+	stored, ok := blobs.Load("/" + desc.Digest.Encoded())
+	require.True(t, ok)
+	require.True(t, bytes.HasPrefix(stored.([]byte), []byte(chunkManifestMagic)))
+
+	// after a small change only the chunk(s) around it are uploaded again, along with the manifest
+	modified := bytes.Clone(data)
+	copy(modified[len(modified)/2:], "a small change")
+	modifiedDesc, modifiedProvider := newTestLayerFrom(t, modified)
+	uploads = nil
+	require.NoError(t, m.pushLayer(ctx, modifiedDesc, modifiedProvider))
+	require.Contains(t, uploads, modifiedDesc.Digest)
+	require.LessOrEqual(t, len(uploads), 4)
+
+	// the layer is reassembled from its chunks on import
+	readerAt, err := m.layerProvider.ReaderAt(ctx, modifiedDesc)
+	require.NoError(t, err)
+	defer readerAt.Close()
+	require.Equal(t, modifiedDesc.Size, readerAt.Size())
+	imported, err := io.ReadAll(content.NewReader(readerAt))
+	require.NoError(t, err)
+	require.Equal(t, modified, imported)
+
+	// layers imported without a size get it from their chunk manifest
+	unsized := modifiedDesc
+	unsized.Size = 0
+	readerAt, err = m.layerProvider.forImport().ReaderAt(ctx, unsized)
+	require.NoError(t, err)
+	defer readerAt.Close()
+	require.Equal(t, modifiedDesc.Size, readerAt.Size())
+	imported, err = io.ReadAll(content.NewReader(readerAt))
+	require.NoError(t, err)
+	require.Equal(t, modified, imported)
+}
+
+func TestImportUnsupportedCompression(t *testing.T) {
+	ctx := context.Background()
+
+	layer := remotecache.CacheLayer{
+		Blob:        digest.FromString("layer"),
+		ParentIndex: -1,
+		Annotations: &remotecache.LayerAnnotations{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+lz4",
+			DiffID:    digest.FromString("layer diff"),
+			Size:      1,
+		},
+	}
+	m := newTestManager(&fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			return &remotecache.CacheConfig{
+				Layers: []remotecache.CacheLayer{layer},
+				Records: []remotecache.CacheRecord{{
+					Digest:  digest.FromString("record"),
+					Results: []remotecache.CacheResult{{LayerIndex: 0}},
+				}},
+			}, nil
+		},
+	}, ManagerConfig{})
+	err := m.Import(ctx)
+	require.ErrorContains(t, err, `has media type "application/vnd.oci.image.layer.v1.tar+lz4", whose compression is not supported`)
+	require.Same(t, m.localCache, m.inner)
+
+	// supported compressions are still accepted, with both OCI and docker media types
+	for _, mediaType := range []string{
+		ocispecs.MediaTypeImageLayerGzip,
+		ocispecs.MediaTypeImageLayerZstd,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip",
+		"application/vnd.docker.image.rootfs.diff.tar.zstd",
+	} {
+		layer.Annotations.MediaType = mediaType
+		_, err := m.descriptorProviderPair(layer, m.layerProvider)
+		require.NoError(t, err)
+	}
+
+	// the media type must match how the layer was stored, i.e. whether its blob is its diff
+	uncompressed := layer
+	uncompressed.Annotations = &remotecache.LayerAnnotations{
+		MediaType: ocispecs.MediaTypeImageLayer,
+		DiffID:    layer.Annotations.DiffID,
+		Size:      1,
+	}
+	_, err = m.descriptorProviderPair(uncompressed, m.layerProvider)
+	require.ErrorContains(t, err, "says it was stored compressed")
+	uncompressed.Blob = uncompressed.Annotations.DiffID
+	_, err = m.descriptorProviderPair(uncompressed, m.layerProvider)
+	require.NoError(t, err)
+	mislabeled := uncompressed
+	mislabeled.Annotations = &remotecache.LayerAnnotations{
+		MediaType: ocispecs.MediaTypeImageLayerZstd,
+		DiffID:    uncompressed.Blob,
+		Size:      1,
+	}
+	_, err = m.descriptorProviderPair(mislabeled, m.layerProvider)
+	require.ErrorContains(t, err, "says it was stored uncompressed")
+}
+
+func TestExportBatchMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	const maxBytes = 2048
+
+	var reqs []UpdateCacheRecordsRequest
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			reqs = append(reqs, req)
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:            solver.NewInMemoryCacheStorage(),
+		ResultStore:         &fakeResultStore{},
+		ExportBatchMaxBytes: maxBytes,
+		ExportDelta:         true,
+	}
+
+	// keys with results of varying size, each linked to the previous one
+	var keyIDs, refs []string
+	for i := range 20 {
+		keyID := fmt.Sprintf("key-%d-%s", i, strings.Repeat("k", 50))
+		ref := fmt.Sprintf("ref-%d-%s", i, strings.Repeat("x", i*30))
+		addTestResult(t, cfg, keyID, ref, time.Now())
+		refs = append(refs, ref)
+		if i > 0 {
+			require.NoError(t, cfg.KeyStore.AddLink(keyIDs[i-1], solver.CacheInfoLink{Digest: digest.FromString(keyID)}, keyID))
+		}
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	m := newTestManager(svc, cfg)
+	require.NoError(t, m.Export(ctx))
+	require.Greater(t, len(reqs), 1)
+
+	var exportedKeys []string
+	for i, req := range reqs {
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(b), maxBytes)
+		require.Equal(t, i < len(reqs)-1, req.MoreBatches)
+
+		batchKeys := map[string]bool{}
+		for _, key := range req.CacheKeys {
+			exportedKeys = append(exportedKeys, key.ID)
+			batchKeys[key.ID] = true
+		}
+		// links are sent along with the key they're links of
+		for _, link := range req.Links {
+			require.True(t, batchKeys[link.ID], link.ID)
+		}
+	}
+	require.ElementsMatch(t, keyIDs, exportedKeys)
+
+	// the keys and links removed since are within the budget too, split across batches as needed
+	for _, ref := range refs {
+		require.NoError(t, cfg.KeyStore.Release(ref))
+	}
+	reqs = nil
+	require.NoError(t, m.Export(ctx))
+	require.Greater(t, len(reqs), 1)
+	var removedKeys []string
+	var removedLinks int
+	for i, req := range reqs {
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(b), maxBytes)
+		require.Equal(t, i < len(reqs)-1, req.MoreBatches)
+		require.True(t, req.Delta)
+		removedKeys = append(removedKeys, req.RemovedCacheKeys...)
+		removedLinks += len(req.RemovedLinks)
+	}
+	require.ElementsMatch(t, keyIDs, removedKeys)
+	require.Equal(t, len(keyIDs)-1, removedLinks)
+}
+
+func TestMaxSnapshotAge(t *testing.T) {
+	ctx := context.Background()
+
+	rootVertex := digest.FromString("root vertex")
+	importErr := errors.New("service unavailable")
+	var imports int
+	m := newTestManager(&fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			imports++
+			if imports == 2 {
+				return nil, importErr
+			}
+			return &remotecache.CacheConfig{
+				Records: []remotecache.CacheRecord{{Digest: recordDigest(rootVertex, 0)}},
+			}, nil
+		},
+	}, ManagerConfig{MaxSnapshotAge: time.Hour})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	queryRemote := func() int {
+		keys, err := m.Query(nil, 0, rootVertex, 0)
+		require.NoError(t, err)
+		return len(keys)
+	}
+
+	require.NoError(t, m.Import(ctx))
+	require.Equal(t, 1, queryRemote())
+
+	// a failed import doesn't refresh the snapshot, which is still served until it's too old
+	now = now.Add(59 * time.Minute)
+	require.ErrorIs(t, m.Import(ctx), importErr)
+	require.Equal(t, 1, queryRemote())
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, 0, queryRemote())
+
+	// a successful import makes the imported cache queried again
+	require.NoError(t, m.Import(ctx))
+	require.Equal(t, 1, queryRemote())
+}
+
+func TestAttestationsRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	rootVertex := digest.FromString("root vertex")
+	rootID := recordDigest(rootVertex, 0).String()
+	provenance := Attestation{
+		PredicateType: "https://slsa.dev/provenance/v1",
+		Predicate:     json.RawMessage(`{"buildDefinition":{"buildType":"https://dagger.io/test"}}`),
+	}
+
+	// the service keeps the attestations of exported results and serves them by record digest
+	serviceAttestations := map[digest.Digest][]Attestation{}
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			for _, key := range req.CacheKeys {
+				for _, result := range key.Results {
+					serviceAttestations[digest.Digest(key.ID)] = append(serviceAttestations[digest.Digest(key.ID)], result.Attestations...)
+				}
+			}
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			return &remotecache.CacheConfig{
+				Layers: []remotecache.CacheLayer{{
+					Blob:        digest.FromString("layer"),
+					ParentIndex: -1,
+					Annotations: &remotecache.LayerAnnotations{
+						MediaType: ocispecs.MediaTypeImageLayerGzip,
+						DiffID:    digest.FromString("layer diff"),
+						Size:      1,
+					},
+				}},
+				Records: []remotecache.CacheRecord{{
+					Digest:  digest.Digest(rootID),
+					Results: []remotecache.CacheResult{{LayerIndex: 0}},
+				}},
+			}, nil
+		},
+		getAttestations: func(_ context.Context, req GetAttestationsRequest) (*GetAttestationsResponse, error) {
+			resp := &GetAttestationsResponse{Attestations: map[digest.Digest][]Attestation{}}
+			for _, dgst := range req.RecordDigests {
+				resp.Attestations[dgst] = serviceAttestations[dgst]
+			}
+			return resp, nil
+		},
+	}
+
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		AttestationSource: func(_ context.Context, ref cache.ImmutableRef) ([]Attestation, error) {
+			require.Equal(t, "root-ref", ref.ID())
+			return []Attestation{provenance}, nil
+		},
+	}
+	addTestResult(t, cfg, rootID, "root-ref", time.Now())
+	require.NoError(t, newTestManager(svc, cfg).Export(ctx))
+
+	importer := newTestManager(svc, ManagerConfig{ImportAttestations: true})
+	require.NoError(t, importer.Import(ctx))
+	require.Equal(t, []Attestation{provenance}, importer.Attestations(digest.Digest(rootID)))
+
+	// without the option attestations aren't fetched
+	importer = newTestManager(svc, ManagerConfig{})
+	require.NoError(t, importer.Import(ctx))
+	require.Empty(t, importer.Attestations(digest.Digest(rootID)))
+}
+
+func TestUploadRetry(t *testing.T) {
+	ctx := context.Background()
+
+	data, desc, provider := newTestLayer(t, 1024)
+	var puts int
+	var uploaded []byte
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts++
+		if puts < 3 {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		uploaded, _ = io.ReadAll(r.Body)
+	}))
+	defer store.Close()
+
+	m := newTestManager(&fakeService{
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: store.URL}, nil
+		},
+	}, ManagerConfig{
+		RetryMaxDuration: 10 * time.Second,
+		RetryJitter:      0.5,
+	})
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	require.Equal(t, 3, puts)
+	require.Equal(t, data, uploaded)
+}
+
+// streamingProvider is a layer provider that can only stream its layer, from the given reader.
+type streamingProvider struct {
+	content.Provider
+	stream io.ReadCloser
+}
+
+func (p *streamingProvider) StreamLayer(context.Context, ocispecs.Descriptor) (io.ReadCloser, error) {
+	return p.stream, nil
+}
+
+func TestUploadMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	data, desc, provider := newTestLayer(t, 64*1024)
+
+	var attempts int
+	var failures []int
+	var uploaded []byte
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		attempts++
+		if len(failures) > 0 {
+			w.WriteHeader(failures[0])
+			failures = failures[1:]
+			return
+		}
+		uploaded = body
+	}))
+	defer store.Close()
+	svc := &fakeService{
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: store.URL + "/" + desc.Digest.Encoded()}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{
+		UploadMaxAttempts: 3,
+		UploadRetryDelay:  time.Millisecond,
+	})
+
+	// transient failures are retried with the whole blob sent again
+	attempts, failures, uploaded = 0, []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, nil
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	require.Equal(t, 3, attempts)
+	require.Equal(t, data, uploaded)
+
+	// up to the max attempts
+	attempts, failures, uploaded = 0, []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, nil
+	require.ErrorContains(t, m.pushLayer(ctx, desc, provider), "unexpected status code: 503")
+	require.Equal(t, 3, attempts)
+
+	// client errors aren't retried
+	attempts, failures, uploaded = 0, []int{http.StatusForbidden}, nil
+	require.ErrorContains(t, m.pushLayer(ctx, desc, provider), "unexpected status code: 403")
+	require.Equal(t, 1, attempts)
+
+	// and retrying stops once ctx is done
+	canceledCtx, cancel := context.WithCancel(ctx)
+	m.UploadRetryDelay = time.Hour
+	attempts, failures, uploaded = 0, []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}, nil
+	time.AfterFunc(50*time.Millisecond, cancel)
+	require.ErrorContains(t, m.pushLayer(canceledCtx, desc, provider), "unexpected status code: 503")
+	require.Equal(t, 1, attempts)
+}
+
+func TestResumableUpload(t *testing.T) {
+	ctx := context.Background()
+	data, desc, provider := newTestLayer(t, 3500)
+
+	var mu sync.Mutex
+	var ranges []string
+	var uploaded []byte
+	const failRange = "bytes 1000-1999/3500"
+	var failed bool
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		contentRange := r.Header.Get("Content-Range")
+		ranges = append(ranges, contentRange)
+		if contentRange == failRange && !failed {
+			// the part fails once, then goes through on retry
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		uploaded = append(uploaded, body...)
+	}))
+	defer store.Close()
+
+	var resumable bool
+	var urlReqs []GetLayerUploadURLRequest
+	svc := &fakeService{
+		getLayerUploadURL: func(_ context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			urlReqs = append(urlReqs, req)
+			return &GetLayerUploadURLResponse{URL: store.URL, Resumable: req.Resumable && resumable}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{
+		ResumableUploadThreshold: 1000,
+		ResumableUploadPartSize:  1000,
+		UploadMaxAttempts:        3,
+		UploadRetryDelay:         time.Millisecond,
+	})
+
+	// the service doesn't support resumable uploads, so it isn't asked for one
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	require.False(t, urlReqs[0].Resumable)
+	require.Equal(t, []string{""}, ranges)
+	require.Equal(t, data, uploaded)
+
+	// it does, but doesn't hand out a resumable URL
+	m.runtimeConfig.ResumableUploads = true
+	ranges, uploaded = nil, nil
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	require.True(t, urlReqs[1].Resumable)
+	require.Equal(t, []string{""}, ranges)
+	require.Equal(t, data, uploaded)
+
+	// it does, with a failed part retried on its own
+	resumable = true
+	ranges, uploaded = nil, nil
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	require.Equal(t, []string{
+		"bytes 0-999/3500",
+		"bytes 1000-1999/3500",
+		"bytes 1000-1999/3500",
+		"bytes 2000-2999/3500",
+		"bytes 3000-3499/3500",
+	}, ranges)
+	require.Equal(t, data, uploaded)
+
+	// layers below the threshold are uploaded in one go
+	smallData, smallDesc, smallProvider := newTestLayer(t, 500)
+	ranges, uploaded = nil, nil
+	require.NoError(t, m.pushLayer(ctx, smallDesc, smallProvider))
+	require.False(t, urlReqs[3].Resumable)
+	require.Equal(t, []string{""}, ranges)
+	require.Equal(t, smallData, uploaded)
+}
+
+func TestStreamingUpload(t *testing.T) {
+	ctx := context.Background()
+
+	data := make([]byte, 1024*1024)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	desc := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+
+	uploadStarted := make(chan struct{})
+	var uploaded []byte
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := make([]byte, len(data)/2)
+		if _, err := io.ReadFull(r.Body, first); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		close(uploadStarted)
+		rest, _ := io.ReadAll(r.Body)
+		uploaded = append(first, rest...)
+	}))
+	defer store.Close()
+
+	// the second half of the layer is only produced once the upload of the first has begun
+	streamR, streamW := io.Pipe()
+	go func() {
+		streamW.Write(data[:len(data)/2])
+		select {
+		case <-uploadStarted:
+			streamW.Write(data[len(data)/2:])
+			streamW.Close()
+		case <-time.After(10 * time.Second):
+			streamW.CloseWithError(errors.New("upload didn't start before the layer was complete"))
+		}
+	}()
+
+	m := newTestManager(&fakeService{
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: store.URL}, nil
+		},
+	}, ManagerConfig{})
+	require.NoError(t, m.pushLayer(ctx, desc, &streamingProvider{stream: streamR}))
+	require.Equal(t, data, uploaded)
+}
+
+// subgraphConfig returns the records of cacheConfig with the given digests, along with the
+// records they transitively link to.
+func subgraphConfig(cacheConfig *remotecache.CacheConfig, digests []digest.Digest) *remotecache.CacheConfig {
+	included := map[int]bool{}
+	var include func(int)
+	include = func(i int) {
+		if included[i] {
+			return
+		}
+		included[i] = true
+		for _, inputs := range cacheConfig.Records[i].Inputs {
+			for _, input := range inputs {
+				include(input.LinkIndex)
+			}
+		}
+	}
+	for i, record := range cacheConfig.Records {
+		if slices.Contains(digests, record.Digest) {
+			include(i)
+		}
+	}
+
+	newIndex := map[int]int{}
+	subgraph := &remotecache.CacheConfig{Layers: cacheConfig.Layers}
+	for i, record := range cacheConfig.Records {
+		if included[i] {
+			newIndex[i] = len(subgraph.Records)
+			subgraph.Records = append(subgraph.Records, record)
+		}
+	}
+	for i, record := range subgraph.Records {
+		var inputs [][]remotecache.CacheInput
+		for _, recordInputs := range record.Inputs {
+			var newInputs []remotecache.CacheInput
+			for _, input := range recordInputs {
+				input.LinkIndex = newIndex[input.LinkIndex]
+				newInputs = append(newInputs, input)
+			}
+			inputs = append(inputs, newInputs)
+		}
+		subgraph.Records[i].Inputs = inputs
+	}
+	return subgraph
+}
+
+func TestScopedImport(t *testing.T) {
+	ctx := context.Background()
+
+	vertexA := digest.FromString("vertex a")
+	vertexB := digest.FromString("vertex b")
+	vertexC := digest.FromString("vertex c") // has vertex a as input
+	fullConfig := &remotecache.CacheConfig{
+		Records: []remotecache.CacheRecord{
+			{Digest: recordDigest(vertexA, 0)},
+			{Digest: recordDigest(vertexB, 0)},
+			{
+				Digest: recordDigest(vertexC, 0),
+				Inputs: [][]remotecache.CacheInput{{{LinkIndex: 0}}},
+			},
+		},
+	}
+
+	var requested [][]digest.Digest
+	var importedRecords []digest.Digest
+	m := newTestManager(&fakeService{
+		importCache: func(_ context.Context, req ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			requested = append(requested, req.RecordDigests)
+			cacheConfig := subgraphConfig(fullConfig, req.RecordDigests)
+			for _, record := range cacheConfig.Records {
+				importedRecords = append(importedRecords, record.Digest)
+			}
+			return cacheConfig, nil
+		},
+	}, ManagerConfig{ScopedImport: true})
+
+	// a query for a root vertex only imports its record
+	keysA, err := m.Query(nil, 0, vertexA, 0)
+	require.NoError(t, err)
+	require.Len(t, keysA, 1)
+	require.Equal(t, [][]digest.Digest{{recordDigest(vertexA, 0)}}, requested)
+	require.Equal(t, []digest.Digest{recordDigest(vertexA, 0)}, importedRecords)
+
+	// records are only fetched once
+	keysA, err = m.Query(nil, 0, vertexA, 0)
+	require.NoError(t, err)
+	require.Len(t, keysA, 1)
+	require.Len(t, requested, 1)
+
+	// a query for a vertex with inputs imports its record along with the ones it links to
+	keysC, err := m.Query([]solver.CacheKeyWithSelector{{
+		CacheKey: solver.ExportableCacheKey{CacheKey: keysA[0]},
+	}}, 0, vertexC, 0)
+	require.NoError(t, err)
+	require.Len(t, keysC, 1)
+	require.Len(t, requested, 2)
+	require.ElementsMatch(t, []digest.Digest{
+		recordDigest(vertexA, 0),
+		recordDigest(vertexA, 0),
+		recordDigest(vertexC, 0),
+	}, importedRecords)
+	require.NotContains(t, importedRecords, recordDigest(vertexB, 0))
+
+	// misses are only fetched once too
+	otherVertex := digest.FromString("other vertex")
+	for range 2 {
+		keys, err := m.Query(nil, 0, otherVertex, 0)
+		require.NoError(t, err)
+		require.Empty(t, keys)
+	}
+	require.Len(t, requested, 3)
+
+	// periodic imports drop the records fetched so far, which are fetched again when queried
+	require.NoError(t, m.Import(ctx))
+	require.Same(t, m.localCache, m.inner)
+	keysA, err = m.Query(nil, 0, vertexA, 0)
+	require.NoError(t, err)
+	require.Len(t, keysA, 1)
+	require.Len(t, requested, 4)
+}
+
+func TestScopedImportConcurrency(t *testing.T) {
+	vertexA := digest.FromString("vertex a")
+	vertexB := digest.FromString("vertex b")
+	fullConfig := &remotecache.CacheConfig{
+		Records: []remotecache.CacheRecord{
+			{Digest: recordDigest(vertexA, 0)},
+			{Digest: recordDigest(vertexB, 0)},
+		},
+	}
+
+	var mu sync.Mutex
+	requested := map[digest.Digest]int{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	m := newTestManager(&fakeService{
+		importCache: func(_ context.Context, req ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			mu.Lock()
+			requested[req.RecordDigests[0]]++
+			mu.Unlock()
+			if req.RecordDigests[0] == recordDigest(vertexA, 0) {
+				close(started)
+				<-release
+			}
+			return subgraphConfig(fullConfig, req.RecordDigests), nil
+		},
+	}, ManagerConfig{ScopedImport: true})
+
+	// queries for a record being imported wait for that import rather than starting their own
+	found := make(chan int, 3)
+	for range cap(found) {
+		go func() {
+			keys, err := m.Query(nil, 0, vertexA, 0)
+			if err != nil {
+				found <- -1
+				return
+			}
+			found <- len(keys)
+		}()
+	}
+	<-started
+
+	// while other records are imported without waiting for it
+	keysB, err := m.Query(nil, 0, vertexB, 0)
+	require.NoError(t, err)
+	require.Len(t, keysB, 1)
+
+	close(release)
+	for range cap(found) {
+		require.Equal(t, 1, <-found)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[digest.Digest]int{recordDigest(vertexA, 0): 1, recordDigest(vertexB, 0): 1}, requested)
+}
+
+func TestExportAfterSave(t *testing.T) {
+	exports := make(chan UpdateCacheRecordsRequest, 10)
+	svc := &fakeService{
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			exports <- req
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+	}
+	cfg := ManagerConfig{
+		KeyStore:        solver.NewInMemoryCacheStorage(),
+		ResultStore:     &fakeResultStore{},
+		ExportAfterSave: 50 * time.Millisecond,
+	}
+	m := newTestManager(svc, cfg)
+
+	// rapid saves are batched into a single export
+	for _, name := range []string{"a", "b", "c"} {
+		key := solver.NewCacheKey(digest.FromString(name), "", 0)
+		_, err := m.Save(key, newTestResult(name+"-ref"), time.Now())
+		require.NoError(t, err)
+	}
+
+	var req UpdateCacheRecordsRequest
+	select {
+	case req = <-exports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export after save")
+	}
+	var exportedResults []string
+	for _, key := range req.CacheKeys {
+		for _, res := range key.Results {
+			exportedResults = append(exportedResults, res.ID)
+		}
+	}
+	require.ElementsMatch(t, []string{"a-ref", "b-ref", "c-ref"}, exportedResults)
+
+	select {
+	case <-exports:
+		t.Fatal("unexpected second export")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// a later save triggers another export
+	_, err := m.Save(solver.NewCacheKey(digest.FromString("d"), "", 0), newTestResult("d-ref"), time.Now())
+	require.NoError(t, err)
+	select {
+	case <-exports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export after second save")
+	}
+}
+
+func TestExportCompression(t *testing.T) {
+	m := newTestManager(&fakeService{}, ManagerConfig{})
+	require.Equal(t, compression.New(compression.Zstd), m.exportCompression())
+
+	bestGzip := compression.New(compression.Gzip).SetLevel(9)
+	m = newTestManager(&fakeService{}, ManagerConfig{Compression: bestGzip})
+	require.Equal(t, bestGzip, m.exportCompression())
+
+	// a level alone keeps the default type
+	m = newTestManager(&fakeService{}, ManagerConfig{Compression: compression.Config{}.SetLevel(3)})
+	require.Equal(t, compression.New(compression.Zstd).SetLevel(3), m.exportCompression())
+
+	require.NoError(t, validateCompression(compression.Config{}))
+	require.NoError(t, validateCompression(compression.New(compression.Uncompressed)))
+
+	// levels are checked against the range of their type
+	require.NoError(t, validateCompression(compression.Config{}.SetLevel(maxZstdLevel)))
+	require.NoError(t, validateCompression(bestGzip))
+	require.ErrorContains(t, validateCompression(compression.Config{}.SetLevel(0)), "zstd level 0 is out of range")
+	require.ErrorContains(t, validateCompression(compression.New(compression.Zstd).SetLevel(23)), "zstd level 23 is out of range")
+	require.ErrorContains(t, validateCompression(compression.New(compression.Gzip).SetLevel(10)), "gzip level 10 is out of range")
+	require.ErrorContains(t, validateCompression(compression.New(compression.Uncompressed).SetLevel(1)), "uncompressed has no compression levels")
+	_, err := NewManager(context.Background(), ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		Compression: compression.New(unsupportedCompression{compression.Zstd}),
+	})
+	require.ErrorContains(t, err, "unsupported compression type lz4")
+}
+
+// unsupportedCompression is a compression type the engine doesn't know about.
+type unsupportedCompression struct {
+	compression.Type
+}
+
+func (unsupportedCompression) String() string { return "lz4" }
+
+func TestContentAwareCompression(t *testing.T) {
+	ctx := context.Background()
+
+	// random data stands in for already compressed media like images and archives
+	precompressedData := make([]byte, 2*compressibilitySampleSize)
+	_, err := rand.Read(precompressedData)
+	require.NoError(t, err)
+	textData := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 50000))
+
+	precompressedDesc, precompressedProvider := newTestLayerFrom(t, precompressedData)
+	textDesc, textProvider := newTestLayerFrom(t, textData)
+
+	compressible, err := isCompressible(ctx, precompressedProvider, precompressedDesc)
+	require.NoError(t, err)
+	require.False(t, compressible)
+	compressible, err = isCompressible(ctx, textProvider, textDesc)
+	require.NoError(t, err)
+	require.True(t, compressible)
+
+	uncompressedProvider := contentutil.NewMultiProvider(nil)
+	uncompressedProvider.Add(precompressedDesc.Digest, precompressedProvider.(content.InfoReaderProvider))
+	uncompressedProvider.Add(textDesc.Digest, textProvider.(content.InfoReaderProvider))
+	uncompressed := &solver.Remote{
+		Descriptors: []ocispecs.Descriptor{precompressedDesc, textDesc},
+		Provider:    uncompressedProvider,
+	}
+
+	compressedProvider := contentutil.NewMultiProvider(nil)
+	compressed := &solver.Remote{Provider: compressedProvider}
+	for _, data := range [][]byte{precompressedData, textData} {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, err := gw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+		desc, provider := newTestLayerFrom(t, buf.Bytes())
+		desc.MediaType = ocispecs.MediaTypeImageLayerGzip
+		compressed.Descriptors = append(compressed.Descriptors, desc)
+		compressedProvider.Add(desc.Digest, provider.(content.InfoReaderProvider))
+	}
+
+	// the precompressed layer is stored uncompressed while the text layer is compressed
+	mixed := mixRemotes(compressed, uncompressed, []bool{true, false})
+	require.Len(t, mixed.Descriptors, 2)
+	require.Equal(t, precompressedDesc, mixed.Descriptors[0])
+	require.Equal(t, ocispecs.MediaTypeImageLayer, mixed.Descriptors[0].MediaType)
+	require.Equal(t, compressed.Descriptors[1], mixed.Descriptors[1])
+	require.Equal(t, ocispecs.MediaTypeImageLayerGzip, mixed.Descriptors[1].MediaType)
+
+	for _, desc := range mixed.Descriptors {
+		readerAt, err := mixed.Provider.ReaderAt(ctx, desc)
+		require.NoError(t, err)
+		require.Equal(t, desc.Size, readerAt.Size())
+		require.NoError(t, readerAt.Close())
+	}
+}
+
+func TestGCEligibleLayers(t *testing.T) {
+	layer := func(name string) ocispecs.Descriptor {
+		return ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageLayerZstd,
+			Digest:    digest.FromString(name),
+			Size:      int64(len(name)),
+		}
+	}
+	exported := map[digest.Digest]*exportedLayer{}
+	for _, l := range []struct {
+		name   string
+		refIDs []string
+	}{
+		{"only-idle", []string{"idle"}},
+		{"shared", []string{"idle", "active"}},
+		{"only-active", []string{"active"}},
+	} {
+		exported[layer(l.name).Digest] = &exportedLayer{desc: layer(l.name), refIDs: l.refIDs}
+	}
+	inUse := map[string]struct{}{"active": {}}
+
+	// layers of refs in use stay, as do layers that weren't exported in the first place
+	eligible := gcEligibleLayers(exported, inUse)
+	require.Equal(t, []ocispecs.Descriptor{layer("only-idle")}, eligible)
+	require.NotContains(t, eligible, layer("unexported"))
+
+	// once nothing uses them, all exported layers may be collected
+	require.Len(t, gcEligibleLayers(exported, nil), 3)
+}
+
+func TestImportReferrers(t *testing.T) {
+	ctx := context.Background()
+
+	rootVertex := digest.FromString("root vertex")
+	subject := digest.FromString("app image manifest")
+
+	layer := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("layer"),
+		Size:      1,
+		Annotations: map[string]string{
+			"containerd.io/uncompressed": digest.FromString("layer diff").String(),
+		},
+	}
+	cacheConfigJSON, err := json.Marshal(remotecache.CacheConfig{
+		Layers: []remotecache.CacheLayer{{Blob: layer.Digest, ParentIndex: -1}},
+		Records: []remotecache.CacheRecord{{
+			Digest:  recordDigest(rootVertex, 0),
+			Results: []remotecache.CacheResult{{LayerIndex: 0}},
+		}},
+	})
+	require.NoError(t, err)
+	manifestJSON, err := json.Marshal(ocispecs.Manifest{
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config: ocispecs.Descriptor{
+			MediaType: remotecache.CacheConfigMediaTypeV0,
+			Digest:    digest.FromBytes(cacheConfigJSON),
+			Size:      int64(len(cacheConfigJSON)),
+		},
+		Layers:  []ocispecs.Descriptor{layer},
+		Subject: &ocispecs.Descriptor{MediaType: ocispecs.MediaTypeImageManifest, Digest: subject},
+	})
+	require.NoError(t, err)
+	referrersJSON, err := json.Marshal(ocispecs.Index{
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: []ocispecs.Descriptor{
+			{
+				MediaType:    ocispecs.MediaTypeImageManifest,
+				ArtifactType: remotecache.CacheConfigMediaTypeV0,
+				Digest:       digest.FromBytes(manifestJSON),
+				Size:         int64(len(manifestJSON)),
+			},
+			{
+				// other referrers like signatures are ignored
+				MediaType:    ocispecs.MediaTypeImageManifest,
+				ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+				Digest:       digest.FromString("signature"),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/cache/app/referrers/" + subject.String():
+			w.Write(referrersJSON)
+		case "/v2/cache/app/manifests/" + digest.FromBytes(manifestJSON).String():
+			w.Write(manifestJSON)
+		case "/v2/cache/app/blobs/" + digest.FromBytes(cacheConfigJSON).String():
+			w.Write(cacheConfigJSON)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	m := newTestManager(&fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			return &remotecache.CacheConfig{}, nil
+		},
+	}, ManagerConfig{
+		ReferrersSubject:   strings.TrimPrefix(registry.URL, "http://") + "/cache/app@" + subject.String(),
+		ReferrersPlainHTTP: true,
+	})
+	require.NoError(t, m.Import(ctx))
+
+	keys, err := m.Query(nil, 0, rootVertex, 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	records, err := m.Records(ctx, keys[0])
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func TestPushCacheMount(t *testing.T) {
+	ctx := context.Background()
+
+	var uploaded []byte
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploaded, _ = io.ReadAll(r.Body)
+	}))
+	defer store.Close()
+
+	var uploadReqs []GetCacheMountUploadURLRequest
+	skip := false
+	m := newTestManager(&fakeService{
+		getCacheMountUploadURL: func(_ context.Context, req GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error) {
+			uploadReqs = append(uploadReqs, req)
+			return &GetCacheMountUploadURLResponse{URL: store.URL, Skip: skip}, nil
+		},
+		updateCacheRecords: func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			return nil, errors.New("build result records must not be updated")
+		},
+		updateCacheLayers: func(context.Context, UpdateCacheLayersRequest) error {
+			return errors.New("build result layers must not be updated")
+		},
+	}, ManagerConfig{})
+
+	data, desc, provider := newTestLayer(t, 1024)
+	readerAt, err := provider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer readerAt.Close()
+
+	require.NoError(t, m.pushCacheMount(ctx, "go-build", desc.Digest, readerAt))
+	require.Equal(t, data, uploaded)
+	require.Equal(t, []GetCacheMountUploadURLRequest{{
+		CacheName: "go-build",
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}}, uploadReqs)
+
+	// contents the service already has aren't uploaded again
+	uploaded = nil
+	skip = true
+	require.NoError(t, m.pushCacheMount(ctx, "go-build", desc.Digest, readerAt))
+	require.Nil(t, uploaded)
+}
+
+func TestCacheMountSyncStatus(t *testing.T) {
+	ctx := context.Background()
+
+	var configCalls int
+	configErr := errors.New("service unavailable")
+	svc := &fakeService{
+		getCacheMountConfig: func(context.Context, GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error) {
+			configCalls++
+			if configErr != nil {
+				return nil, configErr
+			}
+			return &GetCacheMountConfigResponse{}, nil
+		},
+	}
+	m := newTestManager(svc, ManagerConfig{})
+	require.Equal(t, CacheMountSyncStatus{}, m.CacheMountSyncStatus())
+
+	// a failed start is reported, and can be retried
+	require.ErrorIs(t, m.StartCacheMountSynchronization(ctx), configErr)
+	status := m.CacheMountSyncStatus()
+	require.False(t, status.Active)
+	require.ErrorIs(t, status.LastError, configErr)
+	require.Zero(t, status.LastSync)
+
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+	configErr = nil
+	require.NoError(t, m.StartCacheMountSynchronization(ctx))
+	require.Equal(t, CacheMountSyncStatus{Active: true, LastSync: now}, m.CacheMountSyncStatus())
+	require.NotNil(t, m.stopCacheMountSync)
+
+	// starting again is a no-op
+	require.NoError(t, m.StartCacheMountSynchronization(ctx))
+	require.Equal(t, 2, configCalls)
+
+	require.Equal(t, CacheMountSyncStatus{}, defaultCacheManager{}.CacheMountSyncStatus())
+}
+
+func TestDigestAlgorithms(t *testing.T) {
+	ctx := context.Background()
+
+	// layers addressed with sha256 and sha512 import side by side
+	newLayer := func(alg digest.Algorithm, s string) remotecache.CacheLayer {
+		return remotecache.CacheLayer{
+			Blob:        alg.FromString(s),
+			ParentIndex: -1,
+			Annotations: &remotecache.LayerAnnotations{
+				MediaType: ocispecs.MediaTypeImageLayerGzip,
+				DiffID:    alg.FromString(s + " diff"),
+				Size:      1,
+			},
+		}
+	}
+	sha256Vertex := digest.FromString("sha256 vertex")
+	sha512Vertex := digest.FromString("sha512 vertex")
+	m := newTestManager(&fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			return &remotecache.CacheConfig{
+				Layers: []remotecache.CacheLayer{newLayer(digest.SHA256, "a"), newLayer(digest.SHA512, "b")},
+				Records: []remotecache.CacheRecord{
+					{Digest: recordDigest(sha256Vertex, 0), Results: []remotecache.CacheResult{{LayerIndex: 0}}},
+					{Digest: recordDigest(sha512Vertex, 0), Results: []remotecache.CacheResult{{LayerIndex: 1}}},
+				},
+			}, nil
+		},
+	}, ManagerConfig{})
+	require.NoError(t, m.Import(ctx))
+	for _, vertex := range []digest.Digest{sha256Vertex, sha512Vertex} {
+		keys, err := m.Query(nil, 0, vertex, 0)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+	}
+
+	// malformed digests and unsupported algorithms are rejected
+	invalid := newLayer(digest.SHA512, "c")
+	invalid.Blob = digest.Digest("sha512:abc")
+	_, err := m.descriptorProviderPair(invalid, m.layerProvider)
+	require.ErrorContains(t, err, "invalid digest")
+	unsupported := newLayer(digest.SHA256, "d")
+	unsupported.Annotations.DiffID = digest.Digest("md5:" + strings.Repeat("0", 32))
+	_, err = m.descriptorProviderPair(unsupported, m.layerProvider)
+	require.ErrorContains(t, err, "invalid diffID")
+
+	// chunks of a sha512 layer are addressed with sha512 too, and verify when reassembled
+	_, svc, _ := newTestStore(t)
+	var uploads []digest.Digest
+	getLayerUploadURL := svc.getLayerUploadURL
+	svc.getLayerUploadURL = func(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+		uploads = append(uploads, req.Digest)
+		return getLayerUploadURL(ctx, req)
+	}
+	m = newTestManager(svc, ManagerConfig{ChunkedLayers: true})
+
+	data := make([]byte, 8*1024*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	desc := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageLayer,
+		Digest:    digest.SHA512.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	// content stores only commit sha256 content, so the layer is served as is
+	require.NoError(t, m.pushLayer(ctx, desc, bytesProvider(data)))
+	require.Greater(t, len(uploads), 2)
+	for _, upload := range uploads {
+		require.Equal(t, digest.SHA512, upload.Algorithm())
+	}
+
+	readerAt, err := m.layerProvider.ReaderAt(ctx, desc)
+	require.NoError(t, err)
+	defer readerAt.Close()
+	imported, err := io.ReadAll(content.NewReader(readerAt))
+	require.NoError(t, err)
+	require.Equal(t, desc.Digest, digest.SHA512.FromBytes(imported))
+}
+
+// bytesProvider serves its bytes for any descriptor, whatever the descriptor's digest algorithm.
+type bytesProvider []byte
+
+func (p bytesProvider) ReaderAt(context.Context, ocispecs.Descriptor) (content.ReaderAt, error) {
+	return bytesReaderAt{bytes.NewReader(p)}, nil
+}
+
+type bytesReaderAt struct {
+	*bytes.Reader
+}
+
+func (bytesReaderAt) Close() error {
+	return nil
+}
+
+func TestLayerMirror(t *testing.T) {
+	ctx := context.Background()
+
+	// the service's store is slow to respond, and fails at first
+	release := make(chan struct{})
+	uploaded := make(chan []byte, 1)
+	var puts int
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		puts++
+		if puts < 3 {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		uploaded <- data
+	}))
+	defer store.Close()
+
+	mirror := contentutil.NewBuffer()
+	m := newTestManager(&fakeService{
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: store.URL}, nil
+		},
+	}, ManagerConfig{LayerMirror: mirror})
+
+	// the push returns as soon as the layer is in the mirror
+	data, desc, provider := newTestLayer(t, 1024)
+	require.NoError(t, m.pushLayer(ctx, desc, provider))
+	mirrored, err := content.ReadBlob(ctx, mirror, desc)
+	require.NoError(t, err)
+	require.Equal(t, data, mirrored)
+
+	// the upload to the service completes in the background, retrying failures
+	close(release)
+	select {
+	case got := <-uploaded:
+		require.Equal(t, data, got)
+	case <-time.After(10 * time.Second):
+		t.Fatal("mirrored layer wasn't uploaded")
+	}
+	m.replications.Wait()
+	require.Equal(t, 3, puts)
+}
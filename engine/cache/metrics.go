@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"slices"
+	"time"
+)
+
+// MetricsRecorder is notified of the outcome of each import and export, e.g. to expose them as
+// metrics. Its methods are called synchronously at the end of each import and export, so they
+// should return quickly.
+type MetricsRecorder interface {
+	RecordExport(ExportStats)
+	RecordImport(ImportStats)
+}
+
+// ExportStats describe an export. They cover as much of the export as got done if it failed.
+type ExportStats struct {
+	Duration time.Duration
+	Err      error
+
+	// CacheKeys is the number of cache keys sent to the service.
+	CacheKeys int
+
+	// ExportedRecords is the number of records the service asked the layers of.
+	ExportedRecords int
+
+	// SkippedRefs is the number of cache refs that were skipped because they couldn't be
+	// exported, e.g. because they're lazy or have been pruned.
+	SkippedRefs int
+
+	// SkipReasons breaks SkippedRefs down by why they were skipped.
+	SkipReasons map[SkipReason]int
+
+	// SkippedSample is a sample of the skipped refs, the first maxSkippedSample of them.
+	SkippedSample []SkippedRef
+
+	// PushedLayers is the number of layers pushed, including those the service already had.
+	PushedLayers int
+
+	// UploadedBytes is the number of bytes of layers uploaded while exporting.
+	UploadedBytes int64
+
+	// UploadTimeP50 and UploadTimeP95 are the median and 95th percentile of the time taken to
+	// upload each layer uploaded, not counting those the service already had. They're zero if
+	// none were.
+	UploadTimeP50 time.Duration
+	UploadTimeP95 time.Duration
+}
+
+// SkipReason is why a cache ref was skipped by an export.
+type SkipReason string
+
+const (
+	// SkipNotFound is for results whose ref has been pruned from the local cache.
+	SkipNotFound SkipReason = "not-found"
+	// SkipNotLoaded is for results whose ref couldn't be loaded for any other reason, e.g.
+	// because it's lazy.
+	SkipNotLoaded SkipReason = "not-loaded"
+	// SkipNotImmutable is for results that aren't backed by an immutable ref.
+	SkipNotImmutable SkipReason = "not-immutable"
+	// SkipNoRemotes is for refs that have no remotes to push their layers from.
+	SkipNoRemotes SkipReason = "no-remotes"
+	// SkipTimedOut is for refs that had a layer push time out in ExportTimeoutPerLayer mode.
+	SkipTimedOut SkipReason = "timed-out"
+	// SkipFailed is for refs that failed to export with ContinueOnRecordError set.
+	SkipFailed SkipReason = "failed"
+)
+
+// SkippedRef is a cache ref, or the ID of the result of one that couldn't be loaded, skipped by
+// an export.
+type SkippedRef struct {
+	ID     string
+	Reason SkipReason
+}
+
+// maxSkippedSample is the maximum number of refs in ExportStats.SkippedSample.
+const maxSkippedSample = 10
+
+// skip records that the ref with the given ID was skipped.
+func (s *ExportStats) skip(id string, reason SkipReason) {
+	s.SkippedRefs++
+	if s.SkipReasons == nil {
+		s.SkipReasons = make(map[SkipReason]int)
+	}
+	s.SkipReasons[reason]++
+	if len(s.SkippedSample) < maxSkippedSample {
+		s.SkippedSample = append(s.SkippedSample, SkippedRef{ID: id, Reason: reason})
+	}
+}
+
+// percentile returns the p-th percentile of durations, by the nearest-rank method, or zero if
+// there are none. durations is sorted in place.
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	slices.Sort(durations)
+	rank := (p*len(durations) + 99) / 100
+	return durations[max(rank, 1)-1]
+}
+
+// ImportStats describe an import.
+type ImportStats struct {
+	Duration time.Duration
+	Err      error
+
+	// Records is the number of records, i.e. cache keys, in the imported cache config.
+	Records int
+
+	// Layers is the number of layers in the imported cache config.
+	Layers int
+}
+
+type noopMetricsRecorder struct{}
+
+func (noopMetricsRecorder) RecordExport(ExportStats) {}
+func (noopMetricsRecorder) RecordImport(ImportStats) {}
+
+// metrics returns the MetricsRecorder, which is a no-op if not configured.
+func (m *manager) metrics() MetricsRecorder {
+	if m.MetricsRecorder == nil {
+		return noopMetricsRecorder{}
+	}
+	return m.MetricsRecorder
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/errdefs"
+	"github.com/moby/buildkit/util/bklog"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// how long uploads of mirrored layers are retried for if uploads aren't retried otherwise
+const replicationRetryDuration = 10 * time.Minute
+
+// LayerStore is a store layers can be written to and read back from.
+type LayerStore interface {
+	content.Ingester
+	content.Provider
+}
+
+// mirrorLayer writes the given layer to LayerMirror and then uploads it from there in the
+// background, returning once the local write is done.
+func (m *manager) mirrorLayer(ctx context.Context, layerDesc ocispecs.Descriptor, provider content.Provider, uploadURL *GetLayerUploadURLResponse) error {
+	readerAt, err := provider.ReaderAt(ctx, layerDesc)
+	if err != nil {
+		return err
+	}
+	defer readerAt.Close()
+	err = content.WriteBlob(ctx, m.LayerMirror, "dagger-mirror-"+layerDesc.Digest.String(), content.NewReader(readerAt), layerDesc)
+	if err != nil && !errors.Is(err, errdefs.ErrAlreadyExists) {
+		return fmt.Errorf("failed to write layer %s to mirror: %w", layerDesc.Digest, err)
+	}
+
+	// the upload outlives the export, so it isn't canceled along with it
+	ctx = context.WithoutCancel(ctx)
+	m.replications.Add(1)
+	go func() {
+		defer m.replications.Done()
+		// uploads retry on their own if RetryMaxDuration or UploadMaxAttempts is set, otherwise
+		// retry them here
+		policy := m.uploadRetryPolicy()
+		if policy.retries() {
+			policy.maxDuration = 0
+			policy.maxAttempts = 0
+		} else {
+			policy.maxDuration = replicationRetryDuration
+		}
+		err := policy.do(ctx, func() error {
+			readerAt, err := m.LayerMirror.ReaderAt(ctx, layerDesc)
+			if err != nil {
+				return err
+			}
+			defer readerAt.Close()
+			return m.uploadLayer(ctx, layerDesc, readerAt, uploadURL)
+		})
+		if err != nil {
+			bklog.G(ctx).WithError(err).Errorf("failed to upload mirrored layer %s", layerDesc.Digest)
+			return
+		}
+		bklog.G(ctx).Debugf("uploaded mirrored layer %s", layerDesc.Digest)
+	}()
+	return nil
+}
+
+// waitForReplications waits for uploads of mirrored layers to finish, or ctx to be done.
+func (m *manager) waitForReplications(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		m.replications.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		bklog.G(ctx).Warn("closing with uploads of mirrored layers still in progress")
+	}
+}
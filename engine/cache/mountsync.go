@@ -21,14 +21,25 @@ import (
 	solverpb "github.com/moby/buildkit/solver/pb"
 	"github.com/moby/buildkit/util/bklog"
 	"github.com/moby/buildkit/util/leaseutil"
+	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/dagger/dagger/core"
 )
 
-func (m *manager) StartCacheMountSynchronization(ctx context.Context) error {
-	getCacheMountConfigResp, err := m.cacheClient.GetCacheMountConfig(ctx, GetCacheMountConfigRequest{})
+func (m *manager) StartCacheMountSynchronization(ctx context.Context) (rerr error) {
+	m.mountSyncMu.Lock()
+	defer m.mountSyncMu.Unlock()
+	if m.stopCacheMountSync != nil {
+		// already started, syncing again would overwrite mounts in use
+		return nil
+	}
+	defer func() {
+		m.recordCacheMountSync(rerr == nil, rerr)
+	}()
+
+	getCacheMountConfigResp, err := m.service().GetCacheMountConfig(ctx, GetCacheMountConfigRequest{})
 	if err != nil {
 		return fmt.Errorf("failed to get cache mount config: %w", err)
 	}
@@ -85,114 +96,168 @@ func (m *manager) StartCacheMountSynchronization(ctx context.Context) error {
 		return err
 	}
 
-	m.stopCacheMountSync = func(ctx context.Context) error {
-		var eg errgroup.Group
+	m.stopCacheMountSync = m.ExportCacheMounts
+	return nil
+}
 
-		seenCacheMounts := map[string]struct{}{}
-		core.SeenCacheKeys.Range(func(k any, v any) bool {
-			seenCacheMounts[k.(string)] = struct{}{}
-			return true
-		})
+// ExportCacheMounts pushes the contents of the cache mounts used since the engine started to the
+// service. It's independent of the export of build results, whose records are left untouched,
+// and also happens when the manager is closed if cache mount synchronization was started.
+func (m *manager) ExportCacheMounts(ctx context.Context) (rerr error) {
+	defer func() {
+		m.recordCacheMountSync(m.CacheMountSyncStatus().Active, rerr)
+	}()
 
-		for cacheMountName := range seenCacheMounts {
-			eg.Go(func() error {
-				bklog.G(ctx).Debugf("syncing cache mount remotely %s", cacheMountName)
-				cacheKey := cacheKeyFromMountName(cacheMountName)
-
-				return withCacheMount(ctx, m.MountManager, cacheKey, func(ctx context.Context, mnt mount.Mount) error {
-					// First compress the mount into the content store. We can't stream direct to S3 because we want
-					// to tell S3 the checksum of the whole thing when we open the request there. Apparently there
-					// is a way to include the checksum as a trailer, but it is poorly documented and seems to require
-					// a different streaming request type, which is giving me a headache right now. Can optimize in future.
-
-					// add a temporary lease so our content doesn't get pruned immediately from the store
-					ctx, done, err := leaseutil.WithLease(ctx, m.Worker.LeaseManager(), leaseutil.MakeTemporary)
-					if err != nil {
-						return fmt.Errorf("failed to create lease: %w", err)
-					}
-					defer done(ctx)
+	var eg errgroup.Group
 
-					// compress the mount to a tar.zstd and write to the content store
-					contentRef := "dagger-cachemount-" + cacheMountName
-					contentWriter, err := m.Worker.ContentStore().Writer(ctx, content.WithRef(contentRef))
-					if err != nil {
-						return fmt.Errorf("failed to create content writer: %w", err)
-					}
-					defer contentWriter.Close()
-					writeBuffer := bufio.NewWriterSize(contentWriter, 1024*1024)
-					compressor, err := zstd.NewWriter(writeBuffer, zstd.WithEncoderLevel(zstd.SpeedDefault))
-					if err != nil {
-						return fmt.Errorf("failed to create compressor: %w", err)
-					}
-					defer compressor.Close()
-					// mnt.Source relies on our check that this is a bind mount in withCacheMount
-					err = archive.WriteDiff(ctx, compressor, "", mnt.Source)
-					if err != nil {
-						return fmt.Errorf("failed to write diff: %w", err)
-					}
-					if err := compressor.Close(); err != nil {
-						return fmt.Errorf("failed to close compressor: %w", err)
-					}
-					writeBuffer.Flush()
-					if err := contentWriter.Commit(ctx, 0, ""); err != nil {
-						if errors.Is(err, errdefs.ErrAlreadyExists) {
-							// we should be releasing these, but if it was already there, that's weird but fine
-							bklog.G(ctx).Debugf("cache mount %q already committed", cacheMountName)
-						} else {
-							return fmt.Errorf("failed to commit content: %w", err)
-						}
-					}
-					contentDigest := contentWriter.Digest()
-
-					// now that we have the digest we can upload from the content store to the url
-					contentReaderAt, err := m.Worker.ContentStore().ReaderAt(ctx, ocispecs.Descriptor{
-						Digest: contentDigest,
-					})
-					if err != nil {
-						return fmt.Errorf("failed to create content reader: %w", err)
-					}
-					defer contentReaderAt.Close()
-					contentLength := contentReaderAt.Size()
-					getURLResp, err := m.cacheClient.GetCacheMountUploadURL(ctx, GetCacheMountUploadURLRequest{
-						CacheName: cacheMountName,
-						Digest:    contentDigest,
-						Size:      contentLength,
-					})
-					if err != nil {
-						return fmt.Errorf("failed to get cache mount upload url: %w", err)
-					}
+	seenCacheMounts := map[string]struct{}{}
+	core.SeenCacheKeys.Range(func(k any, v any) bool {
+		seenCacheMounts[k.(string)] = struct{}{}
+		return true
+	})
 
-					if getURLResp.Skip {
-						bklog.G(ctx).Debugf("skipped pushing cache mount %s", cacheMountName)
-						return nil
-					}
+	for cacheMountName := range seenCacheMounts {
+		eg.Go(func() error {
+			bklog.G(ctx).Debugf("syncing cache mount remotely %s", cacheMountName)
+			cacheKey := cacheKeyFromMountName(cacheMountName)
 
-					contentReader := io.NewSectionReader(contentReaderAt, 0, contentLength)
-					httpReq, err := http.NewRequestWithContext(ctx, http.MethodPut, getURLResp.URL, contentReader)
-					if err != nil {
-						return fmt.Errorf("failed to create http request: %w", err)
-					}
-					httpReq.ContentLength = contentLength // set it here, go stdlib will ignore if set on Header (??!!)
-					for k, v := range getURLResp.Headers {
-						httpReq.Header.Set(k, v)
-					}
-					resp, err := m.httpClient.Do(httpReq)
-					if err != nil {
-						return fmt.Errorf("failed to upload cache mount: %w", err)
-					}
-					defer resp.Body.Close()
-					if resp.StatusCode != http.StatusOK {
-						return fmt.Errorf("failed to upload cache mount: %s", resp.Status)
+			return withCacheMount(ctx, m.MountManager, cacheKey, func(ctx context.Context, mnt mount.Mount) error {
+				// First compress the mount into the content store. We can't stream direct to S3 because we want
+				// to tell S3 the checksum of the whole thing when we open the request there. Apparently there
+				// is a way to include the checksum as a trailer, but it is poorly documented and seems to require
+				// a different streaming request type, which is giving me a headache right now. Can optimize in future.
+
+				// add a temporary lease so our content doesn't get pruned immediately from the store
+				ctx, done, err := leaseutil.WithLease(ctx, m.Worker.LeaseManager(), leaseutil.MakeTemporary)
+				if err != nil {
+					return fmt.Errorf("failed to create lease: %w", err)
+				}
+				defer done(ctx)
+
+				// compress the mount to a tar.zstd and write to the content store
+				contentRef := "dagger-cachemount-" + cacheMountName
+				contentWriter, err := m.Worker.ContentStore().Writer(ctx, content.WithRef(contentRef))
+				if err != nil {
+					return fmt.Errorf("failed to create content writer: %w", err)
+				}
+				defer contentWriter.Close()
+				writeBuffer := bufio.NewWriterSize(contentWriter, 1024*1024)
+				compressor, err := zstd.NewWriter(writeBuffer, zstd.WithEncoderLevel(zstd.SpeedDefault))
+				if err != nil {
+					return fmt.Errorf("failed to create compressor: %w", err)
+				}
+				defer compressor.Close()
+				// mnt.Source relies on our check that this is a bind mount in withCacheMount
+				err = archive.WriteDiff(ctx, compressor, "", mnt.Source)
+				if err != nil {
+					return fmt.Errorf("failed to write diff: %w", err)
+				}
+				if err := compressor.Close(); err != nil {
+					return fmt.Errorf("failed to close compressor: %w", err)
+				}
+				writeBuffer.Flush()
+				if err := contentWriter.Commit(ctx, 0, ""); err != nil {
+					if errors.Is(err, errdefs.ErrAlreadyExists) {
+						// we should be releasing these, but if it was already there, that's weird but fine
+						bklog.G(ctx).Debugf("cache mount %q already committed", cacheMountName)
+					} else {
+						return fmt.Errorf("failed to commit content: %w", err)
 					}
+				}
+				contentDigest := contentWriter.Digest()
 
-					bklog.G(ctx).Debugf("synced cache mount remotely %s", cacheMountName)
-					return nil
+				// now that we have the digest we can upload from the content store to the url
+				contentReaderAt, err := m.Worker.ContentStore().ReaderAt(ctx, ocispecs.Descriptor{
+					Digest: contentDigest,
 				})
+				if err != nil {
+					return fmt.Errorf("failed to create content reader: %w", err)
+				}
+				defer contentReaderAt.Close()
+				return m.pushCacheMount(ctx, cacheMountName, contentDigest, contentReaderAt)
 			})
-		}
-		return eg.Wait()
+		})
+	}
+	return eg.Wait()
+}
+
+// CacheMountSyncStatus describes the synchronization of cache mounts with the cache service.
+type CacheMountSyncStatus struct {
+	// Active is whether cache mounts have been synced from the service, and will be synced back
+	// to it when the manager is closed.
+	Active bool
+
+	// LastSync is when cache mounts were last synced successfully, either way, zero if never.
+	LastSync time.Time
+
+	// LastError is the error of the last sync if it failed.
+	LastError error
+}
+
+// CacheMountSyncStatus returns the status of the synchronization of cache mounts.
+func (m *manager) CacheMountSyncStatus() CacheMountSyncStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mountSyncStatus
+}
+
+// recordCacheMountSync records the outcome of a sync of cache mounts in either direction.
+func (m *manager) recordCacheMountSync(active bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mountSyncStatus.Active = active
+	m.mountSyncStatus.LastError = err
+	if err == nil {
+		m.mountSyncStatus.LastSync = m.now()
+	}
+}
+
+// CacheMountSyncStatus reports cache mounts as not synced, as there's no service to sync with.
+func (defaultCacheManager) CacheMountSyncStatus() CacheMountSyncStatus {
+	return CacheMountSyncStatus{}
+}
+
+func (mm *multiManager) CacheMountSyncStatus() CacheMountSyncStatus {
+	return mm.managers[0].CacheMountSyncStatus()
+}
+
+// pushCacheMount uploads the compressed contents of the named cache mount, unless the service
+// already has them.
+func (m *manager) pushCacheMount(ctx context.Context, cacheMountName string, contentDigest digest.Digest, contentReaderAt content.ReaderAt) error {
+	contentLength := contentReaderAt.Size()
+	getURLResp, err := m.service().GetCacheMountUploadURL(ctx, GetCacheMountUploadURLRequest{
+		CacheName: cacheMountName,
+		Digest:    contentDigest,
+		Size:      contentLength,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get cache mount upload url: %w", err)
+	}
+
+	if getURLResp.Skip {
+		bklog.G(ctx).Debugf("skipped pushing cache mount %s", cacheMountName)
+		return nil
+	}
+
+	contentReader := io.NewSectionReader(contentReaderAt, 0, contentLength)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPut, getURLResp.URL, contentReader)
+	if err != nil {
+		return fmt.Errorf("failed to create http request: %w", err)
+	}
+	httpReq.ContentLength = contentLength // set it here, go stdlib will ignore if set on Header (??!!)
+	for k, v := range getURLResp.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := m.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to upload cache mount: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to upload cache mount: %s", resp.Status)
 	}
 
+	bklog.G(ctx).Debugf("synced cache mount remotely %s", cacheMountName)
 	return nil
 }
 
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/bklog"
+)
+
+// multiManager combines the managers of multiple cache services, set with ServiceURLs. Each
+// service is imported from and exported to by its own manager, independently of the others, so
+// that one unavailable service doesn't hold up the rest. The managers share the local cache,
+// which results are saved to. Queries go to it and to the cache imported by each manager, with
+// the local cache taking precedence, followed by the first service's.
+type multiManager struct {
+	solver.CacheManager // the combined cache of the local cache and managers
+	managers            []*manager
+}
+
+var _ Manager = &multiManager{}
+
+// multiMember is what a manager of a multiManager needs to know about it.
+type multiMember struct {
+	localCache solver.CacheManager // shared by the managers, and queried by the multiManager
+	index      int                 // of the manager's service in ServiceURLs
+}
+
+// newMultiManager starts a manager for each of ServiceURLs, in priority order. Services that
+// fail to start are skipped, falling back to just the local cache if none do.
+func newMultiManager(ctx context.Context, managerConfig ManagerConfig) (Manager, error) {
+	localCache := solver.NewCacheManager(ctx, LocalCacheID, managerConfig.KeyStore, managerConfig.ResultStore)
+	var managers []*manager
+	cacheManagers := []solver.CacheManager{localCache}
+	for i, serviceURL := range managerConfig.ServiceURLs {
+		serviceConfig := managerConfig
+		serviceConfig.ServiceURL = serviceURL
+		serviceConfig.ServiceURLs = nil
+		serviceManager, err := newManager(ctx, serviceConfig, &multiMember{localCache: localCache, index: i})
+		if err != nil {
+			bklog.G(ctx).WithError(err).Warnf("skipping cache service at %s", serviceURL)
+			continue
+		}
+		m, ok := serviceManager.(*manager)
+		if !ok {
+			// the service's init failed and it fell back to the local cache, already logged
+			continue
+		}
+		managers = append(managers, m)
+		cacheManagers = append(cacheManagers, m)
+	}
+	if len(managers) == 0 {
+		return defaultCacheManager{CacheManager: localCache, keyStore: managerConfig.KeyStore}, nil
+	}
+	return &multiManager{
+		CacheManager: solver.NewCombinedCacheManager(cacheManagers, localCache),
+		managers:     managers,
+	}, nil
+}
+
+func (mm *multiManager) Save(key *solver.CacheKey, s solver.Result, createdAt time.Time) (*solver.ExportableCacheKey, error) {
+	// saved to the local cache, to be exported by each manager
+	exportableKey, err := mm.CacheManager.Save(key, s, createdAt)
+	if err == nil {
+		for _, m := range mm.managers {
+			if m.ExportAfterSave > 0 {
+				m.scheduleExportAfterSave()
+			}
+		}
+	}
+	return exportableKey, err
+}
+
+// StartCacheMountSynchronization syncs cache mounts with the first service only, as they can
+// only be synced from one place.
+func (mm *multiManager) StartCacheMountSynchronization(ctx context.Context) error {
+	return mm.managers[0].StartCacheMountSynchronization(ctx)
+}
+
+func (mm *multiManager) ExportCacheMounts(ctx context.Context) error {
+	return mm.managers[0].ExportCacheMounts(ctx)
+}
+
+func (mm *multiManager) Prune(ctx context.Context, opts PruneOptions) error {
+	return mm.each(func(m *manager) error {
+		return m.Prune(ctx, opts)
+	})
+}
+
+func (mm *multiManager) ReloadConfig(ctx context.Context) error {
+	return mm.each(func(m *manager) error {
+		return m.ReloadConfig(ctx)
+	})
+}
+
+func (mm *multiManager) Flush(ctx context.Context) error {
+	return mm.each(func(m *manager) error {
+		return m.Flush(ctx)
+	})
+}
+
+// ReleaseUnreferenced releases from the local cache, which the managers share.
+func (mm *multiManager) ReleaseUnreferenced(ctx context.Context) error {
+	return mm.managers[0].ReleaseUnreferenced(ctx)
+}
+
+// Close closes the managers concurrently, so that their final exports run in parallel.
+func (mm *multiManager) Close(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(mm.managers))
+	for i, m := range mm.managers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.Close(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// each calls fn with each of the managers, returning all their errors.
+func (mm *multiManager) each(fn func(*manager) error) error {
+	var errs []error
+	for _, m := range mm.managers {
+		errs = append(errs, fn(m))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/moby/buildkit/util/progress"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerProgress reports the upload of a layer to the ProgressWriter as a vertex keyed by the
+// layer's digest. It's nil, and its methods no-ops, if no ProgressWriter is configured.
+type layerProgress struct {
+	pw progress.Writer
+	id string
+
+	mu     sync.Mutex
+	status progress.Status
+}
+
+func (m *manager) startLayerProgress(layerDesc ocispecs.Descriptor) *layerProgress {
+	if m.ProgressWriter == nil {
+		return nil
+	}
+	now := time.Now()
+	p := &layerProgress{
+		pw: m.ProgressWriter,
+		id: layerDesc.Digest.String(),
+		status: progress.Status{
+			Action:  "uploading",
+			Total:   int(layerDesc.Size),
+			Started: &now,
+		},
+	}
+	p.pw.Write(p.id, p.status)
+	return p
+}
+
+// read records that the content of the layer has been read up to the given offset. Reads are
+// tracked by offset rather than added up, so that content read again for a retry isn't counted
+// twice.
+func (p *layerProgress) read(offset int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if int(offset) <= p.status.Current {
+		return
+	}
+	p.status.Current = int(offset)
+	p.pw.Write(p.id, p.status)
+}
+
+// done completes the vertex, as skipped if the service already had the layer.
+func (p *layerProgress) done(skipped bool, err error) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.status.Completed = &now
+	switch {
+	case skipped:
+		p.status.Action = "skipped"
+	case err != nil:
+		p.status.Action = "failed"
+	default:
+		p.status.Action = "done"
+		p.status.Current = p.status.Total
+	}
+	p.pw.Write(p.id, p.status)
+}
+
+// reader returns r reporting the bytes read from it.
+func (p *layerProgress) reader(r io.ReadCloser) io.ReadCloser {
+	if p == nil {
+		return r
+	}
+	return &progressReader{ReadCloser: r, progress: p}
+}
+
+// readerAt returns r reporting the bytes read from it.
+func (p *layerProgress) readerAt(r content.ReaderAt) content.ReaderAt {
+	if p == nil {
+		return r
+	}
+	return &progressReaderAt{ReaderAt: r, progress: p}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	progress *layerProgress
+	offset   int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.offset += int64(n)
+	r.progress.read(r.offset)
+	return n, err
+}
+
+type progressReaderAt struct {
+	content.ReaderAt
+	progress *layerProgress
+}
+
+func (r *progressReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, off)
+	r.progress.read(off + int64(n))
+	return n, err
+}
@@ -2,28 +2,121 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 
 	"dagger.io/dagger/telemetry"
 	"github.com/containerd/containerd/content"
 	"github.com/dagger/dagger/engine/session"
 	"github.com/moby/buildkit/util/bklog"
+	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
 )
 
 const otelMagicacheDigestKey = "dagger.io/magicache.digest"
 const otelMagicacheSize = "dagger.io/magicache.size"
 
 type layerProvider struct {
-	httpClient  *http.Client
-	cacheClient Service
+	httpClient *http.Client
+	service    func() Service      // returns the client of the cache service
+	keys       LayerKeySource      // set if layers may be encrypted
+	chunked    bool                // set if layers may be chunked
+	downloads  *semaphore.Weighted // set if concurrent downloads are limited
+
+	// sizes caches the sizes of layers imported without one by digest, set per import
+	sizes *sync.Map
+}
+
+// forImport returns a copy of the provider for the layers of a single import, which caches the
+// sizes it has to look up for as long as the import's cache is in use.
+func (p *layerProvider) forImport() *layerProvider {
+	importProvider := *p
+	importProvider.sizes = &sync.Map{}
+	return &importProvider
+}
+
+// newDownloadLimit returns the semaphore limiting downloads to max at once, or nil if max isn't
+// positive.
+func newDownloadLimit(max int) *semaphore.Weighted {
+	if max <= 0 {
+		return nil
+	}
+	return semaphore.NewWeighted(int64(max))
 }
 
 func (p *layerProvider) ReaderAt(ctx context.Context, desc ocispecs.Descriptor) (content.ReaderAt, error) {
+	readerAt, err := p.layerReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyingReaderAt(ctx, readerAt, desc), nil
+}
+
+// layerReaderAt returns a ReaderAt of the content of the given layer, reassembling it from its
+// chunks if it's chunked.
+func (p *layerProvider) layerReaderAt(ctx context.Context, desc ocispecs.Descriptor) (content.ReaderAt, error) {
+	if !p.chunked {
+		return p.blobReaderAt(ctx, desc)
+	}
+
+	readerAt, err := p.downloadReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readChunkManifest(readerAt)
+	if err != nil {
+		readerAt.Close()
+		return nil, fmt.Errorf("failed to read chunk manifest of layer %s: %w", desc.Digest, err)
+	}
+	if desc.Size == 0 {
+		// imported without a size, the layer's is that of its blob as looked up on download, unless
+		// the blob is a chunk manifest, whose chunks add up to it
+		desc.Size = readerAt.Size()
+		if manifest != nil {
+			desc.Size = manifest.size()
+		}
+	}
+	if manifest == nil {
+		return p.decryptingReaderAt(ctx, readerAt, desc)
+	}
+	readerAt.Close()
+	chunkedReaderAt, err := newChunkedReaderAt(ctx, desc, manifest, p.blobReaderAt)
+	if err != nil {
+		return nil, err
+	}
+	return chunkedReaderAt, nil
+}
+
+// blobReaderAt returns a ReaderAt of the (decrypted) content of the blob with the given digest.
+func (p *layerProvider) blobReaderAt(ctx context.Context, desc ocispecs.Descriptor) (content.ReaderAt, error) {
+	readerAt, err := p.downloadReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return p.decryptingReaderAt(ctx, readerAt, desc)
+}
+
+func (p *layerProvider) downloadReaderAt(ctx context.Context, desc ocispecs.Descriptor) (_ content.ReaderAt, rerr error) {
+	release := func() {}
+	if p.downloads != nil {
+		// the context is honored so that a canceled import doesn't keep waiting for a slot
+		if err := p.downloads.Acquire(ctx, 1); err != nil {
+			return nil, fmt.Errorf("failed to wait to download layer %s: %w", desc.Digest, err)
+		}
+		release = func() { p.downloads.Release(1) }
+	}
+	defer func() {
+		if rerr != nil {
+			release()
+		}
+	}()
+
 	ctx, span := telemetry.Tracer(ctx, session.InstrumentationLibrary).
 		Start(ctx, "magicache layer download")
 	span.SetAttributes(
@@ -31,22 +124,176 @@ func (p *layerProvider) ReaderAt(ctx context.Context, desc ocispecs.Descriptor)
 		attribute.Int64(otelMagicacheSize, desc.Size),
 	)
 
-	resp, err := p.cacheClient.GetLayerDownloadURL(ctx, GetLayerDownloadURLRequest{
+	resp, err := p.service().GetLayerDownloadURL(ctx, GetLayerDownloadURLRequest{
 		Digest: desc.Digest,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get layer download url for digest %s: %w", desc.Digest, err)
 	}
 
+	if desc.Size == 0 {
+		// older cache entries were written without layer sizes
+		size, err := p.layerSize(ctx, desc.Digest, resp.URL)
+		if err != nil {
+			return nil, err
+		}
+		desc.Size = size
+	}
+
 	return &urlReaderAt{
 		ctx:        ctx,
 		httpClient: p.httpClient,
 		url:        resp.URL,
 		desc:       desc,
 		span:       span,
+		release:    release,
 	}, nil
 }
 
+// layerSize returns the size of the blob at the given download URL, caching it for the rest of the
+// import. It's looked up with a HEAD request, or a GET of the blob's first byte if that fails, as
+// presigned URLs are often only valid for GET requests.
+func (p *layerProvider) layerSize(ctx context.Context, dgst digest.Digest, url string) (int64, error) {
+	if p.sizes != nil {
+		if size, ok := p.sizes.Load(dgst); ok {
+			return size.(int64), nil
+		}
+	}
+
+	size, err := p.headSize(ctx, url)
+	if err != nil {
+		var rangeErr error
+		size, rangeErr = p.rangeSize(ctx, url)
+		if rangeErr != nil {
+			return 0, fmt.Errorf("failed to get size of layer %s: %w", dgst, errors.Join(err, rangeErr))
+		}
+	}
+
+	if p.sizes != nil {
+		p.sizes.Store(dgst, size)
+	}
+	return size, nil
+}
+
+// headSize returns the size of the blob at url from the Content-Length of a HEAD request.
+func (p *layerProvider) headSize(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD: %s", resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, errors.New("HEAD: unknown content length")
+	}
+	return resp.ContentLength, nil
+}
+
+// rangeSize returns the size of the blob at url from the Content-Range of a GET of its first byte,
+// or the Content-Length if the whole blob is returned instead, without reading the body.
+func (p *layerProvider) rangeSize(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start, end, size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			return 0, fmt.Errorf("GET: invalid content range %q", resp.Header.Get("Content-Range"))
+		}
+		return size, nil
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			return 0, errors.New("GET: unknown content length")
+		}
+		return resp.ContentLength, nil
+	default:
+		return 0, fmt.Errorf("GET: %s", resp.Status)
+	}
+}
+
+func (p *layerProvider) decryptingReaderAt(ctx context.Context, readerAt content.ReaderAt, desc ocispecs.Descriptor) (content.ReaderAt, error) {
+	if p.keys == nil {
+		return readerAt, nil
+	}
+	decryptingReaderAt, err := newDecryptingReaderAt(ctx, readerAt, desc, p.keys)
+	if err != nil {
+		readerAt.Close()
+		return nil, err
+	}
+	return decryptingReaderAt, nil
+}
+
+// verifyingReaderAt verifies the content read from a ReaderAt against the digest of its
+// descriptor, so that a misbehaving service can't have wrong content imported into the cache. The
+// read reaching the end of the content fails if it doesn't match, before its bytes are used.
+//
+// Only content read sequentially from the start can be verified this way. Once a read skips
+// ahead or goes back, verification is given up on and the content is passed through as is.
+// That's fine for importing, since containerd reads layers into the content store sequentially.
+type verifyingReaderAt struct {
+	content.ReaderAt
+	ctx  context.Context
+	desc ocispecs.Descriptor
+
+	verifier digest.Verifier // nil once verification has been given up on
+	offset   int64
+	err      error // set once the content failed verification
+}
+
+func newVerifyingReaderAt(ctx context.Context, readerAt content.ReaderAt, desc ocispecs.Descriptor) content.ReaderAt {
+	if err := desc.Digest.Validate(); err != nil {
+		// the descriptor's validated on import, this is just so Verifier can't panic
+		return readerAt
+	}
+	return &verifyingReaderAt{
+		ReaderAt: readerAt,
+		ctx:      ctx,
+		desc:     desc,
+		verifier: desc.Digest.Verifier(),
+	}
+}
+
+func (r *verifyingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.ReaderAt.ReadAt(p, off)
+	if r.verifier == nil {
+		return n, err
+	}
+	if off != r.offset {
+		bklog.G(r.ctx).Debugf("non-sequential read of layer %s at offset %d, not verifying its content", r.desc.Digest, off)
+		r.verifier = nil
+		return n, err
+	}
+
+	r.verifier.Write(p[:n])
+	r.offset += int64(n)
+	if r.offset >= r.Size() || errors.Is(err, io.EOF) {
+		verified := r.offset == r.Size() && r.verifier.Verified()
+		r.verifier = nil // the content's been read in full, any further reads aren't verified
+		if !verified {
+			r.err = fmt.Errorf("content of layer %s doesn't match its digest", r.desc.Digest)
+			return 0, r.err
+		}
+	}
+	return n, err
+}
+
 type cacheMountProvider struct {
 	httpClient *http.Client
 	url        string
@@ -81,6 +328,7 @@ type urlReaderAt struct {
 	url        string
 	desc       ocispecs.Descriptor
 	span       trace.Span
+	release    func() // if set, called once closed, e.g. to free a download slot
 
 	// internally set fields
 	body   io.ReadCloser
@@ -90,7 +338,7 @@ type urlReaderAt struct {
 func (r *urlReaderAt) ReadAt(p []byte, off int64) (int, error) {
 	if r.body == nil || off != r.offset {
 		// this is either the first read or a non-sequential one, so we need to (re-)open the reader
-		req, err := http.NewRequest("GET", r.url, nil)
+		req, err := http.NewRequestWithContext(r.ctx, "GET", r.url, nil)
 		if err != nil {
 			return 0, err
 		}
@@ -123,6 +371,10 @@ func (r *urlReaderAt) Close() error {
 	if r.span != nil {
 		r.span.End()
 	}
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
 
 	if r.body != nil {
 		return r.body.Close()
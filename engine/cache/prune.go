@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/bklog"
+)
+
+// PruneOptions select the cache records to prune.
+type PruneOptions struct {
+	// MaxAge, if set, prunes results created longer than this ago.
+	MaxAge time.Duration
+
+	// KeepBytes, if set, has the cache service prune its least recently created results until
+	// its cache fits in this many bytes. It doesn't apply to the local cache, whose size is up to
+	// buildkit's GC.
+	KeepBytes int64
+}
+
+// Prune drops the records of results matching opts from the cache service and then from the
+// local cache.
+func (m *manager) Prune(ctx context.Context, opts PruneOptions) error {
+	// don't have an export send the records being pruned back to the service
+	m.exportMu.Lock()
+	defer m.exportMu.Unlock()
+
+	var pruned []CacheKey
+	if opts.MaxAge > 0 {
+		var err error
+		pruned, err = staleCacheKeys(m.KeyStore, m.now().Add(-opts.MaxAge))
+		if err != nil {
+			return err
+		}
+	}
+	req := PruneCacheRecordsRequest{
+		MaxAge:    opts.MaxAge,
+		KeepBytes: opts.KeepBytes,
+		Namespace: m.Namespace,
+	}
+	for _, cacheKey := range pruned {
+		reqKey := CacheKey{ID: m.KeyPrefix + cacheKey.ID}
+		for _, result := range cacheKey.Results {
+			result.ID = refIDOfResult(result.ID)
+			reqKey.Results = append(reqKey.Results, result)
+		}
+		req.CacheKeys = append(req.CacheKeys, reqKey)
+	}
+	resp, err := m.service().PruneCacheRecords(ctx, req)
+	if err != nil {
+		return err
+	}
+	bklog.G(ctx).Debugf("cache service pruned %d results (%d bytes)", resp.PrunedResults, resp.PrunedBytes)
+
+	return releaseCacheKeys(ctx, m.KeyStore, pruned)
+}
+
+func (c defaultCacheManager) Prune(ctx context.Context, opts PruneOptions) error {
+	if c.keyStore == nil || opts.MaxAge <= 0 {
+		return nil
+	}
+	pruned, err := staleCacheKeys(c.keyStore, time.Now().Add(-opts.MaxAge))
+	if err != nil {
+		return err
+	}
+	return releaseCacheKeys(ctx, c.keyStore, pruned)
+}
+
+// staleCacheKeys returns the keys with results created before the given time, along with just
+// those results.
+func staleCacheKeys(keyStore solver.CacheKeyStorage, before time.Time) ([]CacheKey, error) {
+	var stale []CacheKey
+	err := keyStore.Walk(func(id string) error {
+		cacheKey := CacheKey{ID: id}
+		err := keyStore.WalkResults(id, func(cacheResult solver.CacheResult) error {
+			if cacheResult.CreatedAt.Before(before) {
+				cacheKey.Results = append(cacheKey.Results, Result{
+					ID:        cacheResult.ID,
+					CreatedAt: cacheResult.CreatedAt,
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(cacheKey.Results) > 0 {
+			stale = append(stale, cacheKey)
+		}
+		return nil
+	})
+	return stale, err
+}
+
+// refIDOfResult returns the ID of the cache ref of the result with the given ID in the key store,
+// which is what results are identified by in exports. Worker results are stored with IDs of the
+// form <worker ID>::<ref ID>.
+func refIDOfResult(resultID string) string {
+	if _, refID, ok := strings.Cut(resultID, "::"); ok {
+		return refID
+	}
+	return resultID
+}
+
+// releaseCacheKeys releases the results of the given keys from the key store, which drops the
+// keys too once they have no results left. The refs of the results are left to buildkit's GC.
+func releaseCacheKeys(ctx context.Context, keyStore solver.CacheKeyStorage, cacheKeys []CacheKey) error {
+	var released int
+	for _, cacheKey := range cacheKeys {
+		for _, result := range cacheKey.Results {
+			if err := keyStore.Release(result.ID); err != nil {
+				return err
+			}
+			released++
+		}
+	}
+	bklog.G(ctx).Debugf("pruned %d local cache results", released)
+	return nil
+}
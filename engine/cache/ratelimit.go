@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedService wraps a Service so that calls are paced by a client-side rate limiter,
+// protecting the cache service from bursts of calls made by a single busy engine. Calls wait
+// for the limiter rather than failing, unless their context is canceled first.
+//
+// The wrapped Service isn't embedded, so that a method added to Service fails to compile until
+// it's rate limited too, rather than bypassing the limiter.
+type rateLimitedService struct {
+	svc     Service
+	limiter *rate.Limiter
+}
+
+var _ Service = &rateLimitedService{}
+
+func newRateLimitedService(svc Service, limit float64, burst int) *rateLimitedService {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimitedService{
+		svc:     svc,
+		limiter: rate.NewLimiter(rate.Limit(limit), burst),
+	}
+}
+
+func (s *rateLimitedService) GetConfig(ctx context.Context, req GetConfigRequest) (*Config, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.GetConfig(ctx, req)
+}
+
+func (s *rateLimitedService) UpdateCacheRecords(ctx context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.UpdateCacheRecords(ctx, req)
+}
+
+func (s *rateLimitedService) UpdateCacheLayers(ctx context.Context, req UpdateCacheLayersRequest) error {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return s.svc.UpdateCacheLayers(ctx, req)
+}
+
+func (s *rateLimitedService) ImportCache(ctx context.Context, req ImportCacheRequest) (*ImportCacheResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.ImportCache(ctx, req)
+}
+
+func (s *rateLimitedService) GetLayerDownloadURL(ctx context.Context, req GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.GetLayerDownloadURL(ctx, req)
+}
+
+func (s *rateLimitedService) GetLayerUploadURL(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.GetLayerUploadURL(ctx, req)
+}
+
+func (s *rateLimitedService) GetAttestations(ctx context.Context, req GetAttestationsRequest) (*GetAttestationsResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.GetAttestations(ctx, req)
+}
+
+func (s *rateLimitedService) GetCacheMountConfig(ctx context.Context, req GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.GetCacheMountConfig(ctx, req)
+}
+
+func (s *rateLimitedService) GetCacheMountUploadURL(ctx context.Context, req GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.GetCacheMountUploadURL(ctx, req)
+}
+
+func (s *rateLimitedService) PruneCacheRecords(ctx context.Context, req PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.PruneCacheRecords(ctx, req)
+}
+
+func (s *rateLimitedService) LayersExist(ctx context.Context, req LayersExistRequest) (*LayersExistResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.LayersExist(ctx, req)
+}
+
+func (s *rateLimitedService) Ping(ctx context.Context) error {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	return s.svc.Ping(ctx)
+}
+
+func (s *rateLimitedService) GetLayerUploadURLs(ctx context.Context, req GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.svc.GetLayerUploadURLs(ctx, req)
+}
@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/opencontainers/go-digest"
+)
+
+// serviceInteraction is a single recorded call to the cache service. Recordings are a stream of
+// JSON encoded interactions, in the order the calls completed.
+type serviceInteraction struct {
+	Method   string
+	Request  json.RawMessage
+	Response json.RawMessage
+	Error    string
+}
+
+// sensitiveHeaders are the headers whose values are redacted from recorded responses.
+var sensitiveHeaders = map[string]struct{}{
+	"Authorization":        {},
+	"Proxy-Authorization":  {},
+	"Cookie":               {},
+	"X-Amz-Security-Token": {},
+}
+
+const redactedHeaderValue = "REDACTED"
+
+// recordingService wraps a Service so that every call made to it is recorded, allowing cache
+// behavior seen against a live service to be reproduced offline with a replayService. Each method is
+// implemented explicitly rather than by embedding the wrapped Service, so that none can silently
+// skip being recorded.
+type recordingService struct {
+	svc Service
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ Service = &recordingService{}
+
+func newRecordingService(svc Service, w io.Writer) *recordingService {
+	return &recordingService{
+		svc: svc,
+		w:   w,
+	}
+}
+
+func (s *recordingService) record(ctx context.Context, method string, req, resp any, err error) {
+	interaction := serviceInteraction{Method: method}
+	if err != nil {
+		interaction.Error = err.Error()
+	}
+	var marshalErr error
+	if interaction.Request, marshalErr = json.Marshal(req); marshalErr != nil {
+		bklog.G(ctx).WithError(marshalErr).Errorf("failed to record %s request", method)
+		return
+	}
+	if interaction.Response, marshalErr = json.Marshal(resp); marshalErr != nil {
+		bklog.G(ctx).WithError(marshalErr).Errorf("failed to record %s response", method)
+		return
+	}
+	b, marshalErr := json.Marshal(interaction)
+	if marshalErr != nil {
+		bklog.G(ctx).WithError(marshalErr).Errorf("failed to record %s call", method)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		bklog.G(ctx).WithError(err).Errorf("failed to record %s call", method)
+	}
+}
+
+func (s *recordingService) GetConfig(ctx context.Context, req GetConfigRequest) (*Config, error) {
+	resp, err := s.svc.GetConfig(ctx, req)
+	s.record(ctx, "GetConfig", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) UpdateCacheRecords(ctx context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+	resp, err := s.svc.UpdateCacheRecords(ctx, req)
+	s.record(ctx, "UpdateCacheRecords", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) UpdateCacheLayers(ctx context.Context, req UpdateCacheLayersRequest) error {
+	err := s.svc.UpdateCacheLayers(ctx, req)
+	s.record(ctx, "UpdateCacheLayers", req, nil, err)
+	return err
+}
+
+func (s *recordingService) ImportCache(ctx context.Context, req ImportCacheRequest) (*ImportCacheResponse, error) {
+	resp, err := s.svc.ImportCache(ctx, req)
+	s.record(ctx, "ImportCache", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) GetLayerDownloadURL(ctx context.Context, req GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error) {
+	resp, err := s.svc.GetLayerDownloadURL(ctx, req)
+	s.record(ctx, "GetLayerDownloadURL", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) GetLayerUploadURL(ctx context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+	resp, err := s.svc.GetLayerUploadURL(ctx, req)
+	if resp != nil {
+		redacted := *resp
+		redacted.Headers = redactHeaders(resp.Headers)
+		s.record(ctx, "GetLayerUploadURL", req, redacted, err)
+	} else {
+		s.record(ctx, "GetLayerUploadURL", req, resp, err)
+	}
+	return resp, err
+}
+
+func (s *recordingService) GetLayerUploadURLs(ctx context.Context, req GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+	resp, err := s.svc.GetLayerUploadURLs(ctx, req)
+	if resp != nil {
+		redacted := GetLayerUploadURLsResponse{URLs: make(map[digest.Digest]GetLayerUploadURLResponse, len(resp.URLs))}
+		for dgst, url := range resp.URLs {
+			url.Headers = redactHeaders(url.Headers)
+			redacted.URLs[dgst] = url
+		}
+		s.record(ctx, "GetLayerUploadURLs", req, redacted, err)
+	} else {
+		s.record(ctx, "GetLayerUploadURLs", req, resp, err)
+	}
+	return resp, err
+}
+
+func (s *recordingService) GetAttestations(ctx context.Context, req GetAttestationsRequest) (*GetAttestationsResponse, error) {
+	resp, err := s.svc.GetAttestations(ctx, req)
+	s.record(ctx, "GetAttestations", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) GetCacheMountConfig(ctx context.Context, req GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error) {
+	resp, err := s.svc.GetCacheMountConfig(ctx, req)
+	s.record(ctx, "GetCacheMountConfig", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) GetCacheMountUploadURL(ctx context.Context, req GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error) {
+	resp, err := s.svc.GetCacheMountUploadURL(ctx, req)
+	if resp != nil {
+		redacted := *resp
+		redacted.Headers = redactHeaders(resp.Headers)
+		s.record(ctx, "GetCacheMountUploadURL", req, redacted, err)
+	} else {
+		s.record(ctx, "GetCacheMountUploadURL", req, resp, err)
+	}
+	return resp, err
+}
+
+func (s *recordingService) PruneCacheRecords(ctx context.Context, req PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error) {
+	resp, err := s.svc.PruneCacheRecords(ctx, req)
+	s.record(ctx, "PruneCacheRecords", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) LayersExist(ctx context.Context, req LayersExistRequest) (*LayersExistResponse, error) {
+	resp, err := s.svc.LayersExist(ctx, req)
+	s.record(ctx, "LayersExist", req, resp, err)
+	return resp, err
+}
+
+func (s *recordingService) Ping(ctx context.Context) error {
+	err := s.svc.Ping(ctx)
+	s.record(ctx, "Ping", struct{}{}, nil, err)
+	return err
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if _, ok := sensitiveHeaders[http.CanonicalHeaderKey(k)]; ok {
+			v = redactedHeaderValue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// replayService is a Service that serves the responses of a recording made by a
+// recordingService. Calls to each method are answered with the recorded responses for that
+// method in the order they were recorded, regardless of the request.
+type replayService struct {
+	mu           sync.Mutex
+	interactions map[string][]serviceInteraction
+}
+
+var _ Service = &replayService{}
+
+func newReplayService(r io.Reader) (*replayService, error) {
+	s := &replayService{
+		interactions: map[string][]serviceInteraction{},
+	}
+	decoder := json.NewDecoder(r)
+	for {
+		var interaction serviceInteraction
+		err := decoder.Decode(&interaction)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service recording: %w", err)
+		}
+		s.interactions[interaction.Method] = append(s.interactions[interaction.Method], interaction)
+	}
+	return s, nil
+}
+
+func replay[T any](s *replayService, method string) (*T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recorded := s.interactions[method]
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("no more recorded %s calls to replay", method)
+	}
+	interaction := recorded[0]
+	s.interactions[method] = recorded[1:]
+
+	if interaction.Error != "" {
+		return nil, errors.New(interaction.Error)
+	}
+	var resp T
+	if err := json.Unmarshal(interaction.Response, &resp); err != nil {
+		return nil, fmt.Errorf("failed to replay %s response: %w", method, err)
+	}
+	return &resp, nil
+}
+
+func (s *replayService) GetConfig(context.Context, GetConfigRequest) (*Config, error) {
+	return replay[Config](s, "GetConfig")
+}
+
+func (s *replayService) UpdateCacheRecords(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+	return replay[UpdateCacheRecordsResponse](s, "UpdateCacheRecords")
+}
+
+func (s *replayService) UpdateCacheLayers(context.Context, UpdateCacheLayersRequest) error {
+	_, err := replay[struct{}](s, "UpdateCacheLayers")
+	return err
+}
+
+func (s *replayService) ImportCache(context.Context, ImportCacheRequest) (*ImportCacheResponse, error) {
+	return replay[ImportCacheResponse](s, "ImportCache")
+}
+
+func (s *replayService) GetLayerDownloadURL(context.Context, GetLayerDownloadURLRequest) (*GetLayerDownloadURLResponse, error) {
+	return replay[GetLayerDownloadURLResponse](s, "GetLayerDownloadURL")
+}
+
+func (s *replayService) GetLayerUploadURL(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+	return replay[GetLayerUploadURLResponse](s, "GetLayerUploadURL")
+}
+
+func (s *replayService) GetAttestations(context.Context, GetAttestationsRequest) (*GetAttestationsResponse, error) {
+	return replay[GetAttestationsResponse](s, "GetAttestations")
+}
+
+func (s *replayService) GetCacheMountConfig(context.Context, GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error) {
+	return replay[GetCacheMountConfigResponse](s, "GetCacheMountConfig")
+}
+
+func (s *replayService) GetCacheMountUploadURL(context.Context, GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error) {
+	return replay[GetCacheMountUploadURLResponse](s, "GetCacheMountUploadURL")
+}
+
+func (s *replayService) PruneCacheRecords(context.Context, PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error) {
+	return replay[PruneCacheRecordsResponse](s, "PruneCacheRecords")
+}
+
+func (s *replayService) LayersExist(context.Context, LayersExistRequest) (*LayersExistResponse, error) {
+	return replay[LayersExistResponse](s, "LayersExist")
+}
+
+func (s *replayService) Ping(context.Context) error {
+	_, err := replay[struct{}](s, "Ping")
+	return err
+}
+
+func (s *replayService) GetLayerUploadURLs(context.Context, GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+	return replay[GetLayerUploadURLsResponse](s, "GetLayerUploadURLs")
+}
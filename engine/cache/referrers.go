@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/containerd/containerd/content"
+	"github.com/distribution/reference"
+	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxRegistryManifestBytes bounds how much of a referrers index, manifest or cache config is read
+// from a registry.
+const maxRegistryManifestBytes = 16 * 1024 * 1024
+
+// importReferrers imports each cache config referring to ReferrersSubject in its registry as a
+// cache manager of its own.
+func (m *manager) importReferrers(ctx context.Context) ([]solver.CacheManager, error) {
+	registry, subject, err := m.referrersRegistry()
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := registry.cacheReferrers(ctx, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	bklog.G(ctx).Debugf("found %d cache referrers of %s", len(manifests), m.ReferrersSubject)
+
+	var cacheManagers []solver.CacheManager
+	for i, manifestDesc := range manifests {
+		cacheConfig, descProvider, err := registry.cacheManifest(ctx, manifestDesc)
+		if err != nil {
+			return cacheManagers, fmt.Errorf("failed to fetch cache manifest %s: %w", manifestDesc.Digest, err)
+		}
+		if err := m.prepareCacheConfig(ctx, cacheConfig); err != nil {
+			return cacheManagers, err
+		}
+		cacheManager, err := m.parseCacheConfig(ctx, cacheConfig, descProvider, fmt.Sprintf("%s-referrers-import-%d", m.ID(), i))
+		if err != nil {
+			return cacheManagers, err
+		}
+		cacheManagers = append(cacheManagers, cacheManager)
+	}
+	return cacheManagers, nil
+}
+
+// referrersRegistry returns a client of the repository of ReferrersSubject, along with its digest.
+func (m *manager) referrersRegistry() (*registryClient, digest.Digest, error) {
+	named, err := reference.ParseNormalizedNamed(m.ReferrersSubject)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid referrers subject: %w", err)
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return nil, "", fmt.Errorf("referrers subject %s must be referenced by digest", m.ReferrersSubject)
+	}
+
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	scheme := "https"
+	if m.ReferrersPlainHTTP {
+		scheme = "http"
+	}
+	return &registryClient{
+		httpClient: withoutAuth(m.httpClient),
+		repoURL:    (&url.URL{Scheme: scheme, Host: host, Path: "/v2/" + reference.Path(named)}).String(),
+	}, digested.Digest(), nil
+}
+
+// registryClient reads cache published to a repository of an OCI distribution registry.
+type registryClient struct {
+	httpClient *http.Client
+	repoURL    string
+}
+
+// cacheReferrers returns the descriptors of the cache manifests referring to the given subject.
+func (c *registryClient) cacheReferrers(ctx context.Context, subject digest.Digest) ([]ocispecs.Descriptor, error) {
+	var index ocispecs.Index
+	err := c.getJSON(ctx, "/referrers/"+subject.String()+"?artifactType="+url.QueryEscape(remotecache.CacheConfigMediaTypeV0),
+		ocispecs.MediaTypeImageIndex, "", &index)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []ocispecs.Descriptor
+	for _, desc := range index.Manifests {
+		// registries may not support filtering by artifact type
+		if desc.ArtifactType == remotecache.CacheConfigMediaTypeV0 {
+			manifests = append(manifests, desc)
+		}
+	}
+	return manifests, nil
+}
+
+// cacheManifest returns the cache config of the given cache manifest, along with the providers
+// of its layers.
+func (c *registryClient) cacheManifest(
+	ctx context.Context,
+	manifestDesc ocispecs.Descriptor,
+) (*remotecache.CacheConfig, remotecache.DescriptorProvider, error) {
+	var manifest ocispecs.Manifest
+	if err := c.getJSON(ctx, "/manifests/"+manifestDesc.Digest.String(), ocispecs.MediaTypeImageManifest, manifestDesc.Digest, &manifest); err != nil {
+		return nil, nil, err
+	}
+	if manifest.Config.MediaType != remotecache.CacheConfigMediaTypeV0 {
+		return nil, nil, fmt.Errorf("config has media type %q, expected %q", manifest.Config.MediaType, remotecache.CacheConfigMediaTypeV0)
+	}
+	var cacheConfig remotecache.CacheConfig
+	if err := c.getJSON(ctx, "/blobs/"+manifest.Config.Digest.String(), "", manifest.Config.Digest, &cacheConfig); err != nil {
+		return nil, nil, err
+	}
+
+	descProvider := remotecache.DescriptorProvider{}
+	for _, layer := range manifest.Layers {
+		if _, err := compression.FromMediaType(layer.MediaType); err != nil {
+			return nil, nil, fmt.Errorf("layer %s has media type %q, whose compression is not supported by this engine: %w",
+				layer.Digest, layer.MediaType, err)
+		}
+		descProvider[layer.Digest] = remotecache.DescriptorProviderPair{
+			Descriptor: layer,
+			Provider:   c,
+		}
+	}
+	return &cacheConfig, descProvider, nil
+}
+
+// getJSON decodes the JSON content at the given path of the repository, verifying it has the
+// expected digest if one is given.
+func (c *registryClient) getJSON(ctx context.Context, path string, accept string, expected digest.Digest, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.repoURL+path, nil)
+	if err != nil {
+		return err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRegistryManifestBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRegistryManifestBytes {
+		return fmt.Errorf("response exceeds %d bytes", maxRegistryManifestBytes)
+	}
+	if expected != "" && expected.Algorithm().FromBytes(body) != expected {
+		return fmt.Errorf("content doesn't match digest %s", expected)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// ReaderAt reads a layer blob from the repository.
+func (c *registryClient) ReaderAt(ctx context.Context, desc ocispecs.Descriptor) (content.ReaderAt, error) {
+	return &urlReaderAt{
+		ctx:        ctx,
+		httpClient: c.httpClient,
+		url:        c.repoURL + "/blobs/" + desc.Digest.String(),
+		desc:       desc,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/moby/buildkit/util/bklog"
+)
+
+// ReloadConfig fetches the service's config again, having the periodic imports and exports pick
+// up the new periods without a restart. An invalid config is rejected, keeping the current one.
+func (m *manager) ReloadConfig(ctx context.Context) error {
+	config, err := m.service().GetConfig(ctx, GetConfigRequest{
+		EngineID:  m.EngineID,
+		Namespace: m.Namespace,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get cache config: %w", err)
+	}
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("invalid cache config: %w", err)
+	}
+	if err := m.checkNamespaces(config); err != nil {
+		return fmt.Errorf("invalid cache config: %w", err)
+	}
+
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	m.runtimeConfig = *config
+	// wake up the loops to reset their timers to the new periods
+	close(m.configReloaded)
+	m.configReloaded = make(chan struct{})
+	bklog.G(ctx).Debugf("reloaded cache config: %s", config)
+	return nil
+}
+
+// checkNamespaces returns an error if a Namespace is set but the service doesn't support them, in
+// which case it can't be used without importing records of other namespaces.
+func (m *manager) checkNamespaces(config *Config) error {
+	if m.Namespace != "" && !config.Namespaces {
+		return fmt.Errorf("cache service doesn't support namespaces, needed for namespace %q", m.Namespace)
+	}
+	return nil
+}
+
+// config returns the current config of the service.
+func (m *manager) config() Config {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	return m.runtimeConfig
+}
+
+// configReloadedCh returns a channel closed the next time the config is reloaded.
+func (m *manager) configReloadedCh() <-chan struct{} {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	return m.configReloaded
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/moby/buildkit/cache"
+	cacheconfig "github.com/moby/buildkit/cache/config"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/moby/buildkit/util/compression"
+)
+
+// RemoteSelection selects which of the remotes of a cache ref, i.e. the variants of its layers
+// in different compressions, are exported. The default, RemoteSelectFirst, exports the remote
+// in the export compression.
+type RemoteSelection struct {
+	all       bool
+	preferred compression.Type
+}
+
+var (
+	// RemoteSelectFirst exports just the remote in the export compression.
+	RemoteSelectFirst = RemoteSelection{}
+
+	// RemoteSelectAll exports the remote in the export compression along with all the other
+	// variants that exist locally, so importers can pick the one that suits them best, e.g.
+	// estargz for lazy pulling. Every variant's layers are stored by the service, multiplying
+	// the storage used by the cache by up to the number of variants.
+	RemoteSelectAll = RemoteSelection{all: true}
+)
+
+// PreferCompression exports the remote in the given compression if the cache ref already has
+// one, e.g. estargz for lazy pulling, or else the remote in the export compression. No layers are
+// compressed just to export them in the preferred compression.
+func PreferCompression(compressionType compression.Type) RemoteSelection {
+	return RemoteSelection{preferred: compressionType}
+}
+
+// exportRemotes returns the remotes whose layers should be pushed for the given ref, selected
+// according to RemoteSelection, the first being the main one. RemoteSelection doesn't apply with
+// ContentAwareCompression, which mixes compressions within a remote.
+func (m *manager) exportRemotes(ctx context.Context, cacheRef cache.ImmutableRef) ([]*solver.Remote, error) {
+	if !m.ContentAwareCompression {
+		switch {
+		case m.RemoteSelection.all:
+			return cacheRef.GetRemotes(ctx, true, cacheconfig.RefConfig{
+				Compression: m.exportCompression(),
+			}, true, nil)
+		case m.RemoteSelection.preferred != nil:
+			preferred, err := cacheRef.GetRemotes(ctx, false, cacheconfig.RefConfig{
+				Compression: compression.New(m.RemoteSelection.preferred).SetForce(true),
+			}, false, nil)
+			if err == nil && len(preferred) > 0 {
+				return preferred[:1], nil
+			}
+			bklog.G(ctx).Debugf("no %s remote for cache ref %s, using the export compression: %v", m.RemoteSelection.preferred, cacheRef.ID(), err)
+		}
+	}
+	remote, err := m.exportRemote(ctx, cacheRef)
+	if err != nil || remote == nil {
+		return nil, err
+	}
+	return []*solver.Remote{remote}, nil
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/containerd/containerd/content"
+	"github.com/moby/buildkit/util/bklog"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// the size of each part of a resumable upload if ResumableUploadPartSize isn't set
+const defaultResumableUploadPartSize = 64 * 1024 * 1024
+
+// resumableUpload returns whether the given layer should be uploaded resumably. Only plain
+// uploads of a layer's content can be: encrypted and chunked layers are uploaded as before, as
+// are layers uploaded over the gRPC transport.
+func (m *manager) resumableUpload(layerDesc ocispecs.Descriptor) bool {
+	return m.config().ResumableUploads &&
+		m.ResumableUploadThreshold > 0 &&
+		layerDesc.Size > m.ResumableUploadThreshold &&
+		m.LayerKeys == nil &&
+		!m.ChunkedLayers &&
+		m.uploader() == nil
+}
+
+// putBlobResumable uploads the given content in parts to a URL accepting resumable uploads. A
+// failed part is retried on its own, so that the upload resumes from the last uploaded part
+// rather than starting over.
+func (m *manager) putBlobResumable(ctx context.Context, uploadURL *GetLayerUploadURLResponse, readerAt content.ReaderAt) error {
+	size := readerAt.Size()
+	partSize := m.ResumableUploadPartSize
+	if partSize <= 0 {
+		partSize = defaultResumableUploadPartSize
+	}
+
+	policy := m.uploadRetryPolicy()
+	var uploaded int64 // confirmed by the service
+	for uploaded < size {
+		end := min(uploaded+partSize, size)
+		err := policy.do(ctx, func() error {
+			return m.putBlobPart(ctx, uploadURL, io.NewSectionReader(readerAt, uploaded, end-uploaded), uploaded, end, size)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload bytes %d-%d of %d: %w", uploaded, end, size, err)
+		}
+		bklog.G(ctx).Debugf("uploaded %d of %d bytes", end, size)
+		uploaded = end
+	}
+	m.uploadedBytes.Add(size)
+	return nil
+}
+
+// putBlobPart uploads bytes start to end (exclusive) of a blob of the given size.
+func (m *manager) putBlobPart(ctx context.Context, uploadURL *GetLayerUploadURLResponse, body io.Reader, start, end, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL.URL, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = end - start
+	for k, v := range uploadURL.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
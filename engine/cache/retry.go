@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	retryInitialBackoff = 100 * time.Millisecond
+	retryMaxBackoff     = 10 * time.Second
+)
+
+// retryPolicy determines how failed cache service calls and uploads are retried: with
+// exponential backoff, of which a fraction is randomized so that engines failing at the same time
+// don't all retry in lockstep, until the total time spent on a call would exceed maxDuration or
+// maxAttempts attempts have been made.
+type retryPolicy struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxDuration    time.Duration // unbounded if zero, no retries are made if maxAttempts is zero too
+	maxAttempts    int           // unbounded if zero
+	jitter         float64       // fraction of each backoff that's randomized, from 0 to 1
+}
+
+func (m *manager) retryPolicy() retryPolicy {
+	return retryPolicy{
+		initialBackoff: retryInitialBackoff,
+		maxBackoff:     retryMaxBackoff,
+		maxDuration:    m.RetryMaxDuration,
+		jitter:         m.RetryJitter,
+	}
+}
+
+// uploadRetryPolicy returns the retry policy of blob uploads, which UploadMaxAttempts and
+// UploadRetryDelay are applied to.
+func (m *manager) uploadRetryPolicy() retryPolicy {
+	policy := m.retryPolicy()
+	policy.maxAttempts = m.UploadMaxAttempts
+	if m.UploadRetryDelay > 0 {
+		policy.initialBackoff = m.UploadRetryDelay
+		policy.maxBackoff = max(policy.maxBackoff, m.UploadRetryDelay)
+	}
+	return policy
+}
+
+// retries returns whether the policy makes any retries at all.
+func (p retryPolicy) retries() bool {
+	return p.maxDuration > 0 || p.maxAttempts > 0
+}
+
+// do calls fn until it succeeds, fails with an error that isn't worth retrying, or the policy's
+// maximum duration would be exceeded by waiting for another attempt, or its maximum attempts have
+// been made. The last error is returned.
+func (p retryPolicy) do(ctx context.Context, fn func() error) error {
+	start := time.Now()
+	backoff := p.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !p.retries() || !isRetryable(err) {
+			return err
+		}
+		if p.maxAttempts > 0 && attempt >= p.maxAttempts {
+			return err
+		}
+		wait := p.jittered(backoff)
+		if p.maxDuration > 0 && time.Since(start)+wait > p.maxDuration {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff = min(2*backoff, p.maxBackoff)
+	}
+}
+
+// jittered returns a random duration between (1-jitter)*backoff and backoff.
+func (p retryPolicy) jittered(backoff time.Duration) time.Duration {
+	jitter := min(max(p.jitter, 0), 1)
+	return backoff - time.Duration(jitter*rand.Float64()*float64(backoff))
+}
+
+// isRetryable returns whether err is likely to be transient: a network error, or a response, or
+// gRPC status, indicating the server is overloaded or failed.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return respErr.statusCode == http.StatusTooManyRequests || respErr.statusCode >= 500
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryingService wraps a Service so that calls failing with transient errors are retried
+// according to a retryPolicy. The wrapped Service isn't embedded, so that a method added to
+// Service fails to compile until it's retried too.
+type retryingService struct {
+	svc    Service
+	policy retryPolicy
+}
+
+var _ Service = &retryingService{}
+
+func newRetryingService(svc Service, policy retryPolicy) *retryingService {
+	return &retryingService{
+		svc:    svc,
+		policy: policy,
+	}
+}
+
+func (s *retryingService) GetConfig(ctx context.Context, req GetConfigRequest) (resp *Config, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.GetConfig(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) UpdateCacheRecords(ctx context.Context, req UpdateCacheRecordsRequest) (resp *UpdateCacheRecordsResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.UpdateCacheRecords(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) UpdateCacheLayers(ctx context.Context, req UpdateCacheLayersRequest) error {
+	return s.policy.do(ctx, func() error {
+		return s.svc.UpdateCacheLayers(ctx, req)
+	})
+}
+
+func (s *retryingService) ImportCache(ctx context.Context, req ImportCacheRequest) (resp *ImportCacheResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.ImportCache(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) GetLayerDownloadURL(ctx context.Context, req GetLayerDownloadURLRequest) (resp *GetLayerDownloadURLResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.GetLayerDownloadURL(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) GetLayerUploadURL(ctx context.Context, req GetLayerUploadURLRequest) (resp *GetLayerUploadURLResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.GetLayerUploadURL(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) GetAttestations(ctx context.Context, req GetAttestationsRequest) (resp *GetAttestationsResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.GetAttestations(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) GetCacheMountConfig(ctx context.Context, req GetCacheMountConfigRequest) (resp *GetCacheMountConfigResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.GetCacheMountConfig(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) GetCacheMountUploadURL(ctx context.Context, req GetCacheMountUploadURLRequest) (resp *GetCacheMountUploadURLResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.GetCacheMountUploadURL(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) PruneCacheRecords(ctx context.Context, req PruneCacheRecordsRequest) (resp *PruneCacheRecordsResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.PruneCacheRecords(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (s *retryingService) LayersExist(ctx context.Context, req LayersExistRequest) (resp *LayersExistResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.LayersExist(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+// Ping isn't retried, as it's meant to tell whether the service is reachable right now.
+func (s *retryingService) Ping(ctx context.Context) error {
+	return s.svc.Ping(ctx)
+}
+
+func (s *retryingService) GetLayerUploadURLs(ctx context.Context, req GetLayerUploadURLsRequest) (resp *GetLayerUploadURLsResponse, err error) {
+	err = s.policy.do(ctx, func() error {
+		resp, err = s.svc.GetLayerUploadURLs(ctx, req)
+		return err
+	})
+	return resp, err
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/moby/buildkit/solver"
+	"github.com/opencontainers/go-digest"
+)
+
+// importScoped fetches the record with the given digest, along with the records it links to, and
+// adds it to the combined cache manager. It returns whether anything was imported; records are
+// only ever fetched once until the next resetScopedImports, whether the service has them or not.
+// Concurrent imports of the same record are deduped, while those of different records run in
+// parallel.
+func (m *manager) importScoped(ctx context.Context, dgst digest.Digest) (bool, error) {
+	ch := m.scopedImportGroup.DoChan(dgst.String(), func() (any, error) {
+		return m.doImportScoped(ctx, dgst)
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(bool), res.Err
+	case <-ctx.Done():
+		return false, context.Cause(ctx)
+	}
+}
+
+func (m *manager) doImportScoped(ctx context.Context, dgst digest.Digest) (bool, error) {
+	m.scopedImportMu.Lock()
+	if _, ok := m.scopedFetched[dgst]; ok {
+		m.scopedImportMu.Unlock()
+		return false, nil
+	}
+	id := fmt.Sprintf("%s-import-%d", m.ID(), m.scopedImportSeq)
+	m.scopedImportSeq++
+	gen := m.scopedImportGen
+	m.scopedImportMu.Unlock()
+
+	ctx, done, err := m.remoteContext(ctx)
+	if err != nil {
+		// nothing is imported while the service is disabled
+		return false, nil
+	}
+	defer done()
+
+	cacheConfig, err := m.service().ImportCache(ctx, ImportCacheRequest{
+		KeyPrefix:     m.KeyPrefix,
+		RecordDigests: []digest.Digest{dgst},
+		Namespace:     m.Namespace,
+	})
+	if err != nil {
+		return false, err
+	}
+	var importedCache solver.CacheManager
+	var attestations map[digest.Digest][]Attestation
+	if len(cacheConfig.Records) > 0 {
+		importedCache, attestations, err = m.loadCacheConfig(ctx, &cacheConfig.CacheConfig, id)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	m.scopedImportMu.Lock()
+	defer m.scopedImportMu.Unlock()
+	if m.scopedImportGen != gen {
+		// the scoped imports were dropped while this one was in flight
+		return false, nil
+	}
+	if m.scopedFetched == nil {
+		m.scopedFetched = map[digest.Digest]struct{}{}
+	}
+	m.scopedFetched[dgst] = struct{}{}
+	if importedCache == nil {
+		return false, nil
+	}
+	for _, record := range cacheConfig.Records {
+		m.scopedFetched[record.Digest] = struct{}{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.remoteDisabled {
+		return false, nil
+	}
+	m.scopedImports = append(m.scopedImports, importedCache)
+	m.inner = m.combine(m.scopedImports...)
+	m.importedAt = m.now()
+	for recordDigest, recordAttestations := range attestations {
+		if m.attestations == nil {
+			m.attestations = map[digest.Digest][]Attestation{}
+		}
+		m.attestations[recordDigest] = recordAttestations
+	}
+	return true, nil
+}
+
+// resetScopedImports drops all records fetched by scoped imports so far.
+func (m *manager) resetScopedImports() {
+	m.scopedImportMu.Lock()
+	defer m.scopedImportMu.Unlock()
+	m.scopedFetched = nil
+	m.scopedImportGen++
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scopedImports = nil
+	m.inner = m.combine()
+	m.importedAt = m.now()
+	m.attestations = nil
+}
@@ -2,11 +2,16 @@ package cache
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"time"
 
 	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
@@ -50,7 +55,7 @@ type Service interface {
 	UpdateCacheLayers(context.Context, UpdateCacheLayersRequest) error
 
 	// ImportCache returns a cache config that the engine can turn into cache manager.
-	ImportCache(context.Context) (*remotecache.CacheConfig, error)
+	ImportCache(context.Context, ImportCacheRequest) (*ImportCacheResponse, error)
 
 	// GetLayerDownloadURL returns a URL that the engine can use to download the layer blob. The URL
 	// is only valid for a limited time so this API should only be called right as the layer is needed.
@@ -60,6 +65,14 @@ type Service interface {
 	// valid for a limited time so this API should only be called right as the layer is to be uploaded.
 	GetLayerUploadURL(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error)
 
+	// GetLayerUploadURLs is the batch variant of GetLayerUploadURL, returning the URLs of multiple
+	// layers at once. It's only called if the service's config advertises it.
+	GetLayerUploadURLs(context.Context, GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error)
+
+	// GetAttestations returns the attestations exported along with the results of the given
+	// records, keyed by record digest.
+	GetAttestations(context.Context, GetAttestationsRequest) (*GetAttestationsResponse, error)
+
 	// GetCacheMountConfig returns a list of cache mounts that the engine should sync locally. It contains
 	// metadata like digest+size plus a time-limited URL that the engine can use to download the cache mounts.
 	GetCacheMountConfig(context.Context, GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error)
@@ -67,10 +80,26 @@ type Service interface {
 	// GetCacheMountUploadURL returns a URL that the engine can use to upload the cache mount blob. The URL is only
 	// valid for a limited time so this API should only be called right as the cache mount is to be uploaded.
 	GetCacheMountUploadURL(context.Context, GetCacheMountUploadURLRequest) (*GetCacheMountUploadURLResponse, error)
+
+	// PruneCacheRecords tells the cache service to drop the records of results older than the
+	// given age, including the given ones the engine has pruned locally, and then those of the
+	// least recently created results until the cache fits in the given size.
+	PruneCacheRecords(context.Context, PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error)
+
+	// LayersExist returns which of the given layers the cache service already has, so that the
+	// engine can skip uploading them. It's only called if the service's config advertises it.
+	LayersExist(context.Context, LayersExistRequest) (*LayersExistResponse, error)
+
+	// Ping checks that the cache service is reachable, without doing any work.
+	Ping(context.Context) error
 }
 
 type GetConfigRequest struct {
 	EngineID string
+
+	// Namespace, if set, scopes the request to the records of this namespace, see
+	// ManagerConfig.Namespace.
+	Namespace string `json:",omitempty"`
 }
 
 func (r GetConfigRequest) String() string {
@@ -85,7 +114,24 @@ type Config struct {
 	ImportPeriod  time.Duration
 	ExportPeriod  time.Duration
 	ExportTimeout time.Duration
-	// TODO: reload config period
+
+	// ResumableUploads advertises that the service can hand out layer upload URLs accepting
+	// resumable uploads, see GetLayerUploadURLRequest.
+	ResumableUploads bool `json:",omitempty"`
+
+	// LayersExist advertises that the service implements LayersExist.
+	LayersExist bool `json:",omitempty"`
+
+	// BatchLayerUploadURLs advertises that the service implements GetLayerUploadURLs.
+	BatchLayerUploadURLs bool `json:",omitempty"`
+
+	// Namespaces advertises that the service scopes records by the Namespace of requests.
+	Namespaces bool `json:",omitempty"`
+
+	// CacheGeneration, if set, identifies the current state of the records the service imports,
+	// changing whenever they do, like an ETag. Snapshots of imports saved to ChainCacheDir are
+	// stamped with the one returned by ImportCache, and only used while it's unchanged.
+	CacheGeneration string `json:",omitempty"`
 }
 
 func (c Config) String() string {
@@ -96,9 +142,56 @@ func (c Config) String() string {
 	return string(b)
 }
 
+const (
+	// bounds on the periods and timeouts a service may configure, so that a misbehaving service
+	// can't e.g. have the import loop spin
+	minConfigPeriod = time.Second
+	maxConfigPeriod = 24 * time.Hour
+
+	// maxConfigResponseBytes bounds how much of a GetConfig response is read
+	maxConfigResponseBytes = 1024 * 1024
+)
+
+// validate returns an error if any of the config's settings are outside of sane bounds.
+func (c Config) validate() error {
+	for _, setting := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"import period", c.ImportPeriod},
+		{"export period", c.ExportPeriod},
+		{"export timeout", c.ExportTimeout},
+	} {
+		if setting.value < minConfigPeriod || setting.value > maxConfigPeriod {
+			return fmt.Errorf("%s %s is out of range, must be between %s and %s",
+				setting.name, setting.value, minConfigPeriod, maxConfigPeriod)
+		}
+	}
+	return nil
+}
+
 type UpdateCacheRecordsRequest struct {
 	CacheKeys []CacheKey
 	Links     []Link
+
+	// Incremental is set when CacheKeys and Links only cover keys with results created since the
+	// previous export, rather than the full state of the engine's cache.
+	Incremental bool
+
+	// Delta is set when CacheKeys and Links are only the keys and links that were added or
+	// changed since the previous export, with RemovedCacheKeys and RemovedLinks those that were
+	// removed since.
+	Delta            bool
+	RemovedCacheKeys []string `json:",omitempty"`
+	RemovedLinks     []Link   `json:",omitempty"`
+
+	// MoreBatches is set when an export is split into several requests and this isn't the last
+	// of them, in which case the service should treat the batches as a single update.
+	MoreBatches bool
+
+	// Namespace, if set, scopes the request to the records of this namespace, see
+	// ManagerConfig.Namespace.
+	Namespace string `json:",omitempty"`
 }
 
 func (r UpdateCacheRecordsRequest) String() string {
@@ -126,6 +219,33 @@ type Result struct {
 	ID          string
 	CreatedAt   time.Time
 	Description string
+
+	// ExpiresAt is a hint of when the service may garbage collect the result. If nil, retention
+	// is left entirely up to the service.
+	ExpiresAt *time.Time
+
+	// Attestations describe how the result was produced, e.g. its provenance.
+	Attestations []Attestation
+
+	// Retention is the policy the service should retain the result with. If nil, retention is
+	// left up to the service.
+	Retention *RetentionPolicy
+}
+
+// RetentionPolicy describes how long and how preferentially the service should retain a result.
+type RetentionPolicy struct {
+	// TTL is how long after the export the result should be retained.
+	TTL time.Duration
+
+	// Priority orders results for eviction when the service needs to make room, with results
+	// of lower priority evicted first.
+	Priority int
+}
+
+// Attestation is an in-toto style attestation about a cache result.
+type Attestation struct {
+	PredicateType string
+	Predicate     json.RawMessage
 }
 
 type UpdateCacheRecordsResponse struct {
@@ -148,6 +268,10 @@ type ExportRecord struct {
 
 type UpdateCacheLayersRequest struct {
 	UpdatedRecords []RecordLayers
+
+	// Namespace, if set, scopes the request to the records of this namespace, see
+	// ManagerConfig.Namespace.
+	Namespace string `json:",omitempty"`
 }
 
 func (r UpdateCacheLayersRequest) String() string {
@@ -161,6 +285,42 @@ func (r UpdateCacheLayersRequest) String() string {
 type RecordLayers struct {
 	RecordDigest digest.Digest
 	Layers       []ocispecs.Descriptor
+
+	// Variants are other chains of the same layers, e.g. in other compressions, that importers
+	// can use in place of Layers. See RemoteSelectAll.
+	Variants [][]ocispecs.Descriptor `json:",omitempty"`
+}
+
+type ImportCacheRequest struct {
+	// KeyPrefix, if set, limits the cache config to records of cache keys exported with IDs
+	// starting with this prefix.
+	KeyPrefix string
+
+	// RecordDigests, if set, limits the cache config to the records with these digests and the
+	// records they (transitively) link to.
+	RecordDigests []digest.Digest
+
+	// Namespace, if set, scopes the request to the records of this namespace, see
+	// ManagerConfig.Namespace.
+	Namespace string `json:",omitempty"`
+}
+
+func (r ImportCacheRequest) String() string {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// ImportCacheResponse is the imported cache config, encoded as the config itself with
+// CacheGeneration alongside its fields.
+type ImportCacheResponse struct {
+	remotecache.CacheConfig
+
+	// CacheGeneration, if set, is the Config.CacheGeneration of the records imported, which a
+	// snapshot of them saved to ChainCacheDir is stamped with.
+	CacheGeneration string `json:",omitempty"`
 }
 
 type GetLayerDownloadURLRequest struct {
@@ -173,12 +333,42 @@ type GetLayerDownloadURLResponse struct {
 
 type GetLayerUploadURLRequest struct {
 	Digest digest.Digest
+
+	// Resumable asks for a URL accepting a resumable upload: the layer is uploaded in parts, each
+	// a PUT of the next range of it with a Content-Range header, with the upload complete once
+	// the last part is. The service may still hand out a URL for a single PUT instead.
+	Resumable bool `json:",omitempty"`
 }
 
 type GetLayerUploadURLResponse struct {
 	URL     string
 	Headers map[string]string
 	Skip    bool
+
+	// Resumable is set if URL accepts a resumable upload.
+	Resumable bool `json:",omitempty"`
+}
+
+type GetLayerUploadURLsRequest struct {
+	Layers []GetLayerUploadURLRequest
+}
+
+type GetLayerUploadURLsResponse struct {
+	// URLs are the upload URLs of the requested layers by layer digest. Layers missing from it
+	// have their URL requested with GetLayerUploadURL instead.
+	URLs map[digest.Digest]GetLayerUploadURLResponse
+}
+
+type GetAttestationsRequest struct {
+	RecordDigests []digest.Digest
+
+	// Namespace, if set, scopes the request to the records of this namespace, see
+	// ManagerConfig.Namespace.
+	Namespace string `json:",omitempty"`
+}
+
+type GetAttestationsResponse struct {
+	Attestations map[digest.Digest][]Attestation
 }
 
 type GetCacheMountConfigRequest struct{}
@@ -207,6 +397,35 @@ type GetCacheMountUploadURLResponse struct {
 	Skip    bool
 }
 
+type PruneCacheRecordsRequest struct {
+	// MaxAge, if set, is the age past which results are pruned.
+	MaxAge time.Duration `json:",omitempty"`
+
+	// KeepBytes, if set, is the size the service should prune its cache down to.
+	KeepBytes int64 `json:",omitempty"`
+
+	// CacheKeys are the keys whose results the engine pruned locally, along with those results.
+	CacheKeys []CacheKey `json:",omitempty"`
+
+	// Namespace, if set, scopes the request to the records of this namespace, see
+	// ManagerConfig.Namespace.
+	Namespace string `json:",omitempty"`
+}
+
+type PruneCacheRecordsResponse struct {
+	PrunedResults int
+	PrunedBytes   int64
+}
+
+type LayersExistRequest struct {
+	Digests []digest.Digest
+}
+
+type LayersExistResponse struct {
+	// Existing are those of the requested layers the service has.
+	Existing []digest.Digest
+}
+
 type client struct {
 	httpClient *http.Client
 	baseURL    string
@@ -215,7 +434,37 @@ type client struct {
 
 var _ Service = &client{}
 
-func newClient(urlString, token string) (Service, error) {
+// validateServiceURL parses the URL of a cache service, checking that it has a scheme the engine
+// supports and an address to connect to. If requireTLS is set, only schemes connecting over TLS
+// are accepted.
+func validateServiceURL(urlString string, requireTLS bool) (*url.URL, error) {
+	if urlString == "" {
+		return nil, errors.New("cache service URL is not set")
+	}
+	u, err := url.Parse(urlString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache service URL: %w", err)
+	}
+	switch u.Scheme {
+	case "https", "grpcs":
+	case "http", "grpc", "tcp", "unix":
+		if requireTLS {
+			return nil, fmt.Errorf("cache service URL %s is not secure, only https and grpcs are allowed when TLS is required", urlString)
+		}
+	default:
+		return nil, fmt.Errorf("cache service URL %s has unsupported scheme %q", urlString, u.Scheme)
+	}
+	if u.Scheme == "unix" {
+		if u.Path == "" {
+			return nil, fmt.Errorf("cache service URL %s has no socket path", urlString)
+		}
+	} else if u.Host == "" {
+		return nil, fmt.Errorf("cache service URL %s has no host", urlString)
+	}
+	return u, nil
+}
+
+func newClient(urlString, token string, tlsConfig *tls.Config) (Service, error) {
 	c := &client{}
 
 	u, err := url.Parse(urlString)
@@ -239,12 +488,76 @@ func newClient(urlString, token string) (Service, error) {
 	default:
 		c.baseURL = urlString
 		c.httpClient = &http.Client{}
+		if tlsConfig != nil {
+			c.httpClient.Transport = newTLSTransport(tlsConfig)
+		}
 	}
 
 	c.token = token
 	return c, nil
 }
 
+// loadTLSConfig builds the client TLS config used for mutual TLS with the cache service and
+// layer stores. It returns nil if no client certificate or CA is configured.
+func loadTLSConfig(certPath, keyPath, caPath string) (*tls.Config, error) {
+	if certPath == "" && keyPath == "" && caPath == "" {
+		return nil, nil
+	}
+	if (certPath == "") != (keyPath == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %w", certPath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caPath != "" {
+		caPEM, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func newTLSTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport
+}
+
+const (
+	// how long layer stores have to respond once a request has been sent, which doesn't include
+	// uploading or downloading the layer itself
+	layerResponseHeaderTimeout = time.Minute
+
+	// idle connections kept to each layer store, enough for concurrent uploads to reuse them
+	layerMaxIdleConnsPerHost = 32
+)
+
+// newLayerTransport returns the transport for requests to layer stores, which bounds how long
+// connecting and waiting for a response take, but not transferring layers of any size.
+func newLayerTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	transport.ResponseHeaderTimeout = layerResponseHeaderTimeout
+	transport.MaxIdleConnsPerHost = layerMaxIdleConnsPerHost
+	return transport
+}
+
 //nolint:dupl
 func (c *client) GetConfig(ctx context.Context, req GetConfigRequest) (*Config, error) {
 	bodyR, bodyW := io.Pipe()
@@ -274,8 +587,15 @@ func (c *client) GetConfig(ctx context.Context, req GetConfigRequest) (*Config,
 		return nil, err
 	}
 
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxConfigResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxConfigResponseBytes {
+		return nil, fmt.Errorf("config response exceeds %d bytes", maxConfigResponseBytes)
+	}
 	config := &Config{}
-	if err := json.NewDecoder(httpResp.Body).Decode(config); err != nil {
+	if err := json.Unmarshal(body, config); err != nil {
 		return nil, err
 	}
 	return config, nil
@@ -354,14 +674,25 @@ func (c *client) UpdateCacheLayers(
 	return nil
 }
 
-func (c *client) ImportCache(ctx context.Context) (*remotecache.CacheConfig, error) {
-	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/import", nil)
+//nolint:dupl
+func (c *client) ImportCache(ctx context.Context, req ImportCacheRequest) (*ImportCacheResponse, error) {
+	bodyR, bodyW := io.Pipe()
+	encoder := json.NewEncoder(bodyW)
+	go func() {
+		defer bodyW.Close()
+		if err := encoder.Encode(req); err != nil {
+			bklog.G(ctx).WithError(err).Error("failed to encode request")
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/import", bodyR)
 	if err != nil {
 		return nil, err
 	}
 	if len(c.token) > 0 {
 		httpReq.SetBasicAuth(c.token, "")
 	}
+	httpReq.Header.Set("Content-Type", "application/json")
 
 	httpResp, err := c.httpClient.Do(httpReq)
 	if err != nil {
@@ -372,11 +703,11 @@ func (c *client) ImportCache(ctx context.Context) (*remotecache.CacheConfig, err
 		return nil, err
 	}
 
-	config := &remotecache.CacheConfig{}
-	if err := json.NewDecoder(httpResp.Body).Decode(config); err != nil {
+	resp := &ImportCacheResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
 		return nil, err
 	}
-	return config, nil
+	return resp, nil
 }
 
 //nolint:dupl
@@ -451,6 +782,42 @@ func (c *client) GetLayerUploadURL(ctx context.Context, req GetLayerUploadURLReq
 	return resp, nil
 }
 
+//nolint:dupl
+func (c *client) GetAttestations(ctx context.Context, req GetAttestationsRequest) (*GetAttestationsResponse, error) {
+	bodyR, bodyW := io.Pipe()
+	encoder := json.NewEncoder(bodyW)
+	go func() {
+		defer bodyW.Close()
+		if err := encoder.Encode(req); err != nil {
+			bklog.G(ctx).WithError(err).Error("failed to encode request")
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/attestations", bodyR)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		httpReq.SetBasicAuth(c.token, "")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if err := checkResponse(httpResp); err != nil {
+		return nil, err
+	}
+
+	resp := &GetAttestationsResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
 //nolint:dupl
 func (c *client) GetCacheMountConfig(ctx context.Context, req GetCacheMountConfigRequest) (*GetCacheMountConfigResponse, error) {
 	bodyR, bodyW := io.Pipe()
@@ -522,3 +889,128 @@ func (c *client) GetCacheMountUploadURL(ctx context.Context, req GetCacheMountUp
 	}
 	return resp, nil
 }
+
+//nolint:dupl
+func (c *client) PruneCacheRecords(ctx context.Context, req PruneCacheRecordsRequest) (*PruneCacheRecordsResponse, error) {
+	bodyR, bodyW := io.Pipe()
+	encoder := json.NewEncoder(bodyW)
+	go func() {
+		defer bodyW.Close()
+		if err := encoder.Encode(req); err != nil {
+			bklog.G(ctx).WithError(err).Error("failed to encode request")
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/prune", bodyR)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		httpReq.SetBasicAuth(c.token, "")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if err := checkResponse(httpResp); err != nil {
+		return nil, err
+	}
+
+	resp := &PruneCacheRecordsResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+//nolint:dupl
+func (c *client) LayersExist(ctx context.Context, req LayersExistRequest) (*LayersExistResponse, error) {
+	bodyR, bodyW := io.Pipe()
+	encoder := json.NewEncoder(bodyW)
+	go func() {
+		defer bodyW.Close()
+		if err := encoder.Encode(req); err != nil {
+			bklog.G(ctx).WithError(err).Error("failed to encode request")
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/layers/exist", bodyR)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		httpReq.SetBasicAuth(c.token, "")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if err := checkResponse(httpResp); err != nil {
+		return nil, err
+	}
+
+	resp := &LayersExistResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+//nolint:dupl
+func (c *client) GetLayerUploadURLs(ctx context.Context, req GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+	bodyR, bodyW := io.Pipe()
+	encoder := json.NewEncoder(bodyW)
+	go func() {
+		defer bodyW.Close()
+		if err := encoder.Encode(req); err != nil {
+			bklog.G(ctx).WithError(err).Error("failed to encode request")
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/layerUploadURLs", bodyR)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.token) > 0 {
+		httpReq.SetBasicAuth(c.token, "")
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if err := checkResponse(httpResp); err != nil {
+		return nil, err
+	}
+
+	resp := &GetLayerUploadURLsResponse{}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *client) Ping(ctx context.Context) error {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	if len(c.token) > 0 {
+		httpReq.SetBasicAuth(c.token, "")
+	}
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	return checkResponse(httpResp)
+}
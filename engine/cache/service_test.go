@@ -0,0 +1,595 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/solver"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, parent *testCert, client bool) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "dagger-cache-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := tmpl, key
+	switch {
+	case parent == nil:
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	case client:
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		signer, signerKey = parent.cert, parent.key
+	default:
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	ctx := context.Background()
+
+	ca := newTestCert(t, nil, false)
+	serverCert := newTestCert(t, ca, false)
+	clientCert := newTestCert(t, ca, true)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.cert)
+	serverTLSCert, err := tls.X509KeyPair(serverCert.certPEM, serverCert.keyPEM)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Config{ImportPeriod: time.Minute})
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverTLSCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(caPath, ca.certPEM, 0600))
+	require.NoError(t, os.WriteFile(certPath, clientCert.certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyPath, clientCert.keyPEM, 0600))
+
+	t.Run("with client cert", func(t *testing.T) {
+		tlsConfig, err := loadTLSConfig(certPath, keyPath, caPath)
+		require.NoError(t, err)
+		c, err := newClient(srv.URL, "", tlsConfig)
+		require.NoError(t, err)
+		config, err := c.GetConfig(ctx, GetConfigRequest{})
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, config.ImportPeriod)
+	})
+
+	t.Run("without client cert", func(t *testing.T) {
+		tlsConfig, err := loadTLSConfig("", "", caPath)
+		require.NoError(t, err)
+		c, err := newClient(srv.URL, "", tlsConfig)
+		require.NoError(t, err)
+		_, err = c.GetConfig(ctx, GetConfigRequest{})
+		require.Error(t, err)
+	})
+
+	t.Run("invalid cert", func(t *testing.T) {
+		_, err := loadTLSConfig(certPath, caPath, "")
+		require.ErrorContains(t, err, "failed to load client certificate")
+		_, err = loadTLSConfig(certPath, "", "")
+		require.ErrorContains(t, err, "must be set together")
+	})
+}
+
+func TestValidateServiceURL(t *testing.T) {
+	for _, serviceURL := range []string{"https://cache.example.com", "grpcs://cache.example.com:443", "http://localhost:8080", "grpc://localhost:9090", "tcp://localhost:8080", "unix:///run/cache.sock"} {
+		_, err := validateServiceURL(serviceURL, false)
+		require.NoError(t, err, serviceURL)
+	}
+
+	_, err := validateServiceURL("", false)
+	require.ErrorContains(t, err, "not set")
+	_, err = validateServiceURL("ftp://cache.example.com", false)
+	require.ErrorContains(t, err, `unsupported scheme "ftp"`)
+	_, err = validateServiceURL("cache.example.com", false)
+	require.ErrorContains(t, err, "unsupported scheme")
+	_, err = validateServiceURL("https://", false)
+	require.ErrorContains(t, err, "has no host")
+	_, err = validateServiceURL("unix://", false)
+	require.ErrorContains(t, err, "has no socket path")
+	_, err = validateServiceURL("https://cache.example.com:port", false)
+	require.ErrorContains(t, err, "invalid cache service URL")
+
+	// only TLS is allowed when required
+	for _, serviceURL := range []string{"https://cache.example.com", "grpcs://cache.example.com:443"} {
+		_, err := validateServiceURL(serviceURL, true)
+		require.NoError(t, err, serviceURL)
+	}
+	for _, serviceURL := range []string{"http://cache.example.com", "grpc://cache.example.com:9090", "tcp://cache.example.com:8080"} {
+		_, err := validateServiceURL(serviceURL, true)
+		require.ErrorContains(t, err, "is not secure", serviceURL)
+	}
+
+	// which fails the manager at startup, for any of multiple services too
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+		ServiceURL:  "http://cache.example.com",
+		Token:       "test",
+		RequireTLS:  true,
+	}
+	_, err = NewManager(context.Background(), cfg)
+	require.ErrorContains(t, err, "is not secure")
+	cfg.ServiceURLs = []string{"https://cache.example.com", "http://cache.example.com"}
+	_, err = NewManager(context.Background(), cfg)
+	require.ErrorContains(t, err, "is not secure")
+}
+
+func TestRateLimitedService(t *testing.T) {
+	ctx := context.Background()
+
+	var calls int
+	svc := newRateLimitedService(&fakeService{
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			calls++
+			return &GetLayerUploadURLResponse{}, nil
+		},
+	}, 50, 1)
+
+	// the first call uses the burst, the other 10 are paced at 50/s
+	start := time.Now()
+	for range 11 {
+		_, err := svc.GetLayerUploadURL(ctx, GetLayerUploadURLRequest{})
+		require.NoError(t, err)
+	}
+	elapsed := time.Since(start)
+	require.Equal(t, 11, calls)
+	require.GreaterOrEqual(t, elapsed, 180*time.Millisecond)
+	require.Less(t, elapsed, 2*time.Second)
+
+	// waiting on the limiter respects cancellation
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := svc.GetLayerUploadURL(canceledCtx, GetLayerUploadURLRequest{})
+	require.Error(t, err)
+	require.Equal(t, 11, calls)
+}
+
+func TestServiceRecordReplay(t *testing.T) {
+	ctx := context.Background()
+
+	rootVertex := digest.FromString("root vertex")
+	var imports int
+	live := &fakeService{
+		importCache: func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+			imports++
+			if imports > 1 {
+				return nil, errors.New("service unavailable")
+			}
+			return &remotecache.CacheConfig{
+				Records: []remotecache.CacheRecord{{Digest: recordDigest(rootVertex, 0)}},
+			}, nil
+		},
+		updateCacheRecords: func(context.Context, UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+		getLayerUploadURL: func(context.Context, GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{
+				URL:     "https://store.example/upload",
+				Headers: map[string]string{"authorization": "secret-token", "Content-Type": "application/octet-stream"},
+			}, nil
+		},
+		getLayerUploadURLs: func(_ context.Context, req GetLayerUploadURLsRequest) (*GetLayerUploadURLsResponse, error) {
+			resp := &GetLayerUploadURLsResponse{URLs: map[digest.Digest]GetLayerUploadURLResponse{}}
+			for _, layer := range req.Layers {
+				resp.URLs[layer.Digest] = GetLayerUploadURLResponse{
+					URL:     "https://store.example/upload/" + layer.Digest.Encoded(),
+					Headers: map[string]string{"X-Amz-Security-Token": "secret-session"},
+				}
+			}
+			return resp, nil
+		},
+	}
+
+	// run a sequence of manager operations, describing the outcome of each
+	run := func(svc Service) []string {
+		m := newTestManager(svc, ManagerConfig{
+			KeyStore:    solver.NewInMemoryCacheStorage(),
+			ResultStore: &fakeResultStore{},
+		})
+		var outcomes []string
+		describe := func(op string, err error) {
+			keys, queryErr := m.Query(nil, 0, rootVertex, 0)
+			require.NoError(t, queryErr)
+			outcomes = append(outcomes, fmt.Sprintf("%s: err=%v keys=%d", op, err, len(keys)))
+		}
+		describe("import", m.Import(ctx))
+		describe("export", m.Export(ctx))
+		describe("import again", m.Import(ctx))
+		uploadURL, err := svc.GetLayerUploadURL(ctx, GetLayerUploadURLRequest{})
+		require.NoError(t, err)
+		outcomes = append(outcomes, "upload url: "+uploadURL.URL)
+		uploadURLs, err := svc.GetLayerUploadURLs(ctx, GetLayerUploadURLsRequest{
+			Layers: []GetLayerUploadURLRequest{{Digest: digest.FromString("layer")}},
+		})
+		require.NoError(t, err)
+		outcomes = append(outcomes, fmt.Sprintf("upload urls: %d", len(uploadURLs.URLs)))
+		return outcomes
+	}
+
+	var recording bytes.Buffer
+	recorded := run(newRecordingService(live, &recording))
+	require.Equal(t, []string{
+		"import: err=<nil> keys=1",
+		"export: err=<nil> keys=1",
+		"import again: err=service unavailable keys=1",
+		"upload url: https://store.example/upload",
+		"upload urls: 1",
+	}, recorded)
+	require.NotContains(t, recording.String(), "secret-token")
+	require.NotContains(t, recording.String(), "secret-session")
+	require.Contains(t, recording.String(), redactedHeaderValue)
+
+	replaySvc, err := newReplayService(bytes.NewReader(recording.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, recorded, run(replaySvc))
+
+	// the recording is exhausted
+	_, err = replaySvc.ImportCache(ctx, ImportCacheRequest{})
+	require.ErrorContains(t, err, "no more recorded ImportCache calls")
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	policy := retryPolicy{
+		initialBackoff: 20 * time.Millisecond,
+		maxBackoff:     20 * time.Millisecond,
+		maxDuration:    300 * time.Millisecond,
+		jitter:         0.5,
+	}
+
+	// backoffs are spread between (1-jitter)*backoff and backoff
+	backoffs := map[time.Duration]struct{}{}
+	for range 20 {
+		backoff := policy.jittered(100 * time.Millisecond)
+		require.GreaterOrEqual(t, backoff, 50*time.Millisecond)
+		require.LessOrEqual(t, backoff, 100*time.Millisecond)
+		backoffs[backoff] = struct{}{}
+	}
+	require.Greater(t, len(backoffs), 1)
+
+	// transient errors are retried until the max duration would be exceeded
+	var attempts int
+	start := time.Now()
+	err := policy.do(ctx, func() error {
+		attempts++
+		return &responseError{statusCode: http.StatusServiceUnavailable}
+	})
+	require.ErrorContains(t, err, "unexpected status code: 503")
+	require.Less(t, time.Since(start), policy.maxDuration+100*time.Millisecond)
+	require.Greater(t, attempts, 5)
+
+	// other errors aren't retried
+	attempts = 0
+	err = policy.do(ctx, func() error {
+		attempts++
+		return &responseError{statusCode: http.StatusBadRequest}
+	})
+	require.ErrorContains(t, err, "unexpected status code: 400")
+	require.Equal(t, 1, attempts)
+
+	// and neither is anything without a max duration
+	attempts = 0
+	policy.maxDuration = 0
+	err = policy.do(ctx, func() error {
+		attempts++
+		return &responseError{statusCode: http.StatusServiceUnavailable}
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+
+	// unless it has max attempts
+	attempts = 0
+	policy.maxAttempts = 4
+	err = policy.do(ctx, func() error {
+		attempts++
+		return &responseError{statusCode: http.StatusServiceUnavailable}
+	})
+	require.Error(t, err)
+	require.Equal(t, 4, attempts)
+
+	// the gRPC transport's transient errors are retried too
+	for code, retryable := range map[codes.Code]bool{
+		codes.Unavailable:       true,
+		codes.ResourceExhausted: true,
+		codes.DeadlineExceeded:  true,
+		codes.InvalidArgument:   false,
+		codes.PermissionDenied:  false,
+	} {
+		attempts = 0
+		err = policy.do(ctx, func() error {
+			attempts++
+			return status.Error(code, "failed")
+		})
+		require.Equal(t, code, status.Code(err))
+		if retryable {
+			require.Equal(t, 4, attempts, code)
+		} else {
+			require.Equal(t, 1, attempts, code)
+		}
+	}
+}
+
+func TestConfigBounds(t *testing.T) {
+	ctx := context.Background()
+
+	valid := Config{
+		ImportPeriod:  time.Minute,
+		ExportPeriod:  time.Minute,
+		ExportTimeout: 10 * time.Minute,
+	}
+	require.NoError(t, valid.validate())
+
+	spinning := valid
+	spinning.ImportPeriod = time.Nanosecond
+	require.ErrorContains(t, spinning.validate(), "import period 1ns is out of range")
+
+	unset := valid
+	unset.ExportTimeout = 0
+	require.ErrorContains(t, unset.validate(), "export timeout 0s is out of range")
+
+	tooLong := valid
+	tooLong.ExportPeriod = 365 * 24 * time.Hour
+	require.ErrorContains(t, tooLong.validate(), "export period 8760h0m0s is out of range")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a valid config padded out with whitespace past the response size limit
+		b, _ := json.Marshal(valid)
+		w.Write(b)
+		w.Write(bytes.Repeat([]byte(" "), maxConfigResponseBytes))
+	}))
+	defer srv.Close()
+
+	c, err := newClient(srv.URL, "", nil)
+	require.NoError(t, err)
+	_, err = c.GetConfig(ctx, GetConfigRequest{})
+	require.ErrorContains(t, err, "config response exceeds")
+}
+
+// grpcUnaryMethod returns a gRPC method of the cache service that serves calls with fn.
+func grpcUnaryMethod[Req, Resp any](name string, fn func(context.Context, Req) (Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			var req Req
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			return fn(ctx, req)
+		},
+	}
+}
+
+// newTestGRPCService serves svc over gRPC, keeping blobs uploaded with PutBlob in blobs by upload
+// URL, and returns its address.
+func newTestGRPCService(t *testing.T, svc *fakeService, blobs *sync.Map) string {
+	t.Helper()
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}), grpc.MaxRecvMsgSize(grpcMaxMessageSize))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: grpcServiceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{
+			grpcUnaryMethod("GetConfig", svc.GetConfig),
+			grpcUnaryMethod("UpdateCacheRecords", svc.UpdateCacheRecords),
+			grpcUnaryMethod("UpdateCacheLayers", func(ctx context.Context, req UpdateCacheLayersRequest) (struct{}, error) {
+				return struct{}{}, svc.UpdateCacheLayers(ctx, req)
+			}),
+			grpcUnaryMethod("ImportCache", svc.ImportCache),
+			grpcUnaryMethod("GetLayerDownloadURL", svc.GetLayerDownloadURL),
+			grpcUnaryMethod("GetLayerUploadURL", svc.GetLayerUploadURL),
+			grpcUnaryMethod("GetAttestations", svc.GetAttestations),
+			grpcUnaryMethod("GetCacheMountConfig", svc.GetCacheMountConfig),
+			grpcUnaryMethod("GetCacheMountUploadURL", svc.GetCacheMountUploadURL),
+			grpcUnaryMethod("PruneCacheRecords", svc.PruneCacheRecords),
+			grpcUnaryMethod("LayersExist", svc.LayersExist),
+			grpcUnaryMethod("GetLayerUploadURLs", svc.GetLayerUploadURLs),
+			grpcUnaryMethod("Ping", func(ctx context.Context, _ struct{}) (struct{}, error) {
+				return struct{}{}, svc.Ping(ctx)
+			}),
+		},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "PutBlob",
+			ClientStreams: true,
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				var first PutBlobChunk
+				if err := stream.RecvMsg(&first); err != nil {
+					return err
+				}
+				data := first.Data
+				for {
+					var chunk PutBlobChunk
+					err := stream.RecvMsg(&chunk)
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						return err
+					}
+					data = append(data, chunk.Data...)
+				}
+				if int64(len(data)) != first.Size {
+					return fmt.Errorf("got %d bytes, expected %d", len(data), first.Size)
+				}
+				blobs.Store(first.UploadURL, data)
+				return stream.SendMsg(&struct{}{})
+			},
+		}},
+	}, nil)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestGRPCTransport(t *testing.T) {
+	ctx := context.Background()
+
+	var exported []UpdateCacheRecordsRequest
+	svc := &fakeService{
+		getConfig: func(ctx context.Context, _ GetConfigRequest) (*Config, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Basic c2VjcmV0Og==" {
+				return nil, fmt.Errorf("unexpected authorization %v", auth)
+			}
+			return &Config{ImportPeriod: time.Minute, ExportPeriod: time.Minute, ExportTimeout: time.Minute}, nil
+		},
+		updateCacheRecords: func(_ context.Context, req UpdateCacheRecordsRequest) (*UpdateCacheRecordsResponse, error) {
+			exported = append(exported, req)
+			return &UpdateCacheRecordsResponse{}, nil
+		},
+		getLayerUploadURL: func(_ context.Context, req GetLayerUploadURLRequest) (*GetLayerUploadURLResponse, error) {
+			return &GetLayerUploadURLResponse{URL: "upload/" + req.Digest.String()}, nil
+		},
+	}
+	var blobs sync.Map
+	client, err := newGRPCClient(newTestGRPCService(t, svc, &blobs), "secret", nil, nil)
+	require.NoError(t, err)
+	defer client.Close()
+
+	config, err := client.GetConfig(ctx, GetConfigRequest{})
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, config.ImportPeriod)
+
+	// exports send the same records over gRPC as they do directly
+	cfg := ManagerConfig{
+		KeyStore:    solver.NewInMemoryCacheStorage(),
+		ResultStore: &fakeResultStore{},
+	}
+	addTestResult(t, cfg, "key", "ref", time.Now())
+	require.NoError(t, newTestManager(svc, cfg).Export(ctx))
+	grpcManager := newTestManager(client, cfg)
+	grpcManager.blobUploader = client
+	require.NoError(t, grpcManager.Export(ctx))
+	require.Len(t, exported, 2)
+	require.Equal(t, exported[0].String(), exported[1].String())
+
+	// layers spanning several chunks are streamed over the connection
+	data, desc, provider := newTestLayer(t, 3*grpcBlobChunkSize+1)
+	require.NoError(t, grpcManager.pushLayer(ctx, desc, provider))
+	uploaded, ok := blobs.Load("upload/" + desc.Digest.String())
+	require.True(t, ok)
+	require.Equal(t, data, uploaded)
+
+	// configs larger than gRPC's default message size are imported, and exported, as they are
+	// over HTTP
+	large := &remotecache.CacheConfig{}
+	for i := 0; len(large.Layers)*100 < 5*1024*1024; i++ {
+		large.Layers = append(large.Layers, remotecache.CacheLayer{
+			Blob:        digest.FromString(fmt.Sprintf("layer-%d", i)),
+			ParentIndex: -1,
+		})
+	}
+	svc.importCache = func(context.Context, ImportCacheRequest) (*remotecache.CacheConfig, error) {
+		return large, nil
+	}
+	imported, err := client.ImportCache(ctx, ImportCacheRequest{})
+	require.NoError(t, err)
+	require.Len(t, imported.Layers, len(large.Layers))
+	var keys []CacheKey
+	for _, layer := range large.Layers {
+		keys = append(keys, CacheKey{ID: layer.Blob.String()})
+	}
+	_, err = client.UpdateCacheRecords(ctx, UpdateCacheRecordsRequest{CacheKeys: keys})
+	require.NoError(t, err)
+	require.Len(t, exported[len(exported)-1].CacheKeys, len(keys))
+}
+
+func TestGRPCDialOptions(t *testing.T) {
+	ctx := context.Background()
+
+	var blobs sync.Map
+	target := newTestGRPCService(t, &fakeService{}, &blobs)
+	var methods []string
+	m := newTestManager(nil, ManagerConfig{
+		ServiceKeepalive: time.Minute,
+		GRPCDialOptions: []grpc.DialOption{
+			grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				methods = append(methods, method)
+				return invoker(ctx, method, req, reply, cc, opts...)
+			}),
+		},
+	})
+	require.Len(t, m.grpcDialOptions(), 2)
+
+	// the options the connection is dialed with apply to calls made over it
+	client, err := newGRPCClient(target, "secret", nil, nil, m.grpcDialOptions()...)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.GetConfig(ctx, GetConfigRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/" + grpcServiceName + "/GetConfig"}, methods)
+}
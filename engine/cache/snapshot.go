@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/opencontainers/go-digest"
+)
+
+// chainSnapshot is the cache config of an import saved to ChainCacheDir, along with the
+// generation of the service's cache it was imported at.
+type chainSnapshot struct {
+	Generation  string
+	ImportedAt  time.Time
+	CacheConfig json.RawMessage
+}
+
+// chainSnapshotPath returns the file imports are saved to, which differs for each service,
+// namespace and key prefix so that managers can share ChainCacheDir.
+func (m *manager) chainSnapshotPath() string {
+	id := digest.FromString(strings.Join([]string{m.ServiceURL, m.Namespace, m.KeyPrefix}, "\n"))
+	return filepath.Join(m.ChainCacheDir, id.Encoded()+".json")
+}
+
+// saveChainSnapshot saves the cache config of an import, replacing the previous snapshot. The
+// snapshot is written to a temporary file first, so that a crash never leaves a partial one.
+func (m *manager) saveChainSnapshot(generation string, importedAt time.Time, cacheConfig []byte) error {
+	b, err := json.Marshal(chainSnapshot{
+		Generation:  generation,
+		ImportedAt:  importedAt,
+		CacheConfig: cacheConfig,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.ChainCacheDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(m.ChainCacheDir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), m.chainSnapshotPath())
+}
+
+// loadChainSnapshot replaces the imported cache with the saved snapshot of the last import,
+// returning whether there was one imported at the given generation. Snapshots of other
+// generations are stale, and services that don't report a generation can't tell, so they're
+// never loaded.
+func (m *manager) loadChainSnapshot(ctx context.Context, generation string) (bool, error) {
+	if generation == "" {
+		return false, nil
+	}
+	b, err := os.ReadFile(m.chainSnapshotPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var snapshot chainSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return false, err
+	}
+	if snapshot.Generation != generation {
+		return false, nil
+	}
+	var cacheConfig remotecache.CacheConfig
+	if err := json.Unmarshal(snapshot.CacheConfig, &cacheConfig); err != nil {
+		return false, err
+	}
+
+	importedCache, attestations, err := m.loadCacheConfig(ctx, &cacheConfig, m.ID()+"-snapshot")
+	if err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inner = m.combine(importedCache)
+	m.importedAt = snapshot.ImportedAt
+	m.attestations = attestations
+	return true, nil
+}
@@ -11,15 +11,25 @@ var (
 	urlRegex = regexp.MustCompile("(https://[^/]*)/[^ ]*")
 )
 
+// responseError is returned for responses with an unexpected status code.
+type responseError struct {
+	statusCode int
+	body       string
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d: %s", e.statusCode, e.body)
+}
+
 func checkResponse(resp *http.Response) error {
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		return nil
 	}
 
 	body, _ := io.ReadAll(resp.Body)
-	return fmt.Errorf("unexpected status code: %d: %s",
-		resp.StatusCode,
+	return &responseError{
+		statusCode: resp.StatusCode,
 		// strip away URL paths to avoid leaking pre-signed URLs
-		urlRegex.ReplaceAllString(string(body), "$1/*****"),
-	)
+		body: urlRegex.ReplaceAllString(string(body), "$1/*****"),
+	}
 }
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/leases"
+	"github.com/moby/buildkit/cache"
+	remotecache "github.com/moby/buildkit/cache/remotecache/v1"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/moby/buildkit/util/leaseutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// loadRemoteFunc loads a result from its layers, like worker.Worker's FromRemote.
+type loadRemoteFunc func(context.Context, *solver.Remote) (cache.ImmutableRef, error)
+
+// warmKeys fetches the records of WarmKeys from the service, copies the layers of their results
+// to the given store and loads the results from them, so that builds using them don't have to
+// wait for the layers to be downloaded first. Layers already in the store aren't downloaded again.
+//
+// The layers are held by a temporary lease until their results are loaded, after which the
+// results' refs keep them from being garbage collected.
+func (m *manager) warmKeys(ctx context.Context, store content.Ingester, lm leases.Manager, load loadRemoteFunc) error {
+	warmStart := time.Now()
+	cacheConfig, err := m.service().ImportCache(ctx, ImportCacheRequest{
+		KeyPrefix:     m.KeyPrefix,
+		RecordDigests: m.WarmKeys,
+		Namespace:     m.Namespace,
+	})
+	if err != nil {
+		return err
+	}
+
+	// only the results of the records asked for, not of those they link to, each as its chain of
+	// layers from the base one up
+	warm := map[digest.Digest]struct{}{}
+	for _, dgst := range m.WarmKeys {
+		warm[dgst] = struct{}{}
+	}
+	var chains [][]int
+	for _, record := range cacheConfig.Records {
+		if _, ok := warm[record.Digest]; !ok {
+			continue
+		}
+		for _, result := range record.Results {
+			// a result's layer is the top of its chain, with the rest found through its parents
+			var chain []int
+			for i := result.LayerIndex; i >= 0 && i < len(cacheConfig.Layers) && !slices.Contains(chain, i); i = cacheConfig.Layers[i].ParentIndex {
+				chain = append(chain, i)
+			}
+			slices.Reverse(chain)
+			chains = append(chains, chain)
+		}
+		for _, result := range record.ChainedResults {
+			var chain []int
+			for _, i := range result.LayerIndexes {
+				if i >= 0 && i < len(cacheConfig.Layers) {
+					chain = append(chain, i)
+				}
+			}
+			chains = append(chains, chain)
+		}
+	}
+
+	provider := m.layerProvider.forImport()
+	providerPairs := map[int]*remotecache.DescriptorProviderPair{}
+	for _, chain := range chains {
+		for _, i := range chain {
+			if _, ok := providerPairs[i]; ok {
+				continue
+			}
+			providerPair, err := m.descriptorProviderPair(cacheConfig.Layers[i], provider)
+			if err != nil {
+				return err
+			}
+			providerPairs[i] = providerPair
+		}
+	}
+
+	ctx, done, err := leaseutil.WithLease(ctx, lm, leaseutil.MakeTemporary)
+	if err != nil {
+		return fmt.Errorf("failed to create lease: %w", err)
+	}
+	defer done(context.WithoutCancel(ctx))
+
+	for _, providerPair := range providerPairs {
+		desc := providerPair.Descriptor
+		if err := contentutil.Copy(ctx, store, provider, desc, "", nil); err != nil {
+			return fmt.Errorf("failed to warm layer %s: %w", desc.Digest, err)
+		}
+	}
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+		remote := &solver.Remote{}
+		multiProvider := contentutil.NewMultiProvider(nil)
+		for _, i := range chain {
+			providerPair := providerPairs[i]
+			remote.Descriptors = append(remote.Descriptors, providerPair.Descriptor)
+			multiProvider.Add(providerPair.Descriptor.Digest, *providerPair)
+		}
+		remote.Provider = multiProvider
+		ref, err := load(ctx, remote)
+		if err != nil {
+			return fmt.Errorf("failed to load warmed result: %w", err)
+		}
+		if err := ref.Release(context.WithoutCancel(ctx)); err != nil {
+			return err
+		}
+	}
+	bklog.G(ctx).Debugf("warmed %d layers of %d cache records in %s", len(providerPairs), len(m.WarmKeys), time.Since(warmStart))
+	return nil
+}